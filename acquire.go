@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrPoolBusy means no database connection became free within the
+// acquire timeout. It maps to 503 so clients back off and retry instead of
+// piling more requests onto a saturated pool.
+var ErrPoolBusy = errors.New("pool busy")
+
+var poolBusy = newCounter("db_pool_busy_total",
+	"Requests rejected because no database connection was free within DB_ACQUIRE_TIMEOUT.")
+
+// acquire takes a connection from db, waiting at most h.acquireTimeout for
+// one to free up. The timeout bounds only the wait; queries on the
+// returned connection run under ctx. The caller must Release it.
+func (h *Handler) acquire(ctx context.Context, db *pgxpool.Pool) (*pgxpool.Conn, error) {
+	if h.acquireTimeout <= 0 {
+		return db.Acquire(ctx)
+	}
+	actx, cancel := context.WithTimeout(ctx, h.acquireTimeout)
+	defer cancel()
+	conn, err := db.Acquire(actx)
+	if err != nil && ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+		poolBusy.Inc()
+		return nil, ErrPoolBusy
+	}
+	return conn, err
+}
+
+// registerPoolMetrics publishes the connection pool statistics of every
+// primary shard, summed, so pool saturation shows up next to
+// db_pool_busy_total. They are read from pgxpool on each scrape.
+func registerPoolMetrics(db ShardRouter) {
+	stat := func(fn func(*pgxpool.Stat) float64) func() float64 {
+		return func() float64 {
+			var sum float64
+			for _, pool := range db.All() {
+				sum += fn(pool.Stat())
+			}
+			return sum
+		}
+	}
+	newGaugeFunc("db_pool_acquired_conns", "Connections currently checked out of the pool.",
+		stat(func(s *pgxpool.Stat) float64 { return float64(s.AcquiredConns()) }))
+	newGaugeFunc("db_pool_idle_conns", "Idle connections in the pool.",
+		stat(func(s *pgxpool.Stat) float64 { return float64(s.IdleConns()) }))
+	newGaugeFunc("db_pool_total_conns", "Open connections in the pool, acquired, idle or being established.",
+		stat(func(s *pgxpool.Stat) float64 { return float64(s.TotalConns()) }))
+	newCounterFunc("db_pool_acquires_total", "Connections acquired from the pool.",
+		stat(func(s *pgxpool.Stat) float64 { return float64(s.AcquireCount()) }))
+	newCounterFunc("db_pool_empty_acquires_total", "Acquires that had to wait because no idle connection was available.",
+		stat(func(s *pgxpool.Stat) float64 { return float64(s.EmptyAcquireCount()) }))
+	newCounterFunc("db_pool_acquire_duration_seconds_total", "Total time spent waiting to acquire connections.",
+		stat(func(s *pgxpool.Stat) float64 { return s.AcquireDuration().Seconds() }))
+}
+
+// dbError responds 503 for ErrPoolBusy and 500 for anything else.
+func dbError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrPoolBusy) {
+		log.Printf("Database pool busy [request %s] %s %s", requestID(r.Context()), r.Method, r.URL.Path)
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "database busy, retry later",
+		})
+		return
+	}
+	internalError(w, r, err)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolSaturationIsBusy(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := f.pool(t)
+	h := &Handler{db: NewHashRouter(db), read: NewHashRouter(db), acquireTimeout: 20 * time.Millisecond}
+
+	// Check out every connection so nothing frees up within the timeout.
+	for i := int32(0); i < db.Config().MaxConns; i++ {
+		conn, err := db.Acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Release()
+	}
+
+	before := poolBusy.Value()
+	if _, err := h.acquire(context.Background(), db); !errors.Is(err, ErrPoolBusy) {
+		t.Errorf("acquire = %v, want ErrPoolBusy", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.acquire(ctx, db); errors.Is(err, ErrPoolBusy) {
+		t.Error("a cancelled request reported the pool busy")
+	}
+
+	req := httptest.NewRequest("POST", "/event", strings.NewReader(validEvent("")))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.Event(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("event on a saturated pool: %d %s, want 503", rec.Code, rec.Body)
+	}
+	if got := poolBusy.Value() - before; got != 2 {
+		t.Errorf("db_pool_busy_total went up %v, want 2", got)
+	}
+}
+
+// metricValue returns the value of the unlabelled series name in a scrape.
+func metricValue(t *testing.T, scrape, name string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(scrape, "\n") {
+		if v, ok := strings.CutPrefix(line, name+" "); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return f
+		}
+	}
+	t.Fatalf("%s missing from /metrics:\n%s", name, scrape)
+	return 0
+}
+
+func TestPoolMetricsFollowAcquires(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{} })
+	db := f.pool(t)
+	registerPoolMetrics(NewHashRouter(db))
+
+	before := scrapeMetrics(t, "")
+	for _, name := range []string{"db_pool_acquired_conns", "db_pool_idle_conns", "db_pool_total_conns",
+		"db_pool_acquires_total", "db_pool_empty_acquires_total", "db_pool_acquire_duration_seconds_total"} {
+		metricValue(t, before, name)
+	}
+
+	conn, err := db.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	after := scrapeMetrics(t, "")
+	for name, want := range map[string]float64{
+		"db_pool_acquired_conns": 1,
+		"db_pool_acquires_total": 1,
+	} {
+		if got := metricValue(t, after, name) - metricValue(t, before, name); got != want {
+			t.Errorf("%s went up %v after one acquire, want %v", name, got, want)
+		}
+	}
+}
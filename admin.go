@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// adminOnly rejects requests that don't carry the configured admin key as
+// a bearer token. Admin endpoints are disabled when no key is configured.
+func (h *Handler) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.adminKey == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{
+				"error": "admin endpoints are disabled",
+			})
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			unauthorized(w, "", "missing Authorization header, expected a Bearer token")
+			return
+		}
+		key, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok {
+			unauthorized(w, "invalid_request", "Authorization header must use the Bearer scheme")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(h.adminKey)) != 1 {
+			unauthorized(w, "invalid_token", "invalid admin key")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// unauthorized writes the 401 shared by all admin endpoints. The
+// WWW-Authenticate header tells clients which scheme is expected and, per
+// RFC 6750, an error code when a token was sent but rejected.
+func unauthorized(w http.ResponseWriter, code, message string) {
+	challenge := `Bearer realm="admin"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error=%q`, code)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeJSON(w, http.StatusUnauthorized, map[string]string{
+		"error": message,
+	})
+}
+
+// Config shows the configuration this instance loaded, with secrets
+// redacted.
+func (h *Handler) Config(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.config.Redacted())
+}
+
+// Requeue moves every event stuck in 'processing' back to 'pending'.
+func (h *Handler) Requeue(w http.ResponseWriter, r *http.Request) {
+	var requeued int
+	for _, db := range h.db.All() {
+		ids, err := updateStatus(r.Context(), db, "processing", "pending")
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		for _, id := range ids {
+			h.hook.Fire(id, "processing", "pending")
+		}
+		requeued += len(ids)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{
+		"requeued": requeued,
+	})
+}
+
+// Poll has a worker process one batch immediately, which lets tests and
+// operators avoid waiting for the poll interval.
+func (h *Handler) Poll(w http.ResponseWriter, r *http.Request) {
+	claimed, err := h.pool.PollNow(r.Context())
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{
+		"claimed": claimed,
+	})
+}
+
+// updateStatus moves every event in status from to status to and returns
+// the IDs it changed.
+func updateStatus(ctx context.Context, db *pgxpool.Pool, from, to string) ([]string, error) {
+	rows, err := db.Query(ctx, "UPDATE cart_events SET status = $2 WHERE status = $1 RETURNING id::text", from, to)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// hostAllowed reports whether the host of websiteURL is on the allowlist.
+// "*.example.com" matches any subdomain of example.com but not
+// example.com itself. An empty allowlist allows every host.
+func hostAllowed(websiteURL string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	u, err := url.Parse(websiteURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostAllowed(t *testing.T) {
+	allowed := []string{"shop.example.com", "*.example.org"}
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://shop.example.com/cart", true},
+		{"https://SHOP.Example.com:8443/cart", true},
+		{"https://example.com/cart", false},
+		{"https://evil.com/shop.example.com", false},
+		{"https://shop.example.com.evil.com/", false},
+		{"https://a.example.org/", true},
+		{"https://a.b.example.org/", true},
+		{"https://example.org/", false},
+		{"https://badexample.org/", false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.url, allowed); got != tt.want {
+			t.Errorf("hostAllowed(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+	if !hostAllowed("https://anything.test/", nil) {
+		t.Error("an empty allowlist rejected a host")
+	}
+}
+
+func TestEventFromDisallowedHostForbidden(t *testing.T) {
+	h := &Handler{allowedHosts: []string{"*.example.org"}}
+	req := httptest.NewRequest("POST", "/event", strings.NewReader(validEvent("")))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.Event(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("event from example.com: %d %s, want 403", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type EventAttempt struct {
+	AttemptNumber int       `json:"attemptNumber"`
+	Status        string    `json:"status"`
+	Error         *string   `json:"error,omitempty"`
+	AttemptedAt   time.Time `json:"attemptedAt"`
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// recordAttempt appends a row to the event's audit trail. Failing to write
+// it is logged but never blocks processing.
+func recordAttempt(db *pgxpool.Pool, eventID string, notifyErr error) {
+	status := "processed"
+	var errText *string
+	if notifyErr != nil {
+		status = "failed"
+		msg := notifyErr.Error()
+		errText = &msg
+	}
+
+	_, err := db.Exec(context.Background(), `
+	INSERT INTO event_attempts (event_id, attempt_number, status, error)
+	SELECT $1, COALESCE(MAX(attempt_number), 0) + 1, $2, $3
+	FROM event_attempts WHERE event_id = $1`,
+		eventID, status, errText)
+	if err != nil {
+		log.Println("Failed to record attempt:", err.Error())
+	}
+}
+
+func (h *Handler) Attempts(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !uuidPattern.MatchString(id) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "invalid event id",
+		})
+		return
+	}
+
+	// A tenant owns the attempts of its events, including dead-lettered
+	// ones when that table exists.
+	owned := "SELECT id FROM cart_events WHERE tenant_id = $2"
+	if h.deadLetters {
+		owned += " UNION ALL SELECT id FROM dead_letter_events WHERE tenant_id = $2"
+	}
+	attempts := []EventAttempt{}
+	for _, db := range h.read.All() {
+		rows, err := db.Query(r.Context(), `
+		SELECT attempt_number, status, error, attempted_at
+		FROM event_attempts
+		WHERE event_id = $1
+		AND ($2::text = '' OR event_id IN (`+owned+`))
+		ORDER BY attempt_number`, id, tenantID(r.Context()))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+
+		for rows.Next() {
+			var a EventAttempt
+			if err := rows.Scan(&a.AttemptNumber, &a.Status, &a.Error, &a.AttemptedAt); err != nil {
+				rows.Close()
+				internalError(w, r, err)
+				return
+			}
+			attempts = append(attempts, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			internalError(w, r, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]EventAttempt{
+		"attempts": attempts,
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// failingTimes returns a notifier that fails its first n calls.
+func failingTimes(n int) Notifier {
+	calls := 0
+	return notifierFunc(func(context.Context, PGCartEvent) error {
+		calls++
+		if calls <= n {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})
+}
+
+func TestAttemptRecordedPerTry(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+	f := newFakePG(t, queue.handle)
+	db := f.pool(t)
+	captureLog(t)
+
+	p := &Pool{batchSize: 10, notifier: failingTimes(2)}
+	for i := 0; i < 3; i++ {
+		if _, err := p.process(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for _, q := range f.Queries() {
+		if !containsAll(q, "INSERT INTO event_attempts", fakeID(1)) {
+			continue
+		}
+		for _, status := range []string{"failed", "processed"} {
+			if strings.Contains(q, "'"+status+"'") {
+				got = append(got, status)
+			}
+		}
+	}
+	if want := "failed,failed,processed"; strings.Join(got, ",") != want {
+		t.Errorf("attempts recorded = %v, want %s", got, want)
+	}
+}
+
+func TestAttemptNumbers(t *testing.T) {
+	db := testDB(t)
+	id := seedEvent(t, db, "session-1")
+	captureLog(t)
+
+	p := &Pool{batchSize: 10, notifier: failingTimes(2)}
+	for i := 0; i < 3; i++ {
+		if _, err := p.process(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := db.Query(context.Background(), "SELECT attempt_number, status FROM event_attempts WHERE event_id = $1 ORDER BY attempt_number", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var n int
+		var status string
+		if err := rows.Scan(&n, &status); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d:%s", n, status))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "1:failed 2:failed 3:processed"; strings.Join(got, " ") != want {
+		t.Errorf("attempts = %v, want %s", got, want)
+	}
+}
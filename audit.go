@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// auditPayload returns the request body as received for the raw_payload
+// audit column, with the card masked wherever it appears as sent and cut
+// to at most max bytes without splitting a character.
+func auditPayload(raw []byte, card string, max int) string {
+	masked := raw
+	if digits := normalizeCard(card); fullCardPattern.MatchString(digits) {
+		masked = bytes.ReplaceAll(raw, []byte(card), []byte(maskCard(digits)))
+		if !cardMasked(masked) {
+			// The digits were escaped or split in a way the byte
+			// replacement missed; store a re-encoded copy instead.
+			masked = reencodeMasked(raw)
+		}
+	}
+	if len(masked) > max {
+		// Cut on a character boundary; half a UTF-8 sequence is not
+		// valid text and Postgres would refuse the insert.
+		for max > 0 && !utf8.RuneStart(masked[max]) {
+			max--
+		}
+		masked = masked[:max]
+	}
+	return string(masked)
+}
+
+// cardMasked reports whether the card in a JSON event body no longer
+// holds a full card number.
+func cardMasked(body []byte) bool {
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+	switch card := fields["card"].(type) {
+	case string:
+		return !fullCardPattern.MatchString(normalizeCard(card))
+	case float64:
+		return false
+	}
+	return true
+}
+
+// reencodeMasked re-encodes a JSON event body with its card masked. Only
+// the card entry is decoded, so bodies of any schema version keep every
+// other key as sent. Bodies that aren't a JSON object give nil, so an
+// unmasked card is never stored.
+func reencodeMasked(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	var card any
+	dec := json.NewDecoder(bytes.NewReader(fields["card"]))
+	dec.UseNumber()
+	if err := dec.Decode(&card); err != nil {
+		return nil
+	}
+	masked, _ := json.Marshal(maskCard(normalizeCard(fmt.Sprint(card))))
+	fields["card"] = masked
+	out, _ := json.Marshal(fields)
+	return out
+}
+
+// withAudit attaches the audit copy of raw to event when AUDIT_RAW is on,
+// gzipped into RawPayloadGzip with AUDIT_RAW_COMPRESS.
+func (h *Handler) withAudit(event *PGCartEvent, raw []byte, card string) {
+	if h.auditRawMax <= 0 {
+		return
+	}
+	payload := auditPayload(raw, card, h.auditRawMax)
+	if h.auditCompress {
+		event.RawPayloadGzip = compressPayload(payload)
+		return
+	}
+	event.RawPayload = &payload
+}
+
+func compressPayload(payload string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(payload))
+	gz.Close()
+	return buf.Bytes()
+}
+
+// decompressPayload reverses compressPayload. Stored payloads are capped
+// by AUDIT_RAW_MAX_BYTES, so anything inflating past max is refused.
+func decompressPayload(data []byte, max int64) (string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+	out, err := io.ReadAll(io.LimitReader(gz, max+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(out)) > max {
+		return "", errors.New("raw payload inflates past the size limit")
+	}
+	return string(out), nil
+}
+
+// maxRawPayload bounds decompression of stored payloads, well above any
+// AUDIT_RAW_MAX_BYTES that fits a request body.
+const maxRawPayload = MaxBatchBytes
+
+// RawPayload returns the audit copy of an event's request body, whether
+// it was stored plain or compressed.
+func (h *Handler) RawPayload(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !uuidPattern.MatchString(id) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "invalid event id",
+		})
+		return
+	}
+
+	for _, db := range h.read.All() {
+		var plain *string
+		var compressed []byte
+		err := db.QueryRow(r.Context(), `
+		SELECT raw_payload, raw_payload_gzip
+		FROM cart_events
+		WHERE id = $1 AND ($2::text = '' OR tenant_id = $2)`, id, tenantID(r.Context())).Scan(&plain, &compressed)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			continue
+		case err != nil:
+			internalError(w, r, err)
+			return
+		}
+
+		var payload string
+		switch {
+		case compressed != nil:
+			if payload, err = decompressPayload(compressed, maxRawPayload); err != nil {
+				internalError(w, r, err)
+				return
+			}
+		case plain != nil:
+			payload = *plain
+		default:
+			writeJSON(w, http.StatusNotFound, map[string]string{
+				"error": "no raw payload stored for event",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"rawPayload": payload,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusNotFound, map[string]string{
+		"error": "event not found",
+	})
+}
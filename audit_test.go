@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestAuditPayload(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		card string
+		max  int
+		want string
+	}{
+		{
+			name: "card masked",
+			raw:  `{"card":"4111111111111111","sessionId":"s"}`,
+			card: "4111111111111111",
+			max:  1000,
+			want: `{"card":"4111**1111","sessionId":"s"}`,
+		},
+		{
+			name: "spaced card masked",
+			raw:  `{"card":"4111 1111 1111 1111"}`,
+			card: "4111 1111 1111 1111",
+			max:  1000,
+			want: `{"card":"4111**1111"}`,
+		},
+		{
+			name: "escaped card re-encoded",
+			raw:  `{"card":"411\u0031111111111111"}`,
+			card: "4111111111111111",
+			max:  1000,
+			want: `{"card":"4111**1111"}`,
+		},
+		{
+			name: "escaped card in a version 2 body re-encoded",
+			raw:  `{"version":2,"card":"411\u0031111111111111","occurredAt":"2024-01-01T00:00:00Z","pageUrl":"https://example.com"}`,
+			card: "4111111111111111",
+			max:  1000,
+			want: `{"card":"4111**1111","occurredAt":"2024-01-01T00:00:00Z","pageUrl":"https://example.com","version":2}`,
+		},
+		{
+			name: "numeric card re-encoded",
+			raw:  `{"card":4111111111111111,"sessionId":"s"}`,
+			card: "4111111111111111",
+			max:  1000,
+			want: `{"card":"4111**1111","sessionId":"s"}`,
+		},
+		{
+			name: "masked card unchanged",
+			raw:  `{"card":"4433**1409"}`,
+			card: "4433**1409",
+			max:  1000,
+			want: `{"card":"4433**1409"}`,
+		},
+		{
+			name: "cut to max",
+			raw:  `{"card":"4433**1409"}`,
+			card: "4433**1409",
+			max:  9,
+			want: `{"card":"`,
+		},
+		{
+			// "ü" is two bytes; cutting after its first byte would leave
+			// an invalid sequence.
+			name: "cut before a multibyte character",
+			raw:  `{"sessionId":"ü"}`,
+			card: "",
+			max:  15,
+			want: `{"sessionId":"`,
+		},
+		{
+			name: "cut after a multibyte character",
+			raw:  `{"sessionId":"ü"}`,
+			card: "",
+			max:  16,
+			want: `{"sessionId":"ü`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := auditPayload([]byte(tt.raw), tt.card, tt.max)
+			if got != tt.want {
+				t.Errorf("auditPayload = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("auditPayload = %q is not valid UTF-8", got)
+			}
+		})
+	}
+}
+
+func TestAuditPayloadNeverSplitsCharacters(t *testing.T) {
+	raw := []byte(`{"sessionId":"` + strings.Repeat("日本語", 20) + `"}`)
+	for max := 1; max <= len(raw); max++ {
+		got := auditPayload(raw, "", max)
+		if len(got) > max || !utf8.ValidString(got) {
+			t.Fatalf("max %d: got %d bytes, valid UTF-8 %v", max, len(got), utf8.ValidString(got))
+		}
+	}
+}
+
+func TestCompressPayloadRoundTrip(t *testing.T) {
+	for _, payload := range []string{"", validEvent(""), strings.Repeat(validEvent(`"note":"🛒"`), 500)} {
+		compressed := compressPayload(payload)
+		got, err := decompressPayload(compressed, int64(len(payload)))
+		if err != nil || got != payload {
+			t.Errorf("round trip of %d bytes: %d bytes, %v", len(payload), len(got), err)
+		}
+		if len(payload) > 10000 && len(compressed) > len(payload)/10 {
+			t.Errorf("%d bytes compressed to %d", len(payload), len(compressed))
+		}
+	}
+
+	if _, err := decompressPayload(compressPayload(strings.Repeat("x", 101)), 100); err == nil {
+		t.Error("a payload inflating past the limit was returned")
+	}
+	if _, err := decompressPayload([]byte("not gzip"), 100); err == nil {
+		t.Error("garbage decompressed")
+	}
+}
+
+func TestCompressedRawPayloadServed(t *testing.T) {
+	payload := validEvent("")
+	f := newFakePG(t, func(string) fakeResult {
+		return fakeResult{
+			columns: []fakeColumn{{"raw_payload", pgtype.TextOID}, {"raw_payload_gzip", pgtype.ByteaOID}},
+			rows:    [][]any{{nil, `\x` + hex.EncodeToString(compressPayload(payload))}},
+		}
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	rec := adminRequest(h, "GET", "/events/"+fakeID(1)+"/raw", "admin-key")
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK || body["rawPayload"] != payload {
+		t.Errorf("raw: %d %s, want the decompressed payload", rec.Code, rec.Body)
+	}
+}
+
+func TestCompressedAuditStoredAndRead(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db, auditRawMax: 1 << 20, auditCompress: true}
+	raw := validEvent(`"note":"` + strings.Repeat("abc", 1000) + `"`)
+	event := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, []byte(raw)); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	var plain *string
+	var compressed []byte
+	err := pool.QueryRow(context.Background(), "SELECT id, raw_payload, raw_payload_gzip FROM cart_events").Scan(&id, &plain, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain != nil || len(compressed) == 0 || len(compressed) >= len(raw) {
+		t.Errorf("stored plain %v and %d compressed bytes for a %d byte body", plain != nil, len(compressed), len(raw))
+	}
+
+	rec := adminRequest(h, "GET", "/events/"+id+"/raw", "admin-key")
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK || body["rawPayload"] != auditPayload([]byte(raw), "4433**1409", 1<<20) {
+		t.Errorf("raw: %d %s", rec.Code, rec.Body)
+	}
+}
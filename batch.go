@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	MaxBatchEvents = 1000
+	MaxBatchBytes  = MaxBatchEvents * MaxEventBytes
+	// BatchChunkSize is how many decoded events Batch validates before
+	// writing them out.
+	BatchChunkSize = 100
+	// BatchReadTimeout replaces BodyReadTimeout for batches, which may
+	// be a thousand times the size of a single event.
+	BatchReadTimeout = time.Minute
+)
+
+type batchError struct {
+	Error     string             `json:"error"`
+	Errors    []*ValidationError `json:"errors,omitempty"`
+	Index     int                `json:"index"`
+	RequestID string             `json:"requestId,omitempty"`
+}
+
+// Batch stores a JSON array of events all or nothing. The array is
+// decoded one event at a time and written in chunks of BatchChunkSize, in
+// one transaction per shard, so a large batch is never held in memory
+// whole. Every transaction is rolled back if any event fails, and the
+// response names the index of the failing event.
+func (h *Handler) Batch(w http.ResponseWriter, r *http.Request) {
+	setReadDeadline(w, BatchReadTimeout)
+	version, err := headerVersion(r)
+	if err != nil {
+		localizeError(w, r, http.StatusBadRequest, "unsupported schema version")
+		return
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxBatchBytes))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		localizeError(w, r, http.StatusBadRequest, "invalid body")
+		return
+	}
+
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Language", lang)
+	ctx := r.Context()
+	txs := &batchTxs{h: h, txs: map[*pgxpool.Pool]pgx.Tx{}}
+	defer txs.close()
+
+	chunk := make([]PGCartEvent, 0, BatchChunkSize)
+	total, stored := 0, 0
+	flush := func() bool {
+		for i, event := range chunk {
+			ok, err := txs.insert(ctx, event)
+			if err != nil {
+				h.batchDBError(w, r, err, total-len(chunk)+i)
+				return false
+			}
+			if ok {
+				stored++
+			}
+		}
+		chunk = chunk[:0]
+		return true
+	}
+
+	for dec.More() {
+		i := total
+		if i == MaxBatchEvents {
+			writeJSON(w, http.StatusBadRequest, batchError{Error: fmt.Sprintf("batch must hold 1 to %d events", MaxBatchEvents), Index: i})
+			return
+		}
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		var event CartEvent
+		if err == nil {
+			event, err = unmarshalEvent(raw, version)
+		}
+		if errors.Is(err, errUnsupportedVersion) {
+			writeJSON(w, http.StatusBadRequest, batchError{Error: translate(lang, "unsupported schema version"), Index: i})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, batchError{Error: translate(lang, "invalid body"), Index: i})
+			return
+		}
+		pgEvent, err := event.toPGCartEvent()
+		if err == nil {
+			err = h.checkBIN(event.Card)
+		}
+		if err != nil {
+			failures, msg := localizeValidation(lang, err)
+			writeJSON(w, http.StatusUnprocessableEntity, batchError{Error: msg, Errors: failures, Index: i})
+			return
+		}
+		if err := h.checkEvent(&pgEvent); err != nil {
+			writeJSON(w, http.StatusForbidden, batchError{Error: translate(lang, err.Error()), Index: i})
+			return
+		}
+		h.withAudit(&pgEvent, raw, event.Card)
+		pgEvent.TenantID = tenantID(ctx)
+		chunk = append(chunk, pgEvent)
+		total++
+		if len(chunk) == BatchChunkSize && !flush() {
+			return
+		}
+	}
+	_, err = dec.Token()
+	if err == nil {
+		err = expectEOF(dec)
+	}
+	if err != nil {
+		localizeError(w, r, http.StatusBadRequest, "invalid body")
+		return
+	}
+	if total == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": fmt.Sprintf("batch must hold 1 to %d events", MaxBatchEvents),
+		})
+		return
+	}
+	if !flush() {
+		return
+	}
+
+	if err := txs.commit(ctx); err != nil {
+		internalError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{
+		"stored":     stored,
+		"duplicates": total - stored,
+	})
+}
+
+func (h *Handler) batchDBError(w http.ResponseWriter, r *http.Request, err error, index int) {
+	if errors.Is(err, ErrPoolBusy) {
+		dbError(w, r, err)
+		return
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		failures, msg := localizeValidation(requestLanguage(r), err)
+		writeJSON(w, http.StatusUnprocessableEntity, batchError{Error: msg, Errors: failures, Index: index})
+		return
+	}
+	logInternalError(r, err)
+	writeJSON(w, http.StatusInternalServerError, batchError{Error: "internal error", Index: index, RequestID: requestID(r.Context())})
+}
+
+// batchTxs holds the open transaction of every shard a batch has written
+// to so far.
+type batchTxs struct {
+	h     *Handler
+	conns []*pgxpool.Conn
+	txs   map[*pgxpool.Pool]pgx.Tx
+}
+
+// insert writes event in its shard's transaction, beginning one on a
+// fresh connection for the first event of that shard.
+func (b *batchTxs) insert(ctx context.Context, event PGCartEvent) (bool, error) {
+	db := b.h.db.ForSession(event.SessionID)
+	tx, ok := b.txs[db]
+	if !ok {
+		conn, err := b.h.acquire(ctx, db)
+		if err != nil {
+			return false, err
+		}
+		b.conns = append(b.conns, conn)
+		if tx, err = conn.Begin(ctx); err != nil {
+			return false, err
+		}
+		b.txs[db] = tx
+	}
+	return b.h.insertEvent(ctx, tx, event)
+}
+
+// commit commits every transaction. A commit failing after another shard
+// committed can still leave a partial batch; with a single shard the
+// batch is atomic.
+func (b *batchTxs) commit(ctx context.Context) error {
+	for db, tx := range b.txs {
+		delete(b.txs, db)
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close rolls back whatever was not committed and returns the
+// connections.
+func (b *batchTxs) close() {
+	for _, tx := range b.txs {
+		tx.Rollback(context.Background())
+	}
+	for _, conn := range b.conns {
+		conn.Release()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// BatchNotifier collects events from all workers and POSTs them to the
+// downstream as a single JSON array once size events are queued or
+// interval has passed since the first one arrived. Notify blocks until
+// the batch holding the event has been delivered. An event whose context
+// ends while it waits for its batch is taken out and never sent; once its
+// batch is on the wire Notify waits for the outcome, so a late timeout
+// can't turn a delivered event into a retry.
+//
+// The downstream may answer a 2xx with {"failed": ["<id>", ...]} to
+// reject individual events; only those are reported as failed. Batches
+// are signed like HTTPNotifier requests when secret is set.
+type BatchNotifier struct {
+	url      string
+	client   *http.Client
+	secret   []byte
+	size     int
+	interval time.Duration
+	queue    chan *batchItem
+}
+
+var errRejected = errors.New("rejected by downstream")
+
+// Item states. Notify and flush race to move a queued item to
+// abandoned or sending, and only the winner decides its fate.
+const (
+	itemQueued int32 = iota
+	itemSending
+	itemAbandoned
+)
+
+type batchItem struct {
+	event PGCartEvent
+	done  chan error
+	state atomic.Int32
+}
+
+type batchResponse struct {
+	Failed []string `json:"failed"`
+}
+
+func NewBatchNotifier(ctx context.Context, url string, client *http.Client, size int, interval time.Duration, secret string) *BatchNotifier {
+	if size < 1 {
+		size = 1
+	}
+	n := &BatchNotifier{
+		url:      url,
+		client:   client,
+		secret:   []byte(secret),
+		size:     size,
+		interval: interval,
+		queue:    make(chan *batchItem, size),
+	}
+	go n.run(ctx)
+	return n
+}
+
+func (n *BatchNotifier) Notify(ctx context.Context, event PGCartEvent) error {
+	item := &batchItem{event: event, done: make(chan error, 1)}
+
+	select {
+	case n.queue <- item:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-item.done:
+		return err
+	case <-ctx.Done():
+		if item.state.CompareAndSwap(itemQueued, itemAbandoned) {
+			return ctx.Err()
+		}
+		// Already being sent; the result decides whether it counts.
+		return <-item.done
+	}
+}
+
+func (n *BatchNotifier) run(ctx context.Context) {
+	var batch []*batchItem
+	var flushTimer <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			for _, item := range batch {
+				item.done <- ctx.Err()
+			}
+			return
+		case item := <-n.queue:
+			batch = append(batch, item)
+			if len(batch) == 1 {
+				flushTimer = time.After(n.interval)
+			}
+			if len(batch) >= n.size {
+				n.flush(ctx, batch)
+				batch, flushTimer = nil, nil
+			}
+		case <-flushTimer:
+			n.flush(ctx, batch)
+			batch, flushTimer = nil, nil
+		}
+	}
+}
+
+// flush sends the items of batch whose callers are still waiting.
+func (n *BatchNotifier) flush(ctx context.Context, batch []*batchItem) {
+	batch = slices.DeleteFunc(batch, func(item *batchItem) bool {
+		return !item.state.CompareAndSwap(itemQueued, itemSending)
+	})
+	if len(batch) == 0 {
+		return
+	}
+	failed, err := n.send(ctx, batch)
+	for _, item := range batch {
+		if err != nil {
+			item.done <- err
+		} else if failed[item.event.ID] {
+			item.done <- errRejected
+		} else {
+			item.done <- nil
+		}
+	}
+}
+
+func (n *BatchNotifier) send(ctx context.Context, batch []*batchItem) (map[string]bool, error) {
+	payload := make([]notification, len(batch))
+	for i, item := range batch {
+		payload[i] = newNotification(item.event)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signRequest(req, body, n.secret)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var result batchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		// An empty or non-JSON body means the whole batch was accepted.
+		return nil, nil
+	}
+	failed := make(map[string]bool, len(result.Failed))
+	for _, id := range result.Failed {
+		failed[id] = true
+	}
+	return failed, nil
+}
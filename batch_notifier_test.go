@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchServer records the size of every batch POSTed to it and rejects
+// the events in failed.
+func batchServer(t *testing.T, failed ...string) (*httptest.Server, func() []int) {
+	var mu sync.Mutex
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []notification
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("batch body: %v", err)
+		}
+		mu.Lock()
+		sizes = append(sizes, len(batch))
+		mu.Unlock()
+		json.NewEncoder(w).Encode(batchResponse{Failed: failed})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), sizes...)
+	}
+}
+
+// notifyAll notifies n events at once and returns each one's error by id.
+func notifyAll(n *BatchNotifier, count int) map[string]error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := map[string]error{}
+	for i := 1; i <= count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := fakeID(i)
+			err := n.Notify(context.Background(), PGCartEvent{ID: id})
+			mu.Lock()
+			errs[id] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBatchNotifierFlushesWhenFull(t *testing.T) {
+	srv, sizes := batchServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewBatchNotifier(ctx, srv.URL, srv.Client(), 3, time.Hour, "")
+
+	start := time.Now()
+	for id, err := range notifyAll(n, 3) {
+		if err != nil {
+			t.Errorf("event %s: %v", id, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("full batch took %s, want it sent without waiting for the interval", elapsed)
+	}
+	if got := fmt.Sprint(sizes()); got != "[3]" {
+		t.Errorf("batch sizes = %s, want [3]", got)
+	}
+}
+
+func TestBatchNotifierFlushesAfterInterval(t *testing.T) {
+	srv, sizes := batchServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const interval = 50 * time.Millisecond
+	n := NewBatchNotifier(ctx, srv.URL, srv.Client(), 10, interval, "")
+
+	start := time.Now()
+	for id, err := range notifyAll(n, 2) {
+		if err != nil {
+			t.Errorf("event %s: %v", id, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("partial batch sent after %s, before the %s interval", elapsed, interval)
+	}
+	if got := fmt.Sprint(sizes()); got != "[2]" {
+		t.Errorf("batch sizes = %s, want [2]", got)
+	}
+}
+
+func TestBatchNotifierFailsOnlyRejectedEvents(t *testing.T) {
+	srv, _ := batchServer(t, fakeID(2))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewBatchNotifier(ctx, srv.URL, srv.Client(), 3, time.Hour, "")
+
+	for id, err := range notifyAll(n, 3) {
+		if want := id == fakeID(2); errors.Is(err, errRejected) != want {
+			t.Errorf("event %s: err = %v, rejected want %v", id, err, want)
+		}
+	}
+}
+
+func TestBatchNotifierDropsEventsThatTimedOutWaiting(t *testing.T) {
+	var mu sync.Mutex
+	delivered := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []notification
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("batch body: %v", err)
+		}
+		mu.Lock()
+		for _, n := range batch {
+			delivered[n.ID]++
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewBatchNotifier(ctx, srv.URL, srv.Client(), 10, 100*time.Millisecond, "")
+
+	event := PGCartEvent{ID: fakeID(1)}
+	timeout, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	if err := n.Notify(timeout, event); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Notify while waiting for the batch = %v, want the deadline", err)
+	}
+	// The worker retries the event; only that attempt may reach the
+	// downstream.
+	if err := n.Notify(context.Background(), event); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := delivered[event.ID]; got != 1 {
+		t.Errorf("event delivered %d times, want exactly once", got)
+	}
+}
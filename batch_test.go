@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchBody returns a JSON array of n valid events, event i in the
+// session session(i).
+func batchBody(n int, session func(i int) string) string {
+	events := make([]string, n)
+	for i := range events {
+		events[i] = fmt.Sprintf(`{"orderType":"Purchase","sessionId":%q,"card":"4433**1409","eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"}`, session(i))
+	}
+	return "[" + strings.Join(events, ",") + "]"
+}
+
+func postBatch(h *Handler, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/events/batch", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	withRequestID(h.routes()).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBatchRollsBackOnDatabaseError(t *testing.T) {
+	var inserts atomic.Int32
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") && inserts.Add(1) == 5 {
+			return fakeResult{err: pgError("XX000", `could not extend file "base/16384/16385"`)}
+		}
+		return fakeResult{tag: "INSERT 0 1"}
+	})
+	db := NewHashRouter(f.pool(t))
+	logs := captureLog(t)
+
+	rec := postBatch(&Handler{db: db, read: db}, batchBody(10, func(int) string { return "session-1" }))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	var body batchError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "internal error" || body.Index != 4 || body.RequestID == "" {
+		t.Errorf("body = %+v, want the redacted error at index 4", body)
+	}
+	if !strings.Contains(logs.String(), "could not extend file") {
+		t.Errorf("error not logged: %s", logs)
+	}
+
+	var rolledBack bool
+	for _, q := range f.Queries() {
+		switch strings.ToLower(strings.TrimSpace(q)) {
+		case "commit":
+			t.Fatal("batch committed after a failed insert")
+		case "rollback":
+			rolledBack = true
+		}
+	}
+	if !rolledBack {
+		t.Error("batch transaction not rolled back")
+	}
+	if n := inserts.Load(); n != 5 {
+		t.Errorf("%d inserts, want to stop at the failing 5th", n)
+	}
+}
+
+func TestBatchDatabaseErrorPersistsNothing(t *testing.T) {
+	pool := testDB(t)
+	ctx := context.Background()
+	// A constraint the service has no friendly message for, so violating
+	// it is a plain database error.
+	if _, err := pool.Exec(ctx, "ALTER TABLE cart_events ADD CONSTRAINT batch_test_check CHECK (session_id <> 'session-4')"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Exec(ctx, "ALTER TABLE cart_events DROP CONSTRAINT batch_test_check") })
+	db := NewHashRouter(pool)
+
+	rec := postBatch(&Handler{db: db, read: db}, batchBody(10, func(i int) string { return fmt.Sprintf("session-%d", i) }))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), `"index":4`) {
+		t.Fatalf("got %d %s, want 500 at index 4", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "batch_test_check") {
+		t.Errorf("response leaks the database error: %s", rec.Body)
+	}
+	var n int
+	if err := pool.QueryRow(ctx, "SELECT COUNT(*) FROM cart_events").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d events stored, want none", n)
+	}
+}
+
+func TestBatchRejectsTrailingData(t *testing.T) {
+	rec := postBatch(&Handler{}, batchBody(2, func(int) string { return "s" })+" []")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("batch with trailing data: %d %s, want 400", rec.Code, rec.Body)
+	}
+}
+
+func TestLargeBatchWrittenInChunks(t *testing.T) {
+	var inserts atomic.Int32
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") {
+			inserts.Add(1)
+			return fakeResult{tag: "INSERT 0 1"}
+		}
+		return fakeResult{}
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	events := strings.Split(strings.Trim(batchBody(MaxBatchEvents, func(int) string { return "session-1" }), "[]"), "},{")
+	body, client := io.Pipe()
+	req := httptest.NewRequest("POST", "/events/batch", body)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.Batch(rec, req)
+	}()
+
+	// Send a chunk and a half. The first chunk must be written while the
+	// rest of the array is still on its way.
+	fmt.Fprint(client, "["+strings.Join(events[:BatchChunkSize*3/2], "},{")+"}")
+	deadline := time.Now().Add(5 * time.Second)
+	for inserts.Load() < BatchChunkSize {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d inserts before the body was complete, want the first chunk of %d", inserts.Load(), BatchChunkSize)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := inserts.Load(); n != BatchChunkSize {
+		t.Errorf("%d inserts for a chunk and a half, want one chunk of %d", n, BatchChunkSize)
+	}
+	fmt.Fprint(client, ",{"+strings.Join(events[BatchChunkSize*3/2:], "},{")+"]")
+	client.Close()
+	<-done
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), fmt.Sprintf(`"stored":%d`, MaxBatchEvents)) {
+		t.Errorf("batch: %d %s", rec.Code, rec.Body)
+	}
+	if n := inserts.Load(); n != MaxBatchEvents {
+		t.Errorf("%d inserts, want %d", n, MaxBatchEvents)
+	}
+}
+
+func TestBatchOverLimitRejected(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	rec := postBatch(&Handler{db: db, read: db}, batchBody(MaxBatchEvents+1, func(int) string { return "session-1" }))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), fmt.Sprintf(`"index":%d`, MaxBatchEvents)) {
+		t.Errorf("batch of %d: %d %s, want 400 at index %d", MaxBatchEvents+1, rec.Code, rec.Body, MaxBatchEvents)
+	}
+	for _, q := range f.Queries() {
+		if strings.EqualFold(strings.TrimSpace(q), "commit") {
+			t.Fatal("an oversized batch was committed")
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBINRangesAllows(t *testing.T) {
+	ranges, err := parseBINRanges([]string{"411111", " 510000-559999 "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for card, want := range map[string]bool{
+		"4111111111111111": true,
+		"4111121111111111": false,
+		"5100001111111111": true,
+		"5599991111111111": true,
+		"5321001111111111": true,
+		"5099991111111111": false,
+		"5600001111111111": false,
+		"4111":             false,
+		"":                 false,
+	} {
+		if got := ranges.Allows(card); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", card, got, want)
+		}
+	}
+}
+
+func TestParseBINRangesRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"41111", "4111111", "41111a", "559999-510000", "510000-", "-559999"} {
+		if _, err := parseBINRanges([]string{spec}); err == nil {
+			t.Errorf("parseBINRanges(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestEventWithDisallowedBINRejected(t *testing.T) {
+	ranges, err := parseBINRanges([]string{"411111"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, allowedBINs: ranges}
+
+	for card, want := range map[string]string{
+		"4111 1111 1111 1111": "",
+		"5500 0000 0000 0004": "has a BIN that is not allowed",
+		"4111**1111":          "must be a full card number when BINs are restricted",
+	} {
+		body := strings.Replace(validEvent(""), `"4433**1409"`, `"`+card+`"`, 1)
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Event(rec, req)
+		switch {
+		case want == "" && rec.Code != http.StatusOK:
+			t.Errorf("card %s: %d %s, want it stored", card, rec.Code, rec.Body)
+		case want != "" && (rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), want)):
+			t.Errorf("card %s: %d %s, want 422 %q", card, rec.Code, rec.Body, want)
+		}
+	}
+	if n := len(f.Queries()); n != 1 {
+		t.Errorf("%d inserts, want only the allowed card stored", n)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreaker stops calling the wrapped Notifier after threshold
+// consecutive failures. Once cooldown has passed calls are let through
+// again; the first failure re-opens it, the first success closes it.
+type CircuitBreaker struct {
+	next      Notifier
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func NewCircuitBreaker(next Notifier, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		next:      next,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (b *CircuitBreaker) Notify(ctx context.Context, event PGCartEvent) error {
+	if b.Open() {
+		return ErrCircuitOpen
+	}
+
+	err := b.next.Notify(ctx, event)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// Our own cancellation says nothing about the downstream, but
+		// running past NOTIFY_TIMEOUT does.
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		return nil
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	return err
+}
+
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
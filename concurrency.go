@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+)
+
+var busyRequests = newCounter("http_requests_rejected_busy_total",
+	"Requests answered 503 because MAX_CONCURRENT_REQUESTS were already in flight.")
+
+// unlimitedPaths skip the concurrency limit, so probes and scrapes keep
+// answering while the service is saturated.
+var unlimitedPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+// limitConcurrency serves at most max requests at a time. Requests over
+// the limit are turned away with 503 and Retry-After straight away rather
+// than queueing up goroutines.
+func limitConcurrency(next http.Handler, max int) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlimitedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			busyRequests.Inc()
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+				"error": "server busy, retry later",
+			})
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestConcurrencyLimitRejectsWhenSaturated(t *testing.T) {
+	const max = 2
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := limitConcurrency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/event" && r.Header.Get("X-Hold") != "" {
+			entered <- struct{}{}
+			<-release
+		}
+	}), max)
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/event", nil)
+			req.Header.Set("X-Hold", "1")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		<-entered
+	}
+
+	before := busyRequests.Value()
+	rec := serve(http.MethodPost, "/event")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("saturated: status = %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("saturated: Retry-After = %q, want 1", got)
+	}
+	if got := busyRequests.Value() - before; got != 1 {
+		t.Errorf("busy counter went up by %d, want 1", got)
+	}
+	// Probes and scrapes still answer.
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		if rec := serve(http.MethodGet, path); rec.Code != http.StatusOK {
+			t.Errorf("saturated: %s status = %d, want 200", path, rec.Code)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	if rec := serve(http.MethodPost, "/event"); rec.Code != http.StatusOK {
+		t.Errorf("after release: status = %d, want 200", rec.Code)
+	}
+}
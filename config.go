@@ -0,0 +1,544 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Port                 int
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	InstanceID           string
+	MultiTenant          bool
+	WorkerCount          int
+	PollInterval         time.Duration
+	BatchSize            int
+	OrderTypeConcurrency []string
+	ListenNotify         bool
+	QueueConsumer        string
+	SessionFIFO          bool
+	Delivery             string
+	NotifyOrder          string
+	DeadLetterTable      bool
+	MaxInFlight          int
+	GzipMinSize          int
+	ConcurrencyLimit     int
+	DebugStackTraces     bool
+	PrettyJSON           bool
+	LogBuffered          bool
+	LogFlushInterval     time.Duration
+	MetricsExemplars     bool
+
+	DatabaseURLs        []string
+	ReadDatabaseURLs    []string
+	DBAcquireTimeout    time.Duration
+	DBMinConns          int
+	SkipSchemaInit      bool
+	NotifyRate          float64
+	NotifyBurst         int
+	Notifier            string
+	NotifyURL           string
+	NotifySigningSecret string
+	NotifyBatchSize     int
+	NotifyFlushInterval time.Duration
+	NotifyTimeout       time.Duration
+	NotifyRampUp        time.Duration
+	PriorityAging       time.Duration
+	NotifyWindow        string
+	RetrySchedule       string
+	NotifyTimezone      string
+
+	NotifyInsecureSkipVerify bool
+	NotifyIdempotencyHeader  string
+	BreakerThreshold         int
+	BreakerCooldown          time.Duration
+	DegradedMode             bool
+	StatusWebhookURL         string
+
+	DedupeWindow        time.Duration
+	AdminAPIKey         string
+	AllowedWebsiteHosts []string
+	RegionMap           []string
+	AllowedRegions      []string
+	AllowedBINs         []string
+	CardLastFour        bool
+	AuditRaw            bool
+	AuditRawMaxBytes    int
+	AuditRawCompress    bool
+	EventLogFile        string
+	EventLogMaxBytes    int64
+
+	MaxPendingAge        time.Duration
+	PendingCheckInterval time.Duration
+	ShedPendingThreshold int
+	ShedFraction         float64
+	ShedCheckInterval    time.Duration
+	StuckAfter           time.Duration
+	WorkerStaleAfter     time.Duration
+	LeaderElection       bool
+	LeaderLockKey        int64
+	LeaderCheckInterval  time.Duration
+	ReadyPingTTL         time.Duration
+
+	// parseErrs holds variables that were set but couldn't be parsed, so
+	// Validate can report them together with everything else.
+	parseErrs []error
+}
+
+func loadConfig() Config {
+	var env envReader
+	cfg := Config{
+		Port:                 env.int("PORT", 8080),
+		ReadHeaderTimeout:    env.duration("SERVER_READ_HEADER_TIMEOUT", ServerReadHeaderTimeout),
+		ReadTimeout:          env.duration("SERVER_READ_TIMEOUT", ServerReadTimeout),
+		WriteTimeout:         env.duration("SERVER_WRITE_TIMEOUT", ServerWriteTimeout),
+		IdleTimeout:          env.duration("SERVER_IDLE_TIMEOUT", ServerIdleTimeout),
+		InstanceID:           env.string("INSTANCE_ID", hostname()),
+		MultiTenant:          env.bool("MULTI_TENANT", false),
+		WorkerCount:          env.int("WORKER_COUNT", WorkerCount),
+		PollInterval:         env.duration("POLL_INTERVAL", Interval),
+		BatchSize:            env.int("BATCH_SIZE", BatchSize),
+		MaxInFlight:          env.int("MAX_IN_FLIGHT", 0),
+		OrderTypeConcurrency: env.list("ORDER_TYPE_CONCURRENCY", nil),
+		ListenNotify:         env.bool("LISTEN_NOTIFY", false),
+		QueueConsumer:        env.string("QUEUE_CONSUMER", ""),
+		SessionFIFO:          env.bool("SESSION_FIFO", false),
+		Delivery:             env.string("DELIVERY", "at-least-once"),
+		NotifyOrder:          env.string("NOTIFY_ORDER", "concurrent"),
+		DeadLetterTable:      env.bool("DEAD_LETTER_TABLE", false),
+		GzipMinSize:          env.int("GZIP_MIN_SIZE", 1024),
+		ConcurrencyLimit:     env.int("MAX_CONCURRENT_REQUESTS", 0),
+		PrettyJSON:           env.bool("PRETTY_JSON", false),
+		DebugStackTraces:     env.bool("DEBUG_STACK_TRACES", false),
+		LogBuffered:          env.bool("LOG_BUFFERED", false),
+		LogFlushInterval:     env.duration("LOG_FLUSH_INTERVAL", time.Second),
+		MetricsExemplars:     env.bool("METRICS_EXEMPLARS", false),
+
+		DatabaseURLs:        env.list("DATABASE_URLS", []string{os.Getenv("DATABASE_URL")}),
+		ReadDatabaseURLs:    env.list("READ_DATABASE_URLS", env.list("READ_DATABASE_URL", nil)),
+		DBAcquireTimeout:    env.duration("DB_ACQUIRE_TIMEOUT", 5*time.Second),
+		DBMinConns:          env.int("DB_MIN_CONNS", 0),
+		SkipSchemaInit:      env.bool("SKIP_SCHEMA_INIT", false),
+		NotifyRate:          env.float("NOTIFY_RATE", 10),
+		NotifyBurst:         env.int("NOTIFY_BURST", 1),
+		Notifier:            os.Getenv("NOTIFIER"),
+		NotifyURL:           os.Getenv("NOTIFY_URL"),
+		NotifySigningSecret: os.Getenv("NOTIFY_SIGNING_SECRET"),
+		NotifyBatchSize:     env.int("NOTIFY_BATCH_SIZE", 50),
+		NotifyFlushInterval: env.duration("NOTIFY_FLUSH_INTERVAL", time.Second),
+		NotifyTimeout:       env.duration("NOTIFY_TIMEOUT", 30*time.Second),
+		NotifyRampUp:        env.duration("NOTIFY_RAMP_UP", 0),
+		PriorityAging:       env.duration("PRIORITY_AGING", 0),
+		NotifyWindow:        os.Getenv("NOTIFY_WINDOW"),
+		RetrySchedule:       os.Getenv("RETRY_SCHEDULE"),
+		NotifyTimezone:      env.string("NOTIFY_TIMEZONE", "UTC"),
+
+		NotifyInsecureSkipVerify: env.bool("NOTIFY_INSECURE_SKIP_VERIFY", false),
+		NotifyIdempotencyHeader:  env.string("NOTIFY_IDEMPOTENCY_HEADER", "Idempotency-Key"),
+		BreakerThreshold:         env.int("BREAKER_THRESHOLD", 5),
+		BreakerCooldown:          env.duration("BREAKER_COOLDOWN", 30*time.Second),
+		DegradedMode:             env.bool("DEGRADED_MODE", false),
+		StatusWebhookURL:         os.Getenv("STATUS_WEBHOOK_URL"),
+
+		DedupeWindow:        env.duration("DEDUPE_WINDOW", 0),
+		AdminAPIKey:         os.Getenv("ADMIN_API_KEY"),
+		AllowedWebsiteHosts: env.list("ALLOWED_WEBSITE_HOSTS", nil),
+		RegionMap:           env.list("REGION_MAP", nil),
+		AllowedBINs:         env.list("ALLOWED_BINS", nil),
+		AllowedRegions:      env.list("ALLOWED_REGIONS", nil),
+		CardLastFour:        env.bool("CARD_LAST_FOUR", false),
+		AuditRaw:            env.bool("AUDIT_RAW", false),
+		AuditRawMaxBytes:    env.int("AUDIT_RAW_MAX_BYTES", 4096),
+		EventLogFile:        env.string("EVENT_LOG_FILE", ""),
+		EventLogMaxBytes:    int64(env.int("EVENT_LOG_MAX_BYTES", 100<<20)),
+		AuditRawCompress:    env.bool("AUDIT_RAW_COMPRESS", false),
+
+		MaxPendingAge:        env.duration("MAX_PENDING_AGE", 0),
+		PendingCheckInterval: env.duration("PENDING_CHECK_INTERVAL", time.Minute),
+		ShedPendingThreshold: env.int("SHED_PENDING_THRESHOLD", 0),
+		ShedFraction:         env.float("SHED_FRACTION", 0.5),
+		ShedCheckInterval:    env.duration("SHED_CHECK_INTERVAL", 5*time.Second),
+		StuckAfter:           env.duration("STUCK_AFTER", 0),
+		WorkerStaleAfter:     env.duration("WORKER_STALE_AFTER", 2*time.Minute),
+		LeaderElection:       env.bool("LEADER_ELECTION", false),
+		LeaderLockKey:        int64(env.int("LEADER_LOCK_KEY", 72_616_001)),
+		LeaderCheckInterval:  env.duration("LEADER_CHECK_INTERVAL", 5*time.Second),
+		ReadyPingTTL:         env.duration("READY_PING_TTL", time.Second),
+	}
+	cfg.parseErrs = env.errs
+	return cfg
+}
+
+// Validate reports every problem with the configuration at once, one per
+// line, so a broken deploy can be fixed in a single pass.
+func (c Config) Validate() error {
+	errs := append([]error(nil), c.parseErrs...)
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port < 65536, "PORT must be between 1 and 65535, got %d", c.Port)
+	check(c.ReadHeaderTimeout >= 0, "SERVER_READ_HEADER_TIMEOUT must not be negative, got %s", c.ReadHeaderTimeout)
+	check(c.ReadTimeout >= 0, "SERVER_READ_TIMEOUT must not be negative, got %s", c.ReadTimeout)
+	check(c.WriteTimeout >= 0, "SERVER_WRITE_TIMEOUT must not be negative, got %s", c.WriteTimeout)
+	check(c.IdleTimeout >= 0, "SERVER_IDLE_TIMEOUT must not be negative, got %s", c.IdleTimeout)
+	check(c.WorkerCount > 0, "WORKER_COUNT must be positive, got %d", c.WorkerCount)
+	check(c.PollInterval > 0, "POLL_INTERVAL must be positive, got %s", c.PollInterval)
+	check(c.BatchSize > 0, "BATCH_SIZE must be positive, got %d", c.BatchSize)
+	check(!c.LogBuffered || c.LogFlushInterval > 0, "LOG_FLUSH_INTERVAL must be positive, got %s", c.LogFlushInterval)
+	check(c.ConcurrencyLimit >= 0, "MAX_CONCURRENT_REQUESTS must not be negative, got %d", c.ConcurrencyLimit)
+	check(c.GzipMinSize >= 0, "GZIP_MIN_SIZE must not be negative, got %d", c.GzipMinSize)
+	check(c.MaxInFlight >= 0, "MAX_IN_FLIGHT must not be negative, got %d", c.MaxInFlight)
+	check(c.QueueConsumer == "" || c.QueueConsumer == "stdin", "QUEUE_CONSUMER must be stdin or unset, got %q", c.QueueConsumer)
+	check(c.QueueConsumer == "" || !c.MultiTenant, "QUEUE_CONSUMER can't be combined with MULTI_TENANT, queue messages carry no tenant")
+	if _, err := parseTypeLimits(c.OrderTypeConcurrency); err != nil {
+		errs = append(errs, fmt.Errorf("ORDER_TYPE_CONCURRENCY: %w", err))
+	}
+
+	check(len(c.DatabaseURLs) > 0 && c.DatabaseURLs[0] != "", "DATABASE_URL or DATABASE_URLS is required")
+	check(len(c.ReadDatabaseURLs) == 0 || len(c.ReadDatabaseURLs) == len(c.DatabaseURLs),
+		"READ_DATABASE_URLS needs one URL per shard, got %d for %d shards", len(c.ReadDatabaseURLs), len(c.DatabaseURLs))
+	for i, u := range c.DatabaseURLs {
+		if err := checkDatabaseURL(u); err != nil {
+			name := fmt.Sprintf("DATABASE_URLS[%d]", i)
+			if len(c.DatabaseURLs) == 1 {
+				name = "DATABASE_URL"
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	for i, u := range c.ReadDatabaseURLs {
+		if err := checkDatabaseURL(u); err != nil {
+			errs = append(errs, fmt.Errorf("READ_DATABASE_URLS[%d]: %w", i, err))
+		}
+	}
+
+	check(c.Delivery == "at-least-once" || c.Delivery == "at-most-once", "DELIVERY must be at-least-once or at-most-once, got %q", c.Delivery)
+	check(c.NotifyOrder == "concurrent" || c.NotifyOrder == "sequential", "NOTIFY_ORDER must be concurrent or sequential, got %q", c.NotifyOrder)
+	check(c.DBMinConns >= 0 && c.DBMinConns <= 10, "DB_MIN_CONNS must be between 0 and 10 (the pool size), got %d", c.DBMinConns)
+	check(c.DBAcquireTimeout >= 0, "DB_ACQUIRE_TIMEOUT must not be negative, got %s", c.DBAcquireTimeout)
+	check(c.NotifyRate >= 0, "NOTIFY_RATE must not be negative, got %v", c.NotifyRate)
+	check(c.NotifyBurst > 0, "NOTIFY_BURST must be positive, got %d", c.NotifyBurst)
+	switch c.Notifier {
+	case "", "log", "stdout":
+	case "http", "batch":
+		check(c.NotifyURL != "", "NOTIFY_URL is required for NOTIFIER=%s", c.Notifier)
+	default:
+		errs = append(errs, fmt.Errorf("NOTIFIER must be log, stdout, http or batch, got %q", c.Notifier))
+	}
+	check(headerNamePattern.MatchString(c.NotifyIdempotencyHeader), "NOTIFY_IDEMPOTENCY_HEADER must be a header name like Idempotency-Key, got %q", c.NotifyIdempotencyHeader)
+	check(c.NotifyURL == "" || isHTTPURL(c.NotifyURL), "NOTIFY_URL must be an http(s) URL, got %q", c.NotifyURL)
+	check(c.NotifyBatchSize > 0, "NOTIFY_BATCH_SIZE must be positive, got %d", c.NotifyBatchSize)
+	check(c.NotifyFlushInterval > 0, "NOTIFY_FLUSH_INTERVAL must be positive, got %s", c.NotifyFlushInterval)
+	check(c.NotifyTimeout >= 0, "NOTIFY_TIMEOUT must not be negative, got %s", c.NotifyTimeout)
+	check(c.NotifyRampUp >= 0, "NOTIFY_RAMP_UP must not be negative, got %s", c.NotifyRampUp)
+	check(c.PriorityAging >= 0, "PRIORITY_AGING must not be negative, got %s", c.PriorityAging)
+	check(c.PriorityAging == 0 || c.NotifyOrder != "sequential", "PRIORITY_AGING can't be combined with NOTIFY_ORDER=sequential")
+
+	if _, err := parseTimeWindow(c.NotifyWindow, c.NotifyTimezone); err != nil {
+		errs = append(errs, fmt.Errorf("NOTIFY_WINDOW/NOTIFY_TIMEZONE: %w", err))
+	}
+	if _, err := parseRetrySchedule(c.RetrySchedule); err != nil {
+		errs = append(errs, fmt.Errorf("RETRY_SCHEDULE: %w", err))
+	}
+
+	check(c.BreakerThreshold >= 0, "BREAKER_THRESHOLD must not be negative, got %d", c.BreakerThreshold)
+	check(c.BreakerThreshold == 0 || c.BreakerCooldown > 0, "BREAKER_COOLDOWN must be positive, got %s", c.BreakerCooldown)
+	check(!c.DegradedMode || c.BreakerThreshold > 0, "DEGRADED_MODE requires BREAKER_THRESHOLD > 0")
+	check(c.StatusWebhookURL == "" || isHTTPURL(c.StatusWebhookURL), "STATUS_WEBHOOK_URL must be an http(s) URL, got %q", c.StatusWebhookURL)
+
+	if _, err := parseRegionMap(c.RegionMap); err != nil {
+		errs = append(errs, fmt.Errorf("REGION_MAP: %w", err))
+	}
+	check(len(c.AllowedRegions) == 0 || len(c.RegionMap) > 0, "ALLOWED_REGIONS requires REGION_MAP")
+	if _, err := parseBINRanges(c.AllowedBINs); err != nil {
+		errs = append(errs, fmt.Errorf("ALLOWED_BINS: %w", err))
+	}
+	check(!c.AuditRaw || c.AuditRawMaxBytes > 0, "AUDIT_RAW_MAX_BYTES must be positive, got %d", c.AuditRawMaxBytes)
+	check(c.EventLogFile == "" || c.EventLogMaxBytes > 0, "EVENT_LOG_MAX_BYTES must be positive, got %d", c.EventLogMaxBytes)
+	check(c.DedupeWindow >= 0, "DEDUPE_WINDOW must not be negative, got %s", c.DedupeWindow)
+	check(c.MaxPendingAge >= 0, "MAX_PENDING_AGE must not be negative, got %s", c.MaxPendingAge)
+	check(c.StuckAfter >= 0, "STUCK_AFTER must not be negative, got %s", c.StuckAfter)
+	check((c.MaxPendingAge == 0 && c.StuckAfter == 0) || c.PendingCheckInterval > 0, "PENDING_CHECK_INTERVAL must be positive, got %s", c.PendingCheckInterval)
+	check(c.ShedPendingThreshold >= 0, "SHED_PENDING_THRESHOLD must not be negative, got %d", c.ShedPendingThreshold)
+	check(c.ShedPendingThreshold == 0 || (c.ShedFraction > 0 && c.ShedFraction <= 1), "SHED_FRACTION must be above 0 and at most 1, got %g", c.ShedFraction)
+	check(c.ShedPendingThreshold == 0 || c.ShedCheckInterval > 0, "SHED_CHECK_INTERVAL must be positive, got %s", c.ShedCheckInterval)
+	check(c.WorkerStaleAfter > 0, "WORKER_STALE_AFTER must be positive, got %s", c.WorkerStaleAfter)
+	check(!c.LeaderElection || c.LeaderCheckInterval > 0, "LEADER_CHECK_INTERVAL must be positive, got %s", c.LeaderCheckInterval)
+	check(c.ReadyPingTTL >= 0, "READY_PING_TTL must not be negative, got %s", c.ReadyPingTTL)
+
+	return errors.Join(errs...)
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// envReader reads typed environment variables, falling back to a default
+// when a variable is unset and remembering the ones that don't parse.
+type envReader struct {
+	errs []error
+}
+
+func (r *envReader) fail(key, v, want string) {
+	r.errs = append(r.errs, fmt.Errorf("%s must be %s, got %q", key, want, v))
+}
+
+func (r *envReader) string(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func (r *envReader) list(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (r *envReader) int(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		r.fail(key, v, "an integer")
+		return def
+	}
+	return n
+}
+
+func (r *envReader) bool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		r.fail(key, v, "true or false")
+		return def
+	}
+	return b
+}
+
+func (r *envReader) float(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		r.fail(key, v, "a number")
+		return def
+	}
+	return f
+}
+
+func (r *envReader) duration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		r.fail(key, v, "a duration like 30s")
+		return def
+	}
+	return d
+}
+
+// Summary is a one-line key=value description of the effective
+// configuration for the startup log. Passwords in URLs are redacted and
+// secrets only show whether they are set.
+func (c Config) Summary() string {
+	redacted := func(urls []string) string {
+		out := make([]string, len(urls))
+		for i, u := range urls {
+			out[i] = redactURL(u)
+		}
+		return strings.Join(out, ",")
+	}
+	notifier := c.Notifier
+	if notifier == "" {
+		notifier = "log"
+	}
+	fields := []string{
+		fmt.Sprintf("port=%d", c.Port),
+		fmt.Sprintf("serverTimeouts=header:%s,read:%s,write:%s,idle:%s", c.ReadHeaderTimeout, c.ReadTimeout, c.WriteTimeout, c.IdleTimeout),
+		fmt.Sprintf("instanceID=%q", c.InstanceID),
+		fmt.Sprintf("multiTenant=%t", c.MultiTenant),
+		fmt.Sprintf("workers=%d", c.WorkerCount),
+		fmt.Sprintf("pollInterval=%s", c.PollInterval),
+		fmt.Sprintf("batchSize=%d", c.BatchSize),
+		fmt.Sprintf("maxInFlight=%d", c.MaxInFlight),
+		fmt.Sprintf("concurrencyLimit=%d", c.ConcurrencyLimit),
+		fmt.Sprintf("queueConsumer=%q", c.QueueConsumer),
+		fmt.Sprintf("databases=%s", redacted(c.DatabaseURLs)),
+		fmt.Sprintf("readDatabases=%s", redacted(c.ReadDatabaseURLs)),
+		fmt.Sprintf("dbAcquireTimeout=%s", c.DBAcquireTimeout),
+		fmt.Sprintf("dbMinConns=%d", c.DBMinConns),
+		fmt.Sprintf("notifier=%s", notifier),
+		fmt.Sprintf("notifyURL=%s", redactURL(c.NotifyURL)),
+		fmt.Sprintf("notifyRate=%g", c.NotifyRate),
+		fmt.Sprintf("notifyTimeout=%s", c.NotifyTimeout),
+		fmt.Sprintf("notifyRampUp=%s", c.NotifyRampUp),
+		fmt.Sprintf("notifyWindow=%q", c.NotifyWindow),
+		fmt.Sprintf("retrySchedule=%q", c.RetrySchedule),
+		fmt.Sprintf("delivery=%s", c.Delivery),
+		fmt.Sprintf("notifyOrder=%s", c.NotifyOrder),
+		fmt.Sprintf("priorityAging=%s", c.PriorityAging),
+		fmt.Sprintf("deadLetterTable=%t", c.DeadLetterTable),
+		fmt.Sprintf("breakerThreshold=%d", c.BreakerThreshold),
+		fmt.Sprintf("breakerCooldown=%s", c.BreakerCooldown),
+		fmt.Sprintf("dedupeWindow=%s", c.DedupeWindow),
+		fmt.Sprintf("maxPendingAge=%s", c.MaxPendingAge),
+		fmt.Sprintf("shedPendingThreshold=%d", c.ShedPendingThreshold),
+		fmt.Sprintf("shedFraction=%g", c.ShedFraction),
+		fmt.Sprintf("stuckAfter=%s", c.StuckAfter),
+		fmt.Sprintf("leaderElection=%t", c.LeaderElection),
+		fmt.Sprintf("logBuffered=%t", c.LogBuffered),
+		fmt.Sprintf("metricsExemplars=%t", c.MetricsExemplars),
+		fmt.Sprintf("eventLogFile=%q", c.EventLogFile),
+		fmt.Sprintf("adminAPIKey=%s", secretSet(c.AdminAPIKey)),
+		fmt.Sprintf("notifySigningSecret=%s", secretSet(c.NotifySigningSecret)),
+	}
+	return strings.Join(fields, " ")
+}
+
+// Redacted returns c for GET /admin/config, keyed by the lower camel
+// case field name. Durations are spelled like the environment takes them,
+// URLs lose their passwords and secrets only show whether they are set,
+// as in Summary.
+func (c Config) Redacted() map[string]any {
+	out := map[string]any{}
+	v := reflect.ValueOf(c)
+	for _, f := range reflect.VisibleFields(v.Type()) {
+		if !f.IsExported() {
+			continue
+		}
+		val := v.FieldByIndex(f.Index).Interface()
+		if d, ok := val.(time.Duration); ok {
+			val = d.String()
+		}
+		out[lowerCamel(f.Name)] = val
+	}
+
+	redactAll := func(urls []string) []string {
+		out := make([]string, len(urls))
+		for i, u := range urls {
+			out[i] = redactURL(u)
+		}
+		return out
+	}
+	out["databaseURLs"] = redactAll(c.DatabaseURLs)
+	out["readDatabaseURLs"] = redactAll(c.ReadDatabaseURLs)
+	out["notifyURL"] = redactURL(c.NotifyURL)
+	out["statusWebhookURL"] = redactURL(c.StatusWebhookURL)
+	out["adminAPIKey"] = secretSet(c.AdminAPIKey)
+	out["notifySigningSecret"] = secretSet(c.NotifySigningSecret)
+	return out
+}
+
+// lowerCamel lowers the leading capitals of a field name, keeping the
+// last one when it starts a word: DBMinConns becomes dbMinConns.
+func lowerCamel(name string) string {
+	n := 0
+	for n < len(name) && name[n] >= 'A' && name[n] <= 'Z' {
+		n++
+	}
+	if n > 1 && n < len(name) {
+		n--
+	}
+	return strings.ToLower(name[:n]) + name[n:]
+}
+
+// hostname is the default INSTANCE_ID: $HOSTNAME, which is the pod name
+// on Kubernetes, or else the OS host name.
+func hostname() string {
+	if h := os.Getenv("HOSTNAME"); h != "" {
+		return h
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
+func secretSet(v string) string {
+	if v == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// headerNamePattern accepts the header names NOTIFY_IDEMPOTENCY_HEADER
+// may use.
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// keywordPassword matches the password of a "host=... password=..."
+// connection string, quoted or not.
+var keywordPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// urlScheme matches the scheme of a connection string given as a URL. A
+// keyword/value string never matches, since its first keyword is followed
+// by '=' rather than ':'.
+var urlScheme = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9+.-]*):`)
+
+// checkDatabaseURL rejects URLs pgxpool would fail on with a less
+// helpful error, such as mysql:// or mysql:host. Keyword/value connection
+// strings ("host=... dbname=...") have no scheme and are left to pgxpool.
+func checkDatabaseURL(databaseURL string) error {
+	m := urlScheme.FindStringSubmatch(databaseURL)
+	if m == nil {
+		return nil
+	}
+	// pgxpool only takes these two prefixes as a URL and would parse
+	// anything else as keywords.
+	if !strings.HasPrefix(databaseURL, "postgres://") && !strings.HasPrefix(databaseURL, "postgresql://") {
+		return fmt.Errorf("database URL must start with postgres:// or postgresql://, got scheme %q", m[1])
+	}
+	if _, err := url.Parse(databaseURL); err != nil {
+		// The error would repeat the URL, password included.
+		return errors.New("database URL is not a valid URL")
+	}
+	return nil
+}
+
+// redactURL hides the password in a URL or keyword/value connection
+// string.
+func redactURL(raw string) string {
+	if strings.Contains(raw, "://") {
+		if u, err := url.Parse(raw); err == nil {
+			// libpq also takes the password as a query parameter.
+			if q := u.Query(); q.Has("password") {
+				q.Set("password", "xxxxx")
+				u.RawQuery = q.Encode()
+			}
+			return u.Redacted()
+		}
+		// Unparseable, so we can't tell where the password is.
+		return "<redacted>"
+	}
+	return keywordPassword.ReplaceAllString(raw, "${1}xxxxx")
+}
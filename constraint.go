@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// checkViolation is the SQLSTATE of a failed CHECK constraint.
+const checkViolation = "23514"
+
+// checkConstraints maps CHECK constraints on cart_events to the field
+// error a client gets for violating them. The names are the ones
+// Postgres picks for a column constraint, e.g.
+// ALTER TABLE cart_events ADD CHECK (order_type IN ('Purchase', 'Refund')).
+var checkConstraints = map[string]struct{ field, message string }{
+	"cart_events_order_type_check":  {"orderType", "is not an accepted order type"},
+	"cart_events_session_id_check":  {"sessionId", "is not an accepted session ID"},
+	"cart_events_card_check":        {"card", "is not an accepted card"},
+	"cart_events_event_date_check":  {"eventDate", "is outside the accepted range"},
+	"cart_events_website_url_check": {"websiteUrl", "is not an accepted URL"},
+	"cart_events_region_check":      {"websiteUrl", "is in a region that is not accepted"},
+}
+
+// constraintError turns a violation of a known CHECK constraint into a
+// *ValidationError naming the field as schema version spells it, and
+// returns every other error unchanged. An unknown
+// constraint stays a database error, since the service can't tell the
+// client what to fix.
+func constraintError(err error, version int) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != checkViolation {
+		return err
+	}
+	c, ok := checkConstraints[pgErr.ConstraintName]
+	if !ok {
+		return err
+	}
+	return invalid(versionedField(version, c.field), c.message)
+}
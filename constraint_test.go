@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestConstraintErrorKnownCheck(t *testing.T) {
+	pgErr := &pgconn.PgError{Code: checkViolation, ConstraintName: "cart_events_website_url_check"}
+	for version, field := range map[int]string{0: "websiteUrl", 1: "websiteUrl", 2: "pageUrl"} {
+		var validationErr *ValidationError
+		if err := constraintError(pgErr, version); !errors.As(err, &validationErr) {
+			t.Errorf("version %d: %v, want a ValidationError", version, err)
+		} else if validationErr.Field != field || validationErr.Message != "is not an accepted URL" {
+			t.Errorf("version %d: %q %q, want field %s", version, validationErr.Field, validationErr.Message, field)
+		}
+	}
+}
+
+func TestConstraintErrorPassesOtherErrorsThrough(t *testing.T) {
+	for name, err := range map[string]error{
+		"unknown constraint": &pgconn.PgError{Code: checkViolation, ConstraintName: "cart_events_something_check"},
+		"not a check":        &pgconn.PgError{Code: "23505", ConstraintName: "cart_events_pkey"},
+		"not a pg error":     errors.New("connection reset"),
+	} {
+		if got := constraintError(err, 1); got != err {
+			t.Errorf("%s: constraintError = %v, want the error unchanged", name, got)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Consumer is a message queue ingress, e.g. a RabbitMQ queue or an SQS
+// queue. Adapters for a specific broker implement it; Handler.Consume
+// does the rest, so queued events go through the same validation and
+// storage as POST /event.
+type Consumer interface {
+	// Receive blocks until a message is available or ctx is done.
+	Receive(ctx context.Context) (Message, error)
+}
+
+// Message is one queued CartEvent in JSON.
+type Message interface {
+	Body() []byte
+	// Ack removes the message from the queue.
+	Ack(ctx context.Context) error
+	// Nack returns the message to the queue for redelivery.
+	Nack(ctx context.Context) error
+}
+
+var (
+	consumedEvents = newCounter("queue_events_stored_total",
+		"Events from the message queue that were stored.")
+	rejectedMessages = newCounter("queue_messages_rejected_total",
+		"Queue messages dropped because they were malformed or failed validation.")
+)
+
+// Consume stores events from c until ctx is done or c returns io.EOF.
+// Messages that can never be stored (bad JSON, failed validation,
+// disallowed host or region) are logged and acked so they don't block
+// the queue; database errors nack the message so the broker redelivers
+// it.
+func (h *Handler) Consume(ctx context.Context, c Consumer) {
+	for {
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				log.Println("Queue consumer has no more messages")
+				return
+			}
+			log.Println("Error receiving from queue:", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		h.consumeMessage(ctx, msg)
+	}
+}
+
+func (h *Handler) consumeMessage(ctx context.Context, msg Message) {
+	var validationErr *ValidationError
+	event, err := unmarshalEvent(msg.Body(), 0)
+	if err == nil {
+		_, err = h.ingest(ctx, event, msg.Body())
+	}
+	switch {
+	case err == nil:
+		consumedEvents.Inc()
+	case errors.As(err, &validationErr), errors.Is(err, errHostNotAllowed),
+		errors.Is(err, errRegionNotAllowed), errors.Is(err, errMalformedMessage):
+		log.Println("Dropping queued event:", err)
+		rejectedMessages.Inc()
+	default:
+		if !isShutdown(ctx, err) {
+			log.Println("Error storing queued event, requeueing:", err)
+		}
+		if err := msg.Nack(context.Background()); err != nil {
+			log.Println("Error nacking queue message:", err)
+		}
+		return
+	}
+	if err := msg.Ack(context.Background()); err != nil {
+		log.Println("Error acking queue message:", err)
+	}
+}
+
+var errMalformedMessage = errors.New("malformed message")
+
+// newConsumer returns the QUEUE_CONSUMER adapter called name.
+func newConsumer(name string) (Consumer, error) {
+	switch name {
+	case "stdin":
+		return newLineConsumer(os.Stdin), nil
+	}
+	return nil, fmt.Errorf("unknown queue consumer %q", name)
+}
+
+// QueueRedeliveryDelay is how long a lineConsumer holds back a nacked
+// message, so a database outage isn't retried in a tight loop.
+const QueueRedeliveryDelay = time.Second
+
+// lineConsumer reads one JSON event per line, e.g. from stdin fed by a
+// broker's command line client such as kcat. A line is gone once read, so
+// Ack does nothing and Nack hands the message back to be received again.
+// At the end of the input Receive returns io.EOF.
+type lineConsumer struct {
+	lines chan []byte
+	delay time.Duration
+
+	mu        sync.Mutex
+	redeliver Message
+}
+
+func newLineConsumer(r io.Reader) *lineConsumer {
+	c := &lineConsumer{lines: make(chan []byte), delay: QueueRedeliveryDelay}
+	go c.read(r)
+	return c
+}
+
+// read sends every non-empty line of r to c.lines and closes it at the
+// end. Lines longer than any valid event are skipped without buffering
+// them whole.
+func (c *lineConsumer) read(r io.Reader) {
+	defer close(c.lines)
+	br := bufio.NewReaderSize(r, MaxEventBytes+1)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			log.Printf("Dropping queued event: longer than %d bytes", MaxEventBytes)
+			rejectedMessages.Inc()
+		} else if line = bytes.TrimSpace(line); len(line) > 0 {
+			c.lines <- bytes.Clone(line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading queue input:", err)
+			}
+			return
+		}
+	}
+}
+
+func (c *lineConsumer) Receive(ctx context.Context) (Message, error) {
+	c.mu.Lock()
+	msg := c.redeliver
+	c.redeliver = nil
+	c.mu.Unlock()
+	if msg != nil {
+		select {
+		case <-ctx.Done():
+			msg.Nack(ctx)
+			return nil, ctx.Err()
+		case <-time.After(c.delay):
+			return msg, nil
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case line, ok := <-c.lines:
+		if !ok {
+			return nil, io.EOF
+		}
+		return &lineMessage{c: c, body: line}, nil
+	}
+}
+
+type lineMessage struct {
+	c    *lineConsumer
+	body []byte
+}
+
+func (m *lineMessage) Body() []byte { return m.body }
+
+func (m *lineMessage) Ack(ctx context.Context) error { return nil }
+
+func (m *lineMessage) Nack(ctx context.Context) error {
+	m.c.mu.Lock()
+	defer m.c.mu.Unlock()
+	m.c.redeliver = m
+	return nil
+}
+
+// unmarshalEvent decodes one event strictly: unknown fields are rejected
+// and so is anything larger than MaxEventBytes. snake_case keys are
+// renamed and then older and newer schema versions upgraded first, see
+// upgradeEvent; version is the one the request header declared, or zero.
+func unmarshalEvent(data []byte, version int) (CartEvent, error) {
+	var event CartEvent
+	if len(data) > MaxEventBytes {
+		return event, fmt.Errorf("%w: larger than %d bytes", errMalformedMessage, MaxEventBytes)
+	}
+	var fields map[string]json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&fields); err != nil {
+		return event, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	if err := expectEOF(dec); err != nil {
+		return event, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	// Renamed before the upgrade so it sees a version's own keys in
+	// either spelling.
+	renamed, err := camelCaseFields(fields)
+	if err != nil {
+		return event, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	version, changed, err := upgradeEvent(fields, version)
+	if err != nil {
+		return event, fmt.Errorf("%w: %w", errMalformedMessage, err)
+	}
+	if renamed || changed {
+		if data, err = json.Marshal(fields); err != nil {
+			return event, fmt.Errorf("%w: %v", errMalformedMessage, err)
+		}
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, fmt.Errorf("%w: %v", errMalformedMessage, err)
+	}
+	event.version = version
+	return event, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockConsumer hands out its messages in order, then io.EOF.
+type mockConsumer struct {
+	mu       sync.Mutex
+	messages []*mockMessage
+}
+
+func (c *mockConsumer) Receive(ctx context.Context) (Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := c.messages[0]
+	c.messages = c.messages[1:]
+	return msg, nil
+}
+
+type mockMessage struct {
+	body        string
+	acked, nack bool
+}
+
+func (m *mockMessage) Body() []byte                   { return []byte(m.body) }
+func (m *mockMessage) Ack(ctx context.Context) error  { m.acked = true; return nil }
+func (m *mockMessage) Nack(ctx context.Context) error { m.nack = true; return nil }
+
+func queuedEvent(session string) string {
+	return `{"orderType":"Purchase","sessionId":"` + session + `","card":"4433**1409","eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"}`
+}
+
+func TestConsume(t *testing.T) {
+	var mu sync.Mutex
+	var inserted []string
+	f := newFakePG(t, func(sql string) fakeResult {
+		if !strings.Contains(sql, "INSERT INTO cart_events") {
+			return fakeResult{}
+		}
+		if strings.Contains(sql, "'db-down'") {
+			return fakeResult{err: pgError("57P01", "terminating connection due to administrator command")}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		inserted = append(inserted, sql)
+		return fakeResult{tag: "INSERT 0 1"}
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+	captureLog(t)
+
+	stored := &mockMessage{body: queuedEvent("ok")}
+	malformed := &mockMessage{body: `{"orderType":`}
+	invalid := &mockMessage{body: `{"orderType":"Purchase"}`}
+	failing := &mockMessage{body: queuedEvent("db-down")}
+	consumer := &mockConsumer{messages: []*mockMessage{stored, malformed, invalid, failing}}
+
+	done := make(chan struct{})
+	go func() {
+		h.Consume(context.Background(), consumer)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Consume didn't return at the end of the queue")
+	}
+
+	for name, tt := range map[string]struct {
+		msg         *mockMessage
+		acked, nack bool
+	}{
+		"stored":    {stored, true, false},
+		"malformed": {malformed, true, false},
+		"invalid":   {invalid, true, false},
+		"db error":  {failing, false, true},
+	} {
+		if tt.msg.acked != tt.acked || tt.msg.nack != tt.nack {
+			t.Errorf("%s: acked %v nacked %v, want %v %v", name, tt.msg.acked, tt.msg.nack, tt.acked, tt.nack)
+		}
+	}
+	if len(inserted) != 1 || !strings.Contains(inserted[0], "'ok'") {
+		t.Errorf("inserted %q, want only the valid event", inserted)
+	}
+}
+
+func TestLineConsumer(t *testing.T) {
+	input := "first\n\n" + strings.Repeat("x", MaxEventBytes+10) + "\nsecond"
+	c := newLineConsumer(strings.NewReader(input))
+	c.delay = time.Millisecond
+	captureLog(t)
+	ctx := context.Background()
+
+	receive := func() string {
+		t.Helper()
+		msg, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(msg.Body())
+	}
+	first, err := c.Receive(ctx)
+	if err != nil || string(first.Body()) != "first" {
+		t.Fatalf("Receive = %v, %v", first, err)
+	}
+	first.Nack(ctx)
+	if got := receive(); got != "first" {
+		t.Errorf("after Nack got %q, want the message again", got)
+	}
+	if got := receive(); got != "second" {
+		t.Errorf("got %q, want the oversized line skipped", got)
+	}
+	if _, err := c.Receive(ctx); err != io.EOF {
+		t.Errorf("at the end of the input Receive = %v, want io.EOF", err)
+	}
+}
+
+func TestNewConsumerRejectsUnknown(t *testing.T) {
+	if _, err := newConsumer("kafka"); err == nil {
+		t.Error("unknown consumer accepted")
+	}
+}
+
+func TestConsumeDropsDisallowedRegion(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") {
+			t.Errorf("event from a disallowed region was inserted: %s", sql)
+		}
+		return fakeResult{tag: "INSERT 0 1"}
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, regions: RegionMap{"com": "us"}, allowedRegions: []string{"eu"}}
+	captureLog(t)
+
+	msg := &mockMessage{body: queuedEvent("us")}
+	h.Consume(context.Background(), &mockConsumer{messages: []*mockMessage{msg}})
+	if !msg.acked || msg.nack {
+		t.Errorf("acked %v nacked %v, want the message dropped", msg.acked, msg.nack)
+	}
+}
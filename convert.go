@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MaxOrderTypeLen = 30
+	MaxSessionIDLen = 256
+	MaxDelay        = 7 * 24 * time.Hour
+	MaxPriority     = 9
+)
+
+var (
+	digitsPattern     = regexp.MustCompile(`^[0-9]+$`)
+	fullCardPattern   = regexp.MustCompile(`^[0-9]{12,19}$`)
+	maskedCardPattern = regexp.MustCompile(`^[0-9]{4}\*{2,8}[0-9]{4}$`)
+)
+
+// ValidationError reports a CartEvent field the client has to fix.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+
+	// format and args produced Message, kept to translate it.
+	format string
+	args   []any
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+func invalid(field, format string, args ...any) error {
+	return &ValidationError{Field: field, Message: fmt.Sprintf(format, args...), format: format, args: args}
+}
+
+// ValidationErrors holds every problem found with one event, so clients
+// can fix them all in one go. errors.As finds each *ValidationError in it.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs ValidationErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
+
+// add appends err if it is a *ValidationError.
+func (errs *ValidationErrors) add(err error) {
+	var v *ValidationError
+	if errors.As(err, &v) {
+		*errs = append(*errs, v)
+	}
+}
+
+func (errs ValidationErrors) has(field string) bool {
+	for _, err := range errs {
+		if err.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (errs ValidationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validationFailures returns the individual field errors in err for the
+// "errors" list of a 422 response.
+func validationFailures(err error) []*ValidationError {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	var v *ValidationError
+	if errors.As(err, &v) {
+		return []*ValidationError{v}
+	}
+	return nil
+}
+
+// UnmarshalJSON accepts the card as a JSON string or, for clients that
+// send it that way, a JSON integer. Numbers can't carry leading zeros, so
+// their use is logged. Keys may be camelCase or snake_case, see
+// snakeCaseKeys. Unknown fields are still rejected.
+func (e *CartEvent) UnmarshalJSON(data []byte) error {
+	type plain CartEvent
+	aux := struct {
+		*plain
+		Card json.RawMessage `json:"card"`
+	}{plain: (*plain)(e)}
+
+	data, fields, err := camelCaseKeys(data)
+	if err != nil {
+		return err
+	}
+	e.sent = make(map[string]bool, len(fields))
+	e.nulls = map[string]bool{}
+	for key, v := range fields {
+		e.sent[key] = true
+		if string(v) == "null" {
+			e.nulls[key] = true
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+
+	switch {
+	case len(aux.Card) == 0 || string(aux.Card) == "null":
+		e.Card = ""
+	case aux.Card[0] == '"':
+		if err := json.Unmarshal(aux.Card, &e.Card); err != nil {
+			return err
+		}
+	case digitsPattern.Match(aux.Card):
+		log.Printf("Card for session %s sent as a JSON number, leading zeros may be lost", e.SessionID)
+		e.Card = string(aux.Card)
+	default:
+		return errors.New("card must be a string or an integer")
+	}
+	return nil
+}
+
+// snakeCaseKeys maps the snake_case spelling of each CartEvent key, and
+// of the keys later schema versions renamed them to, to the camelCase one
+// its JSON tag uses.
+var snakeCaseKeys = map[string]string{
+	"order_type":    "orderType",
+	"session_id":    "sessionId",
+	"event_date":    "eventDate",
+	"website_url":   "websiteUrl",
+	"delay_seconds": "delaySeconds",
+	"created_at":    "createdAt",
+	"occurred_at":   "occurredAt",
+	"page_url":      "pageUrl",
+}
+
+// camelCaseKeys rewrites snake_case keys of a JSON object to camelCase
+// and returns the object along with its fields.
+func camelCaseKeys(data []byte) ([]byte, map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, nil, err
+	}
+	renamed, err := camelCaseFields(fields)
+	if err != nil || !renamed {
+		return data, fields, err
+	}
+	data, err = json.Marshal(fields)
+	return data, fields, err
+}
+
+// camelCaseFields renames the snake_case keys in fields to camelCase and
+// reports whether there were any. Sending both spellings of one key is an
+// error rather than a guess.
+func camelCaseFields(fields map[string]json.RawMessage) (bool, error) {
+	renamed := false
+	for snake, camel := range snakeCaseKeys {
+		v, ok := fields[snake]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[camel]; ok {
+			return false, fmt.Errorf("both %s and %s given", snake, camel)
+		}
+		fields[camel] = v
+		delete(fields, snake)
+		renamed = true
+	}
+	return renamed, nil
+}
+
+// blank explains why a required string field came out empty: it was
+// null, an empty string, or not sent at all.
+func (e CartEvent) blank(key string) string {
+	switch {
+	case e.nulls[key]:
+		return "must not be null"
+	case e.sent[key]:
+		return "must not be empty"
+	}
+	return "is required"
+}
+
+// Validate checks the event without transforming it. It reports every
+// failing field as ValidationErrors, or nil.
+func (e CartEvent) Validate() error {
+	var errs ValidationErrors
+	switch {
+	case e.OrderType == "":
+		errs.add(invalid("orderType", e.blank("orderType")))
+	case len(e.OrderType) > MaxOrderTypeLen:
+		errs.add(invalid("orderType", "must be at most %d characters", MaxOrderTypeLen))
+	}
+	switch {
+	case e.SessionID == "":
+		errs.add(invalid("sessionId", e.blank("sessionId")))
+	case len(e.SessionID) > MaxSessionIDLen:
+		errs.add(invalid("sessionId", "must be at most %d characters", MaxSessionIDLen))
+	}
+	switch {
+	case e.Card == "":
+		errs.add(invalid("card", e.blank("card")))
+	case !fullCardPattern.MatchString(e.Card) && !maskedCardPattern.MatchString(e.Card):
+		errs.add(invalid("card", "must be a card number or a masked card like 4433**1409"))
+	}
+	if e.WebsiteURL == "" {
+		errs.add(invalid("websiteUrl", e.blank("websiteUrl")))
+	}
+	if e.EventDate == "" {
+		errs.add(invalid("eventDate", e.blank("eventDate")))
+	}
+	if e.DelaySeconds < 0 || time.Duration(e.DelaySeconds)*time.Second > MaxDelay {
+		errs.add(invalid("delaySeconds", "must be between 0 and %d", int(MaxDelay.Seconds())))
+	}
+	if e.Priority < 0 || e.Priority > MaxPriority {
+		errs.add(invalid("priority", "must be between 0 and %d", MaxPriority))
+	}
+	return errs.err()
+}
+
+// toPGCartEvent validates the event and turns it into the row we store:
+// the card is stripped of formatting and masked, the date parsed to UTC
+// and the URL normalized.
+func (e CartEvent) toPGCartEvent() (PGCartEvent, error) {
+	e.Card = normalizeCard(e.Card)
+	var errs ValidationErrors
+	if err := e.Validate(); err != nil {
+		errs = err.(ValidationErrors)
+	}
+
+	eventDate, msg, err := parseVersionedDate(e.version, e.EventDate)
+	if err != nil && !errs.has("eventDate") {
+		errs.add(invalid("eventDate", msg))
+	}
+
+	websiteURL, err := normalizeURL(e.WebsiteURL)
+	if err != nil && !errs.has("websiteUrl") {
+		errs.add(invalid("websiteUrl", "must be an absolute http(s) URL"))
+	}
+	lastFour := ""
+	if len(e.Card) >= 4 {
+		lastFour = e.Card[len(e.Card)-4:]
+	}
+	if !errs.has("card") && !digitsPattern.MatchString(lastFour) {
+		errs.add(invalid("card", "must end in four digits"))
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			err.Field = versionedField(e.version, err.Field)
+		}
+		return PGCartEvent{}, errs
+	}
+
+	version := e.version
+	if version == 0 {
+		version = DefaultSchemaVersion
+	}
+	return PGCartEvent{
+		OrderType:     e.OrderType,
+		SessionID:     e.SessionID,
+		Card:          maskCard(e.Card),
+		CardLastFour:  lastFour,
+		EventDate:     eventDate,
+		WebsiteURL:    websiteURL,
+		Delay:         time.Duration(e.DelaySeconds) * time.Second,
+		Priority:      e.Priority,
+		SchemaVersion: version,
+	}, nil
+}
+
+// cardFormatting strips the separators people type into card numbers,
+// as in "4111 1111 1111 1111" or "4111-1111-1111-1111".
+var cardFormatting = strings.NewReplacer(" ", "", "-", "")
+
+func normalizeCard(card string) string {
+	return cardFormatting.Replace(card)
+}
+
+// maskCard keeps the first and last four digits of a card number, the
+// format clients already send (4433**1409). Masked input is unchanged.
+func maskCard(card string) string {
+	if !fullCardPattern.MatchString(card) {
+		return card
+	}
+	return card[:4] + "**" + card[len(card)-4:]
+}
+
+// normalizeURL lowercases the scheme and host and drops default ports and
+// fragments so the same site is always stored the same way.
+func normalizeURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return "", fmt.Errorf("not an absolute http(s) URL: %q", raw)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+	u.Fragment = ""
+	if u.Path == "/" {
+		u.Path = ""
+	}
+	return u.String(), nil
+}
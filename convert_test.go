@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validEvent is a version 1 event body with extra appended as further
+// fields.
+func validEvent(extra string) string {
+	body := `{"orderType":"Purchase","sessionId":"s","card":"4433**1409","eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"`
+	if extra != "" {
+		body += "," + extra
+	}
+	return body + "}"
+}
+
+func TestCreatedAtMustBeStringOrNull(t *testing.T) {
+	tests := []struct {
+		createdAt string
+		ok        bool
+	}{
+		{"", true},
+		{`"createdAt":"2024-01-01T00:00:00Z"`, true},
+		{`"createdAt":null`, true},
+		{`"createdAt":{"nested":{"deep":[1,2,3]}}`, false},
+		{`"createdAt":["2024-01-01"]`, false},
+		{`"createdAt":1704067200`, false},
+		{`"createdAt":true`, false},
+	}
+	for _, tt := range tests {
+		_, err := unmarshalEvent([]byte(validEvent(tt.createdAt)), 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.createdAt, err, tt.ok)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/event", strings.NewReader(validEvent(`"createdAt":{"a":1}`)))
+	req.Header.Set("Content-Type", "application/json")
+	(&Handler{}).Event(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("object createdAt: status %d, want 400", rec.Code)
+	}
+}
+
+func TestEventDateParsedToUTC(t *testing.T) {
+	event := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T10:00:00+02:00", WebsiteURL: "https://example.com"}
+	pgEvent, err := event.toPGCartEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	if !pgEvent.EventDate.Equal(want) || pgEvent.EventDate.Location() != time.UTC {
+		t.Errorf("EventDate = %s, want %s", pgEvent.EventDate, want)
+	}
+}
+
+func TestToPGCartEvent(t *testing.T) {
+	base := func(change func(*CartEvent)) CartEvent {
+		e := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T10:00:00Z", WebsiteURL: "https://example.com/cart"}
+		if change != nil {
+			change(&e)
+		}
+		return e
+	}
+	stored := func(change func(*PGCartEvent)) PGCartEvent {
+		e := PGCartEvent{
+			OrderType: "Purchase", SessionID: "s", Card: "4433**1409", CardLastFour: "1409",
+			EventDate: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC), WebsiteURL: "https://example.com/cart",
+			SchemaVersion: DefaultSchemaVersion,
+		}
+		if change != nil {
+			change(&e)
+		}
+		return e
+	}
+	tests := []struct {
+		name      string
+		event     CartEvent
+		want      PGCartEvent
+		badFields []string
+	}{
+		{name: "masked card", event: base(nil), want: stored(nil)},
+		{
+			name:  "full card is masked",
+			event: base(func(e *CartEvent) { e.Card = "4111111111111111" }),
+			want:  stored(func(e *PGCartEvent) { e.Card, e.CardLastFour = "4111**1111", "1111" }),
+		},
+		{
+			name:  "formatted card",
+			event: base(func(e *CartEvent) { e.Card = "4111 1111-1111 1234" }),
+			want:  stored(func(e *PGCartEvent) { e.Card, e.CardLastFour = "4111**1234", "1234" }),
+		},
+		{
+			name:  "offset date",
+			event: base(func(e *CartEvent) { e.EventDate = "2024-01-01T12:00:00+02:00" }),
+			want:  stored(nil),
+		},
+		{
+			name:  "postgres date",
+			event: base(func(e *CartEvent) { e.EventDate = "2024-01-01 10:00:00" }),
+			want:  stored(nil),
+		},
+		{
+			name:  "url normalized",
+			event: base(func(e *CartEvent) { e.WebsiteURL = " HTTPS://Example.COM:443/cart#top" }),
+			want:  stored(nil),
+		},
+		{
+			name:  "delay and priority",
+			event: base(func(e *CartEvent) { e.DelaySeconds, e.Priority = 90, 3 }),
+			want:  stored(func(e *PGCartEvent) { e.Delay, e.Priority = 90*time.Second, 3 }),
+		},
+		{
+			name:      "bad date",
+			event:     base(func(e *CartEvent) { e.EventDate = "yesterday" }),
+			badFields: []string{"eventDate"},
+		},
+		{
+			name:      "relative url",
+			event:     base(func(e *CartEvent) { e.WebsiteURL = "/cart" }),
+			badFields: []string{"websiteUrl"},
+		},
+		{
+			name:      "several problems",
+			event:     base(func(e *CartEvent) { e.Card, e.OrderType, e.WebsiteURL = "4433**14xx", "", "ftp://example.com" }),
+			badFields: []string{"orderType", "card", "websiteUrl"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.event.toPGCartEvent()
+		if tt.badFields != nil {
+			var fields []string
+			for _, v := range validationFailures(err) {
+				fields = append(fields, v.Field)
+			}
+			if !slices.Equal(fields, tt.badFields) {
+				t.Errorf("%s: invalid fields %v, want %v (err %v)", tt.name, fields, tt.badFields, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s:\n got %+v\nwant %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCardAsStringOrNumber(t *testing.T) {
+	body := func(card string) []byte {
+		return []byte(`{"orderType":"Purchase","sessionId":"s","card":` + card + `,"eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"}`)
+	}
+	tests := []struct {
+		card   string
+		want   string
+		warned bool
+		ok     bool
+	}{
+		{card: `"4111111111111111"`, want: "4111111111111111", ok: true},
+		{card: `"4433**1409"`, want: "4433**1409", ok: true},
+		{card: `4111111111111111`, want: "4111111111111111", warned: true, ok: true},
+		{card: `null`, want: "", ok: true},
+		{card: `4111.5`},
+		{card: `-4111111111111111`},
+		{card: `4.1e15`},
+		{card: `true`},
+		{card: `["4111111111111111"]`},
+	}
+	for _, tt := range tests {
+		logs := captureLog(t)
+		event, err := unmarshalEvent(body(tt.card), 0)
+		if (err == nil) != tt.ok {
+			t.Errorf("card %s: err = %v, want ok %v", tt.card, err, tt.ok)
+			continue
+		}
+		if tt.ok && event.Card != tt.want {
+			t.Errorf("card %s: stored %q, want %q", tt.card, event.Card, tt.want)
+		}
+		if warned := strings.Contains(logs.String(), "leading zeros may be lost"); warned != tt.warned {
+			t.Errorf("card %s: warned %v, want %v", tt.card, warned, tt.warned)
+		}
+	}
+}
+
+func TestValidateReportsEveryViolation(t *testing.T) {
+	body := `{"orderType":"Purchase","card":"not-a-card","eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com","delaySeconds":-1}`
+	want := []string{"sessionId", "card", "delaySeconds"}
+
+	var event CartEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, v := range validationFailures(event.Validate()) {
+		fields = append(fields, v.Field)
+	}
+	if !slices.Equal(fields, want) {
+		t.Errorf("Validate reported %v, want %v", fields, want)
+	}
+
+	req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	(&Handler{}).Event(rec, req)
+	var resp validationResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("event: %d %s", rec.Code, rec.Body)
+	}
+	fields = nil
+	for _, v := range resp.Errors {
+		fields = append(fields, v.Field)
+		if !strings.Contains(resp.Error, v.Field+" "+v.Message) {
+			t.Errorf("error %q leaves out %s", resp.Error, v.Field)
+		}
+	}
+	if !slices.Equal(fields, want) {
+		t.Errorf("response lists %v, want %v", fields, want)
+	}
+}
+
+func TestNormalizeCard(t *testing.T) {
+	for card, want := range map[string]string{
+		"4111111111111111":      "4111111111111111",
+		"4111 1111 1111 1111":   "4111111111111111",
+		"4111-1111-1111-1111":   "4111111111111111",
+		"4111 1111-1111 1111":   "4111111111111111",
+		"4111 - 1111  1111-111": "411111111111111",
+		"4433**1409":            "4433**1409",
+		"4433 ** 1409":          "4433**1409",
+		"":                      "",
+	} {
+		if got := normalizeCard(card); got != want {
+			t.Errorf("normalizeCard(%q) = %q, want %q", card, got, want)
+		}
+	}
+	// Other separators are not formatting; validation rejects them.
+	for _, card := range []string{"4111.1111.1111.1111", "4111/1111/1111/1111"} {
+		errs, _ := CartEvent{Card: normalizeCard(card)}.Validate().(ValidationErrors)
+		if !errs.has("card") {
+			t.Errorf("card %q accepted", card)
+		}
+	}
+}
+
+func TestSnakeCaseKeysDecodeLikeCamelCase(t *testing.T) {
+	camel := `{"orderType":"Purchase","sessionId":"s-1","card":"4111 1111 1111 1111","eventDate":"2024-01-01T10:00:00+02:00","websiteUrl":"https://Example.com:443/cart","delaySeconds":30,"createdAt":"2024-01-01T00:00:00Z"}`
+	snake := `{"order_type":"Purchase","session_id":"s-1","card":"4111 1111 1111 1111","event_date":"2024-01-01T10:00:00+02:00","website_url":"https://Example.com:443/cart","delay_seconds":30,"created_at":"2024-01-01T00:00:00Z"}`
+	mixed := `{"orderType":"Purchase","session_id":"s-1","card":"4111 1111 1111 1111","eventDate":"2024-01-01T10:00:00+02:00","website_url":"https://Example.com:443/cart","delaySeconds":30,"created_at":"2024-01-01T00:00:00Z"}`
+
+	decode := func(body string) PGCartEvent {
+		t.Helper()
+		event, err := unmarshalEvent([]byte(body), 0)
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		pgEvent, err := event.toPGCartEvent()
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		return pgEvent
+	}
+	want := decode(camel)
+	for _, body := range []string{snake, mixed} {
+		if got := decode(body); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded to\n%+v\nwant\n%+v", body, got, want)
+		}
+	}
+
+	// Both spellings of one key are ambiguous.
+	if _, err := unmarshalEvent([]byte(`{"orderType":"Purchase","order_type":"Refund"}`), 0); err == nil {
+		t.Error("orderType and order_type together were accepted")
+	}
+	// A missing snake_case field is reported under its documented name.
+	event, err := unmarshalEvent([]byte(`{"order_type":"Purchase","card":"4433**1409","event_date":"2024-01-01T00:00:00Z","website_url":"https://example.com"}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs, _ := event.Validate().(ValidationErrors); !errs.has("sessionId") || len(errs) != 1 {
+		t.Errorf("Validate = %v, want only sessionId missing", errs)
+	}
+}
+
+func TestMissingNullAndEmptyFields(t *testing.T) {
+	tests := []struct {
+		card string
+		want string
+	}{
+		{``, "card is required"},
+		{`"card":null,`, "card must not be null"},
+		{`"card":"",`, "card must not be empty"},
+	}
+	for _, tt := range tests {
+		body := `{"orderType":"Purchase","sessionId":"s",` + tt.card + `"eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"}`
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		(&Handler{}).Event(rec, req)
+
+		var resp validationResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: %d %s", body, rec.Code, rec.Body)
+		}
+		if resp.Error != tt.want || len(resp.Errors) != 1 || resp.Errors[0].Field != "card" {
+			t.Errorf("%s: %+v, want only %q", body, resp, tt.want)
+		}
+	}
+
+	// Null for an optional field is the same as leaving it out.
+	var event CartEvent
+	if err := json.Unmarshal([]byte(validEvent(`"delaySeconds":null,"createdAt":null`)), &event); err != nil {
+		t.Fatal(err)
+	}
+	if err := event.Validate(); err != nil {
+		t.Errorf("null optional fields: %v", err)
+	}
+}
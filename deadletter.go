@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DeadLetter is an event that failed for good and was moved out of
+// cart_events with DEAD_LETTER_TABLE.
+type DeadLetter struct {
+	ID            string    `json:"id"`
+	OrderType     string    `json:"orderType"`
+	SessionID     string    `json:"sessionId"`
+	Card          string    `json:"card"`
+	EventDate     time.Time `json:"eventDate"`
+	WebsiteURL    string    `json:"websiteUrl"`
+	CreatedAt     time.Time `json:"createdAt"`
+	FailedAt      time.Time `json:"failedAt"`
+	FailureReason string    `json:"failureReason"`
+	TenantID      string    `json:"tenantId,omitempty"`
+	RetryCount    int       `json:"retryCount"`
+	// Attempts counts the notification attempts recorded for the event.
+	// The attempt rows stay in event_attempts.
+	Attempts int `json:"attempts"`
+}
+
+// moveToDeadLetter deletes event from cart_events and stores it in
+// dead_letter_events in the same statement, so it is never in both or
+// neither. Its event_attempts rows are left in place.
+func moveToDeadLetter(db *pgxpool.Pool, event PGCartEvent, reason string) error {
+	_, err := db.Exec(context.Background(), `
+	WITH moved AS (
+		DELETE FROM cart_events WHERE id = $1
+		RETURNING id, order_type, session_id, card, event_date, website_url, created_at, retry_count, tenant_id
+	)
+	INSERT INTO dead_letter_events (id, order_type, session_id, card, event_date, website_url, created_at, failure_reason, retry_count, tenant_id, attempts)
+	SELECT id, order_type, session_id, card, event_date, website_url, created_at, $2, retry_count, tenant_id,
+		(SELECT COUNT(*) FROM event_attempts WHERE event_id = $1)
+	FROM moved`, event.ID, reason)
+	return err
+}
+
+// DeadLetters lists dead-lettered events, most recently failed first.
+func (h *Handler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := DefaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxPageSize {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "invalid limit",
+			})
+			return
+		}
+		limit = n
+	}
+
+	letters := []DeadLetter{}
+	if !h.deadLetters {
+		// Schema managed elsewhere without DEAD_LETTER_TABLE; nothing
+		// can have been dead-lettered into a table that may not exist.
+		writeJSON(w, http.StatusOK, map[string][]DeadLetter{
+			"deadLetters": letters,
+		})
+		return
+	}
+	for _, db := range h.read.All() {
+		rows, err := db.Query(r.Context(), `
+		SELECT id, order_type, session_id, card, event_date, website_url, created_at, failed_at, failure_reason, COALESCE(tenant_id, ''), retry_count, attempts
+		FROM dead_letter_events
+		WHERE $2::text = '' OR tenant_id = $2
+		ORDER BY failed_at DESC, id
+		LIMIT $1`, limit, tenantID(r.Context()))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		shardLetters, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (DeadLetter, error) {
+			var d DeadLetter
+			err := row.Scan(&d.ID, &d.OrderType, &d.SessionID, &d.Card, &d.EventDate, &d.WebsiteURL,
+				&d.CreatedAt, &d.FailedAt, &d.FailureReason, &d.TenantID, &d.RetryCount, &d.Attempts)
+			return d, err
+		})
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		letters = append(letters, shardLetters...)
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].FailedAt.After(letters[j].FailedAt)
+		}
+		return letters[i].ID < letters[j].ID
+	})
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string][]DeadLetter{
+		"deadLetters": letters,
+	})
+}
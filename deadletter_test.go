@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMoveToDeadLetterKeepsAttempts(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	id := seedEvent(t, db, "session-1")
+	recordAttempt(db, id, errors.New("first failure"))
+	recordAttempt(db, id, errors.New("second failure"))
+
+	if err := moveToDeadLetter(db, PGCartEvent{ID: id}, "notification failed after 2 retries"); err != nil {
+		t.Fatal(err)
+	}
+	if status := eventStatus(t, db, id); status != "" {
+		t.Fatalf("event still in cart_events as %q", status)
+	}
+	var reason string
+	var attempts int
+	err := db.QueryRow(ctx, "SELECT failure_reason, attempts FROM dead_letter_events WHERE id = $1", id).Scan(&reason, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != "notification failed after 2 retries" || attempts != 2 {
+		t.Errorf("dead letter has reason %q and %d attempts", reason, attempts)
+	}
+
+	h := &Handler{db: NewHashRouter(db), read: NewHashRouter(db), deadLetters: true}
+	routes := h.routes()
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+id+"/attempts", nil))
+	var got struct{ Attempts []EventAttempt }
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("attempts: %d %s", rec.Code, rec.Body)
+	}
+	if len(got.Attempts) != 2 || got.Attempts[1].Error == nil || *got.Attempts[1].Error != "second failure" {
+		t.Errorf("attempts after dead-lettering = %+v, want both", got.Attempts)
+	}
+
+	rec = httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest("GET", "/dead-letters", nil))
+	var letters struct{ DeadLetters []DeadLetter }
+	if err := json.Unmarshal(rec.Body.Bytes(), &letters); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("dead letters: %d %s", rec.Code, rec.Body)
+	}
+	if len(letters.DeadLetters) != 1 || letters.DeadLetters[0].ID != id || letters.DeadLetters[0].Attempts != 2 {
+		t.Errorf("dead letters = %+v", letters.DeadLetters)
+	}
+}
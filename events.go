@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// eventColumns is the column list scanEvent expects, in order.
+const eventColumns = "id, order_type, session_id, card, event_date, website_url, status, created_at, notified_at, process_after, retry_count, COALESCE(region, ''), COALESCE(card_last_four, ''), COALESCE(instance_id, ''), COALESCE(tenant_id, ''), priority"
+
+// rawRow is one row of a query selecting eventColumns, decoded from its
+// raw values. Unlike rows.Scan, a value that fails to decode leaves the
+// result set open, so the caller can go on to the next row.
+type rawRow struct {
+	typeMap *pgtype.Map
+	fields  []pgconn.FieldDescription
+	values  [][]byte
+}
+
+func (r rawRow) Scan(dest ...any) error {
+	return pgx.ScanRow(r.typeMap, r.fields, r.values, dest...)
+}
+
+// id decodes just the id column, for rows scanEvent failed on.
+func (r rawRow) id() (string, bool) {
+	var id string
+	if len(r.values) == 0 || r.values[0] == nil {
+		return "", false
+	}
+	err := pgx.ScanRow(r.typeMap, r.fields[:1], r.values[:1], &id)
+	return id, err == nil
+}
+
+func scanEvent(row pgx.Row) (PGCartEvent, error) {
+	var event PGCartEvent
+	err := row.Scan(
+		&event.ID,
+		&event.OrderType,
+		&event.SessionID,
+		&event.Card,
+		&event.EventDate,
+		&event.WebsiteURL,
+		&event.Status,
+		&event.CreatedAt,
+		&event.NotifiedAt,
+		&event.ProcessAfter,
+		&event.RetryCount,
+		&event.Region,
+		&event.CardLastFour,
+		&event.InstanceID,
+		&event.TenantID,
+		&event.Priority,
+	)
+	if !exposeCardLastFour {
+		event.CardLastFour = ""
+	}
+	return event, err
+}
+
+// exposeCardLastFour includes card_last_four in responses and
+// notifications, set from CARD_LAST_FOUR. The column is always stored.
+var exposeCardLastFour bool
+
+type eventPage struct {
+	Events []PGCartEvent `json:"events"`
+	Next   string        `json:"next,omitempty"`
+}
+
+// List pages through events ordered by (created_at, id). The "after"
+// parameter takes the opaque "next" token of the previous page, so rows
+// inserted between fetches never shift the page boundaries. With
+// "sessionId" only that session's events are listed, which live on a
+// single shard.
+func (h *Handler) List(w http.ResponseWriter, r *http.Request) {
+	limit := DefaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxPageSize {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "invalid limit",
+			})
+			return
+		}
+		limit = n
+	}
+
+	var afterTime *time.Time
+	var afterID *string
+	if v := r.URL.Query().Get("after"); v != "" {
+		t, id, err := decodeCursor(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "invalid cursor",
+			})
+			return
+		}
+		afterTime, afterID = &t, &id
+	}
+
+	shards := h.read.All()
+	var sessionID *string
+	if r.URL.Query().Has("sessionId") {
+		v := r.URL.Query().Get("sessionId")
+		if v == "" || len(v) > MaxSessionIDLen {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": fmt.Sprintf("sessionId must be 1 to %d characters", MaxSessionIDLen),
+			})
+			return
+		}
+		sessionID = &v
+		shards = []*pgxpool.Pool{h.read.ForSession(v)}
+	}
+
+	// Every shard returns its own first page; merging those and cutting at
+	// limit gives the global page.
+	events := []PGCartEvent{}
+	for _, db := range shards {
+		rows, err := db.Query(r.Context(), `
+		SELECT `+eventColumns+`
+		FROM cart_events
+		WHERE ($1::timestamptz IS NULL OR (created_at, id) > ($1, $2::uuid))
+		AND ($4::text IS NULL OR session_id = $4)
+		AND ($5::text = '' OR tenant_id = $5)
+		ORDER BY created_at, id
+		LIMIT $3`, afterTime, afterID, limit, sessionID, tenantID(r.Context()))
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		shardEvents, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PGCartEvent, error) {
+			return scanEvent(row)
+		})
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		events = append(events, shardEvents...)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+			return events[i].CreatedAt.Before(events[j].CreatedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+
+	page := eventPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+	}
+	if len(page.Events) == limit {
+		last := page.Events[limit-1]
+		page.Next = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func encodeCursor(createdAt time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || !uuidPattern.MatchString(id) {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return t, id, nil
+}
+
+// Get returns one event by ID, looking through every read shard since the
+// ID doesn't say where the event lives.
+func (h *Handler) Get(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !uuidPattern.MatchString(id) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "invalid event id",
+		})
+		return
+	}
+
+	for _, db := range h.read.All() {
+		event, err := scanEvent(db.QueryRow(r.Context(), `
+		SELECT `+eventColumns+`
+		FROM cart_events
+		WHERE id = $1 AND ($2::text = '' OR tenant_id = $2)`, id, tenantID(r.Context())))
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			continue
+		case err != nil:
+			internalError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, event)
+		return
+	}
+
+	writeJSON(w, http.StatusNotFound, map[string]string{
+		"error": "event not found",
+	})
+}
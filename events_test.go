@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadsUseReadPool(t *testing.T) {
+	primary := newFakePG(t, func(sql string) fakeResult {
+		return fakeResult{err: pgError("XX000", "read sent to the primary")}
+	})
+	replica := newFakePG(t, func(sql string) fakeResult { return fakeEvents() })
+	h := &Handler{db: NewHashRouter(primary.pool(t)), read: NewHashRouter(replica.pool(t)), deadLetters: true}
+	routes := h.routes()
+
+	for _, path := range []string{
+		"/events",
+		"/events?sessionId=session-1",
+		"/events/export?from=2024-01-01&to=2024-01-02",
+		"/events/" + fakeID(1),
+		"/events/" + fakeID(1) + "/attempts",
+		"/dead-letters",
+	} {
+		before := len(replica.Queries())
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK && rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d %s", path, rec.Code, rec.Body)
+		}
+		if len(replica.Queries()) == before {
+			t.Errorf("GET %s didn't query the read pool", path)
+		}
+	}
+	if q := primary.Queries(); len(q) > 0 {
+		t.Errorf("reads reached the primary: %q", q)
+	}
+}
+
+func TestEventTimesReadInUTC(t *testing.T) {
+	// Scanning must not depend on the zone the service runs in.
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	row := fakeEventRow(fakeID(1))
+	row[4] = "2024-01-01 10:00:00+02"
+	f := newFakePG(t, func(string) fakeResult { return fakeEvents(row) })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+fakeID(1), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get: %d %s", rec.Code, rec.Body)
+	}
+	if !containsAll(rec.Body.String(), `"eventDate":"2024-01-01T08:00:00Z"`, `"createdAt":"2024-01-01T00:00:00Z"`) {
+		t.Errorf("times not in UTC: %s", rec.Body)
+	}
+}
+
+func TestEventTimesUTCInNonUTCSession(t *testing.T) {
+	pool := testDB(t)
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+	id := seedEvent(t, pool, "session-1")
+
+	ctx := context.Background()
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SET TIME ZONE 'Asia/Tokyo'"); err != nil {
+		t.Fatal(err)
+	}
+	var event PGCartEvent
+	err = conn.QueryRow(ctx, "SELECT created_at, event_date FROM cart_events WHERE id = $1", id).
+		Scan(&event.CreatedAt, &event.EventDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{`"createdAt":"`, `"eventDate":"`} {
+		_, rest, _ := strings.Cut(string(body), key)
+		value, _, _ := strings.Cut(rest, `"`)
+		if !strings.HasSuffix(value, "Z") {
+			t.Errorf("%s%s\" has no trailing Z", key, value)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 10, 0, 0, 123456000, time.FixedZone("UTC+2", 2*60*60))
+	gotTime, gotID, err := decodeCursor(encodeCursor(createdAt, fakeID(7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(createdAt) || gotID != fakeID(7) {
+		t.Errorf("decoded %s %s, want %s %s", gotTime, gotID, createdAt, fakeID(7))
+	}
+	for _, bad := range []string{"not base64!", "bm8gc2VwYXJhdG9y", encodeCursor(createdAt, "not-a-uuid")} {
+		if _, _, err := decodeCursor(bad); err == nil {
+			t.Errorf("decodeCursor(%q) accepted a bad cursor", bad)
+		}
+	}
+}
+
+func TestListPagesAcrossInserts(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db}
+	routes := h.routes()
+
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		want[seedEvent(t, pool, "session-1")] = true
+	}
+	seen := map[string]bool{}
+	after := ""
+	for page := 0; ; page++ {
+		if page > 20 {
+			t.Fatal("paging never ended")
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest("GET", "/events?limit=2&after="+after, nil))
+		var got eventPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", page, rec.Code, rec.Body)
+		}
+		for _, event := range got.Events {
+			if seen[event.ID] {
+				t.Errorf("event %s listed twice", event.ID)
+			}
+			seen[event.ID] = true
+		}
+		// New events keep arriving while the client pages.
+		if page < 2 {
+			want[seedEvent(t, pool, "session-2")] = true
+		}
+		if got.Next == "" {
+			break
+		}
+		after = got.Next
+	}
+	for id := range want {
+		if !seen[id] {
+			t.Errorf("event %s skipped", id)
+		}
+	}
+}
+
+func TestCardLastFourStoredAndExposed(t *testing.T) {
+	row := fakeEventRow(fakeID(1))
+	row[12] = "1234"
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") {
+			return fakeResult{tag: "INSERT 0 1"}
+		}
+		return fakeEvents(row)
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	body := validEvent("")
+	body = strings.Replace(body, `"4433**1409"`, `"4111 1111 1111 1234"`, 1)
+	req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.Event(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("event: %d %s", rec.Code, rec.Body)
+	}
+	var insert string
+	for _, q := range f.Queries() {
+		if strings.Contains(q, "INSERT INTO cart_events") {
+			insert = q
+		}
+	}
+	if !containsAll(insert, "'4111**1234'", "'1234'") || strings.Contains(insert, "4111111111111234") {
+		t.Errorf("insert %q, want the masked card and its last four", insert)
+	}
+
+	defer func(expose bool) { exposeCardLastFour = expose }(exposeCardLastFour)
+	for _, expose := range []bool{false, true} {
+		exposeCardLastFour = expose
+		rec := httptest.NewRecorder()
+		h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+fakeID(1), nil))
+		if got := strings.Contains(rec.Body.String(), `"cardLastFour":"1234"`); got != expose {
+			t.Errorf("CARD_LAST_FOUR=%v: get returned %s", expose, rec.Body)
+		}
+	}
+}
+
+func TestCardLastFourRoundTrip(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db}
+	defer func(expose bool) { exposeCardLastFour = expose }(exposeCardLastFour)
+	exposeCardLastFour = true
+
+	event := CartEvent{OrderType: "Purchase", SessionID: "session-1", Card: "4111-1111-1111-9876", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, nil); err != nil {
+		t.Fatal(err)
+	}
+	var id, card, lastFour string
+	err := pool.QueryRow(context.Background(), "SELECT id, card, card_last_four FROM cart_events").Scan(&id, &card, &lastFour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card != "4111**9876" || lastFour != "9876" {
+		t.Errorf("stored card %q, last four %q", card, lastFour)
+	}
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+id, nil))
+	if !strings.Contains(rec.Body.String(), `"cardLastFour":"9876"`) {
+		t.Errorf("get: %s", rec.Body)
+	}
+}
+
+func TestGetNotFoundAndInternalError(t *testing.T) {
+	captureLog(t)
+	tests := []struct {
+		name   string
+		result fakeResult
+		code   int
+		body   string
+	}{
+		{"not found", fakeEvents(), http.StatusNotFound, `{"error":"event not found"}`},
+		{"database error", fakeResult{err: pgError("XX000", `could not read block 7 in file "base/16384/16385"`)}, http.StatusInternalServerError, `"error":"internal error"`},
+	}
+	for _, tt := range tests {
+		f := newFakePG(t, func(string) fakeResult { return tt.result })
+		db := NewHashRouter(f.pool(t))
+		h := &Handler{db: db, read: db}
+
+		rec := httptest.NewRecorder()
+		withRequestID(h.routes()).ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+fakeID(1), nil))
+		if rec.Code != tt.code || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("%s: %d %s, want %d %s", tt.name, rec.Code, rec.Body, tt.code, tt.body)
+		}
+		if strings.Contains(rec.Body.String(), "no rows") || strings.Contains(rec.Body.String(), "base/16384") {
+			t.Errorf("%s: response leaks the error: %s", tt.name, rec.Body)
+		}
+	}
+}
+
+func TestListBySessionQueriesItsShard(t *testing.T) {
+	fakes := []*fakePG{
+		newFakePG(t, func(string) fakeResult { return fakeEvents() }),
+		newFakePG(t, func(string) fakeResult { return fakeEvents() }),
+	}
+	router := NewHashRouter(fakes[0].pool(t), fakes[1].pool(t))
+	h := &Handler{db: router, read: router}
+
+	const session = "session-7"
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events?sessionId="+session, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", rec.Code, rec.Body)
+	}
+	for i, f := range fakes {
+		q := f.Queries()
+		if i != shardIndex(session, 2) {
+			if len(q) != 0 {
+				t.Errorf("shard %d queried for another shard's session: %q", i, q)
+			}
+			continue
+		}
+		if len(q) != 1 || !strings.Contains(q[0], "'"+session+"'") {
+			t.Errorf("shard %d queries = %q, want the session filter", i, q)
+		}
+	}
+
+	for _, v := range []string{"", strings.Repeat("s", MaxSessionIDLen+1)} {
+		rec := httptest.NewRecorder()
+		h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events?sessionId="+v, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("sessionId of %d characters: %d, want 400", len(v), rec.Code)
+		}
+	}
+}
+
+func TestListBySessionAcrossSessions(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db}
+	var want []string
+	for i := 0; i < 3; i++ {
+		seedEvent(t, pool, "session-1")
+		want = append(want, seedEvent(t, pool, "session-2"))
+		seedEvent(t, pool, "session-3")
+	}
+
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events?sessionId=session-2", nil))
+	var got eventPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("list: %d %s", rec.Code, rec.Body)
+	}
+	var ids []string
+	for _, event := range got.Events {
+		ids = append(ids, event.ID)
+		if event.SessionID != "session-2" || event.Card != "4433**1409" {
+			t.Errorf("listed %+v", event)
+		}
+	}
+	if !slices.Equal(ids, want) {
+		t.Errorf("listed %v, want %v in creation order", ids, want)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var expiredEvents = newCounter("events_expired_total",
+	"Events failed because they stayed pending longer than MAX_PENDING_AGE after becoming due.")
+
+// StartPendingExpiry periodically fails events that have been due for
+// longer than maxAge, e.g. because no worker was running, so they don't
+// linger unnoticed. Age counts from process_after, so delayed events and
+// retries waiting out their backoff are not failed for waiting as told.
+// Ages are compared against the database clock.
+func (p *Pool) StartPendingExpiry(ctx context.Context, maxAge, every time.Duration) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.expirePending(ctx, maxAge)
+			}
+		}
+	}()
+}
+
+func (p *Pool) expirePending(ctx context.Context, maxAge time.Duration) {
+	now := time.Now()
+	if !p.window.Contains(now) {
+		// Due events are held until the window opens; that is not them
+		// being stuck.
+		return
+	}
+	// Nor is the time before the window opened. GREATEST skips a NULL.
+	var opened *time.Time
+	if p.window != nil {
+		t := p.window.Opened(now)
+		opened = &t
+	}
+	for _, db := range p.db.All() {
+		rows, err := db.Query(ctx, `
+		UPDATE cart_events
+		SET status = 'failed', failure_reason = 'pending for too long'
+		WHERE status = 'pending'
+		AND GREATEST(process_after, $2::timestamptz) < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		RETURNING id::text`,
+			maxAge.Seconds(), opened)
+		var ids []string
+		if err == nil {
+			ids, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+		if err != nil {
+			if !isShutdown(ctx, err) {
+				log.Println("Error expiring pending events:", err)
+			}
+			continue
+		}
+
+		for _, id := range ids {
+			p.hook.Fire(id, "pending", "failed")
+		}
+		if len(ids) > 0 {
+			log.Printf("Failed %d events pending longer than %s", len(ids), maxAge)
+			expiredEvents.Add(uint64(len(ids)))
+		}
+	}
+}
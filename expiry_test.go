@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestExpirePendingCountsFromDueTime(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	// Created long ago but only due a minute ago, like an event that
+	// spent the last hours waiting out its retry backoff.
+	retrying := seedEvent(t, db, "session-1")
+	// Due for two hours.
+	overdue := seedEvent(t, db, "session-2")
+	_, err := db.Exec(ctx, `
+	UPDATE cart_events SET created_at = CURRENT_TIMESTAMP - interval '3 hours',
+		process_after = CASE WHEN id = $1 THEN CURRENT_TIMESTAMP - interval '1 minute'
+			ELSE CURRENT_TIMESTAMP - interval '2 hours' END`, retrying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Due later.
+	delayed := seedEvent(t, db, "session-3")
+	if _, err := db.Exec(ctx, "UPDATE cart_events SET process_after = CURRENT_TIMESTAMP + interval '1 day' WHERE id = $1", delayed); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pool{db: NewHashRouter(db)}
+	p.expirePending(ctx, time.Hour)
+	for id, want := range map[string]string{retrying: "pending", overdue: "failed", delayed: "pending"} {
+		if got := eventStatus(t, db, id); got != want {
+			t.Errorf("event %s: status %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestExpirePendingWaitsForWindow(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult {
+		return fakeResult{columns: []fakeColumn{{"id", pgtype.TextOID}}}
+	})
+	now := time.Now().UTC()
+	// A one-minute window that closed a while ago.
+	start := now.Add(-2 * time.Hour)
+	closed, err := parseTimeWindow(start.Format("15:04")+"-"+start.Add(time.Minute).Format("15:04"), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Pool{db: NewHashRouter(f.pool(t)), window: closed}
+	p.expirePending(context.Background(), time.Minute)
+	for _, q := range f.Queries() {
+		if strings.Contains(q, "pending for too long") {
+			t.Fatalf("expired events outside the window: %s", q)
+		}
+	}
+
+	p.window = nil
+	p.expirePending(context.Background(), time.Minute)
+	expired := false
+	for _, q := range f.Queries() {
+		expired = expired || strings.Contains(q, "pending for too long")
+	}
+	if !expired {
+		t.Error("didn't expire events without a window")
+	}
+}
+
+func TestExpirePendingFailsEvents(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult {
+		return fakeResult{columns: []fakeColumn{{"id", pgtype.TextOID}}, rows: [][]any{{fakeID(1)}, {fakeID(2)}}}
+	})
+	captureLog(t)
+	hook := &StatusHook{queue: make(chan statusChange, 10)}
+	p := &Pool{db: NewHashRouter(f.pool(t)), hook: hook}
+	before := expiredEvents.Value()
+	p.expirePending(context.Background(), time.Hour)
+
+	queries := f.Queries()
+	if len(queries) != 1 || !containsAll(queries[0], "SET status = 'failed', failure_reason = 'pending for too long'", "WHERE status = 'pending'") {
+		t.Errorf("queries = %q, want one pending to failed update", queries)
+	}
+	if n := expiredEvents.Value() - before; n != 2 {
+		t.Errorf("%d events counted expired, want 2", n)
+	}
+	close(hook.queue)
+	var got []string
+	for change := range hook.queue {
+		got = append(got, change.EventID+":"+change.OldStatus+"->"+change.NewStatus)
+	}
+	if want := fakeID(1) + ":pending->failed " + fakeID(2) + ":pending->failed"; strings.Join(got, " ") != want {
+		t.Errorf("transitions = %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// MaxExportRange caps how much created_at time one export may span.
+const MaxExportRange = 31 * 24 * time.Hour
+
+// ExportWriteTimeout is how long an export may go without the client
+// accepting more data. The deadline moves forward with every flush, so
+// the export as a whole can outlast the server's WriteTimeout.
+const ExportWriteTimeout = 30 * time.Second
+
+// Export streams every event created in [from, to) as newline-delimited
+// JSON. Rows come shard by shard, each shard ordered by (created_at, id).
+// Both bounds take RFC 3339 timestamps or plain dates (2024-01-31, UTC).
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	from, to, err := exportRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+	for _, db := range h.read.All() {
+		rows, err := db.Query(r.Context(), `
+		SELECT `+eventColumns+`
+		FROM cart_events
+		WHERE created_at >= $1 AND created_at < $2
+		AND ($3::text = '' OR tenant_id = $3)
+		ORDER BY created_at, id`, from, to, tenantID(r.Context()))
+		if err != nil {
+			if !started {
+				internalError(w, r, err)
+			} else {
+				logInternalError(r, err)
+			}
+			return
+		}
+		n := 0
+		for rows.Next() {
+			event, err := scanEvent(rows)
+			if err != nil {
+				rows.Close()
+				logInternalError(r, err)
+				return
+			}
+			event.Card = maskCard(event.Card)
+			if err := enc.Encode(event); err != nil {
+				// The client went away.
+				rows.Close()
+				return
+			}
+			started = true
+			if n++; n%500 == 0 && flusher != nil {
+				flusher.Flush()
+				rc.SetWriteDeadline(time.Now().Add(ExportWriteTimeout))
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			// Headers are already out, so all that's left is to cut the
+			// stream short.
+			logInternalError(r, err)
+			return
+		}
+	}
+}
+
+func exportRange(fromParam, toParam string) (time.Time, time.Time, error) {
+	if fromParam == "" || toParam == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("from and to are required")
+	}
+	from, err := parseExportTime(fromParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %q", fromParam)
+	}
+	to, err := parseExportTime(toParam)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %q", toParam)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > MaxExportRange {
+		return time.Time{}, time.Time{}, fmt.Errorf("range must not exceed %s", MaxExportRange)
+	}
+	return from, to, nil
+}
+
+func parseExportTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// export runs GET /events/export?query against h and returns the
+// response and its NDJSON lines decoded.
+func export(t *testing.T, h *Handler, query string) (*httptest.ResponseRecorder, []PGCartEvent) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events/export?"+query, nil))
+	var events []PGCartEvent
+	scanner := bufio.NewScanner(strings.NewReader(rec.Body.String()))
+	for rec.Code == http.StatusOK && scanner.Scan() {
+		var event PGCartEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return rec, events
+}
+
+func TestExportNDJSON(t *testing.T) {
+	rows := [][]any{fakeEventRow(fakeID(1)), fakeEventRow(fakeID(2)), fakeEventRow(fakeID(3))}
+	f := newFakePG(t, func(string) fakeResult { return fakeEvents(rows...) })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	rec, events := export(t, h, "from=2024-01-01&to=2024-01-02")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if got := strings.Count(rec.Body.String(), "\n"); got != 3 {
+		t.Errorf("%d lines, want one per event", got)
+	}
+	for i, event := range events {
+		if event.ID != fakeID(i+1) || event.Card != "4111**1111" {
+			t.Errorf("line %d: id %s card %q, want %s masked", i+1, event.ID, event.Card, fakeID(i+1))
+		}
+	}
+	if q := f.Queries(); len(q) != 1 || !containsAll(q[0], "'2024-01-01 00:00:00Z'", "'2024-01-02 00:00:00Z'") {
+		t.Errorf("queries = %q, want the range bounds", q)
+	}
+}
+
+func TestExportRangeValidation(t *testing.T) {
+	h := &Handler{}
+	for _, query := range []string{
+		"",
+		"from=2024-01-01",
+		"from=yesterday&to=2024-01-02",
+		"from=2024-01-02&to=2024-01-01",
+		"from=2024-01-01&to=2024-01-01",
+		"from=2024-01-01&to=2024-03-01",
+	} {
+		if rec, _ := export(t, h, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("export?%s: %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestExportSeededRange(t *testing.T) {
+	pool := testDB(t)
+	ctx := context.Background()
+	inside := []string{seedEvent(t, pool, "session-1"), seedEvent(t, pool, "session-2")}
+	outside := seedEvent(t, pool, "session-3")
+	// The upper bound is exclusive, so outside lands just past the range.
+	for id, createdAt := range map[string]string{
+		inside[0]: "2024-01-01 12:00:00Z",
+		inside[1]: "2024-01-01 12:00:01Z",
+		outside:   "2024-01-02 00:00:00Z",
+	} {
+		if _, err := pool.Exec(ctx, "UPDATE cart_events SET created_at = $2 WHERE id = $1", id, createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := NewHashRouter(pool)
+
+	rec, events := export(t, &Handler{db: db, read: db}, "from=2024-01-01&to=2024-01-02")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", rec.Code, rec.Body)
+	}
+	if len(events) != 2 || events[0].ID != inside[0] || events[1].ID != inside[1] {
+		t.Errorf("exported %+v, want %v in order", events, inside)
+	}
+	for _, event := range events {
+		if event.Card != "4433**1409" {
+			t.Errorf("card %q, want it masked", event.Card)
+		}
+	}
+}
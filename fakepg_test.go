@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// fakePG is just enough of a Postgres server for pgx in simple protocol
+// mode: it accepts any login and answers each query with what the
+// handler returns. It covers what the service does with results and
+// errors; tests that depend on SQL semantics run against a real database,
+// see testDB.
+type fakePG struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	handler func(sql string) fakeResult
+	queries []string
+	conns   []net.Conn
+}
+
+// fakeResult is the reply to one query. Values are in text format, nil
+// for NULL. A non-nil err is sent as an ErrorResponse instead; drop
+// hangs up after the rows, before the command completes.
+type fakeResult struct {
+	columns []fakeColumn
+	rows    [][]any
+	tag     string
+	err     *pgconn.PgError
+	drop    bool
+}
+
+type fakeColumn struct {
+	name string
+	oid  uint32
+}
+
+func newFakePG(t testing.TB, handler func(sql string) fakeResult) *fakePG {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakePG{ln: ln, handler: handler}
+	go f.serve()
+	t.Cleanup(f.close)
+	return f
+}
+
+// URL is a DATABASE_URL for the server. Simple protocol keeps the fake
+// small: every query is one round trip with its arguments inlined.
+func (f *fakePG) URL() string {
+	return fmt.Sprintf("postgres://test@%s/test?sslmode=disable&default_query_exec_mode=simple_protocol", f.ln.Addr())
+}
+
+// pool connects to the server the way connectDB does.
+func (f *fakePG) pool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	db, err := connectDB(f.URL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func (f *fakePG) setHandler(handler func(sql string) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handler = handler
+}
+
+// Queries returns every query received so far, in order.
+func (f *fakePG) Queries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries...)
+}
+
+// Conns returns how many connections the server has accepted.
+func (f *fakePG) Conns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.conns)
+}
+
+// dropConns hangs up every open connection, as a server restart or
+// network failure would, and keeps accepting new ones.
+func (f *fakePG) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakePG) close() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakePG) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.serveConn(conn)
+	}
+}
+
+func (f *fakePG) serveConn(conn net.Conn) {
+	defer conn.Close()
+	backend := pgproto3.NewBackend(conn, conn)
+	startup, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := startup.(*pgproto3.StartupMessage); !ok {
+		// A cancel request or TLS probe; the fake supports neither.
+		return
+	}
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.mu.Unlock()
+
+	backend.Send(&pgproto3.AuthenticationOk{})
+	backend.Send(&pgproto3.ParameterStatus{Name: "server_version", Value: "16.0"})
+	backend.Send(&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"})
+	backend.Send(&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"})
+	backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if backend.Flush() != nil {
+		return
+	}
+
+	txStatus := byte('I')
+	for {
+		msg, err := backend.Receive()
+		if err != nil {
+			return
+		}
+		query, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+		f.mu.Lock()
+		f.queries = append(f.queries, query.String)
+		handler := f.handler
+		f.mu.Unlock()
+
+		var res fakeResult
+		if handler != nil {
+			res = handler(query.String)
+		}
+		switch strings.ToLower(strings.TrimSpace(query.String)) {
+		case "begin", "begin isolation level serializable":
+			txStatus = 'T'
+		case "commit", "rollback":
+			txStatus = 'I'
+		}
+		if res.err != nil {
+			if txStatus == 'T' {
+				txStatus = 'E'
+			}
+			backend.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: res.err.Code, Message: res.err.Message, ConstraintName: res.err.ConstraintName})
+		} else {
+			if res.columns != nil {
+				fields := make([]pgproto3.FieldDescription, len(res.columns))
+				for i, col := range res.columns {
+					fields[i] = pgproto3.FieldDescription{Name: []byte(col.name), DataTypeOID: col.oid, DataTypeSize: -1, TypeModifier: -1}
+				}
+				backend.Send(&pgproto3.RowDescription{Fields: fields})
+				for _, row := range res.rows {
+					values := make([][]byte, len(row))
+					for i, v := range row {
+						if v != nil {
+							values[i] = []byte(fmt.Sprint(v))
+						}
+					}
+					backend.Send(&pgproto3.DataRow{Values: values})
+				}
+			}
+			if res.drop {
+				backend.Flush()
+				return
+			}
+			tag := res.tag
+			if tag == "" {
+				tag = fmt.Sprintf("SELECT %d", len(res.rows))
+			}
+			backend.Send(&pgproto3.CommandComplete{CommandTag: []byte(tag)})
+		}
+		backend.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		if backend.Flush() != nil {
+			return
+		}
+	}
+}
+
+// fakeEventColumns matches eventColumns.
+var fakeEventColumns = []fakeColumn{
+	{"id", pgtype.UUIDOID},
+	{"order_type", pgtype.TextOID},
+	{"session_id", pgtype.TextOID},
+	{"card", pgtype.TextOID},
+	{"event_date", pgtype.TimestamptzOID},
+	{"website_url", pgtype.TextOID},
+	{"status", pgtype.TextOID},
+	{"created_at", pgtype.TimestamptzOID},
+	{"notified_at", pgtype.TimestamptzOID},
+	{"process_after", pgtype.TimestamptzOID},
+	{"retry_count", pgtype.Int4OID},
+	{"region", pgtype.TextOID},
+	{"card_last_four", pgtype.TextOID},
+	{"instance_id", pgtype.TextOID},
+	{"tenant_id", pgtype.TextOID},
+	{"priority", pgtype.Int2OID},
+}
+
+// Indexes into a fakeEventRow, for tests that change one column.
+const (
+	fakeColSession    = 2
+	fakeColStatus     = 6
+	fakeColCreatedAt  = 7
+	fakeColNotifiedAt = 8
+	fakeColRetryCount = 10
+	fakeColTenant     = 14
+)
+
+// fakeEventRow is a processing event row in eventColumns order.
+func fakeEventRow(id string) []any {
+	return []any{
+		id, "Purchase", "session-1", "4111111111111111", "2024-01-01 00:00:00+00",
+		"https://example.com/cart", "processing", "2024-01-01 00:00:00+00", nil,
+		"2024-01-01 00:00:00+00", "0", "", "", "", "", "0",
+	}
+}
+
+// fakeEvents returns rows of event columns.
+func fakeEvents(rows ...[]any) fakeResult {
+	return fakeResult{columns: fakeEventColumns, rows: rows}
+}
+
+// fakeID returns the nth of a run of distinct event ids.
+func fakeID(n int) string {
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", n)
+}
+
+// pgError is what the server would send for a failed statement.
+func pgError(code, message string) *pgconn.PgError {
+	return &pgconn.PgError{Code: code, Message: message}
+}
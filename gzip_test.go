@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLargeResponseGzipped(t *testing.T) {
+	var rows [][]any
+	for i := 1; i <= 100; i++ {
+		rows = append(rows, fakeEventRow(fakeID(i)))
+	}
+	f := newFakePG(t, func(string) fakeResult { return fakeEvents(rows...) })
+	db := NewHashRouter(f.pool(t))
+	handler := gzipResponses((&Handler{db: db, read: db}).routes(), 1024)
+	get := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/events?limit=100", "gzip, deflate")
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("large response not gzipped, headers %v", rec.Header())
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type %q lost to compression", rec.Header().Get("Content-Type"))
+	}
+	compressed := rec.Body.Len()
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page eventPage
+	if err := json.Unmarshal(body, &page); err != nil || len(page.Events) != 100 {
+		t.Fatalf("decompressed body has %d events (%v)", len(page.Events), err)
+	}
+	if compressed >= len(body) {
+		t.Errorf("compressed %d bytes to %d", len(body), compressed)
+	}
+
+	for _, tt := range []struct{ path, accept string }{
+		{"/events?limit=100", ""},
+		{"/events?limit=100", "gzip;q=0"},
+		{"/healthz", "gzip"},
+	} {
+		rec := get(tt.path, tt.accept)
+		if enc := rec.Header().Get("Content-Encoding"); enc != "" || rec.Code != http.StatusOK {
+			t.Errorf("%s with Accept-Encoding %q: %d, Content-Encoding %q, want plain", tt.path, tt.accept, rec.Code, enc)
+		}
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("%s with Accept-Encoding %q: body is not plain JSON", tt.path, tt.accept)
+		}
+	}
+}
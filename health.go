@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type workerStatus struct {
+	Worker           int     `json:"worker"`
+	SecondsSincePoll float64 `json:"secondsSincePoll"`
+	Stale            bool    `json:"stale"`
+}
+
+// beat records that worker id just finished a poll.
+func (p *Pool) beat(id int) {
+	p.heartbeats[id].Store(time.Now().UnixNano())
+}
+
+func (p *Pool) workerStatuses() []workerStatus {
+	now := time.Now()
+	statuses := make([]workerStatus, len(p.heartbeats))
+	for i := range p.heartbeats {
+		since := now.Sub(time.Unix(0, p.heartbeats[i].Load()))
+		statuses[i] = workerStatus{
+			Worker:           i,
+			SecondsSincePoll: since.Seconds(),
+			Stale:            since > p.staleAfter,
+		}
+	}
+	return statuses
+}
+
+// oldestHeartbeat returns how long ago the least recently active worker
+// finished a poll.
+func (p *Pool) oldestHeartbeat() time.Duration {
+	var oldest time.Duration
+	for _, s := range p.workerStatuses() {
+		if d := time.Duration(s.SecondsSincePoll * float64(time.Second)); d > oldest {
+			oldest = d
+		}
+	}
+	return oldest
+}
+
+func (p *Pool) allStale() bool {
+	for _, s := range p.workerStatuses() {
+		if !s.Stale {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) Workers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]workerStatus{
+		"workers": h.pool.workerStatuses(),
+	})
+}
+
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, "ok")
+}
+
+// becomeReady marks the service ready once every shard answers a ping.
+// It is called after the worker pool has started and retries until the
+// databases are reachable or ctx is done.
+func (h *Handler) becomeReady(ctx context.Context) {
+	for {
+		if h.pingAll(ctx) == nil {
+			h.ready.Store(true)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (h *Handler) pingAll(ctx context.Context) error {
+	for _, db := range h.db.All() {
+		if err := db.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Readyz fails until startup has finished, when a shard can't be reached
+// or when every worker has stopped polling, since events would then pile
+// up unprocessed.
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "starting",
+		})
+		return
+	}
+	if err := h.pings.check(r.Context(), h.pingAll); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "database unreachable",
+		})
+		return
+	}
+	if h.pool.allStale() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"error": "all workers are stale",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, "ready")
+}
+
+// pingCache remembers the last ping result for ttl so frequent probes
+// don't each hit every shard. Failures are cached too, so an outage shows
+// up at most ttl late and recovery likewise. A zero ttl pings every time.
+type pingCache struct {
+	ttl time.Duration
+
+	mu  sync.Mutex
+	at  time.Time
+	err error
+}
+
+// check returns the cached result if it is younger than ttl and runs ping
+// otherwise. Concurrent callers wait for a single ping.
+func (c *pingCache) check(ctx context.Context, ping func(context.Context) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl > 0 && !c.at.IsZero() && time.Since(c.at) < c.ttl {
+		return c.err
+	}
+	err := ping(ctx)
+	if ctx.Err() != nil {
+		// The probe gave up; that says nothing about the database.
+		return err
+	}
+	c.at, c.err = time.Now(), err
+	return err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatAdvancesOnPoll(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeEvents() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewPool(ctx, 1, NewHashRouter(f.pool(t)), PoolOptions{BatchSize: 10, Interval: time.Hour, StaleAfter: time.Minute})
+
+	last := p.heartbeats[0].Load()
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond)
+		if _, err := p.PollNow(ctx); err != nil {
+			t.Fatal(err)
+		}
+		beat := p.heartbeats[0].Load()
+		if beat <= last {
+			t.Fatalf("poll %d: heartbeat %d didn't advance past %d", i+1, beat, last)
+		}
+		last = beat
+	}
+	if p.allStale() {
+		t.Error("a worker that just polled counts as stale")
+	}
+
+	// A worker that hasn't polled for longer than StaleAfter is hung.
+	p.heartbeats[0].Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	statuses := p.workerStatuses()
+	if !statuses[0].Stale || statuses[0].SecondsSincePoll < 120 {
+		t.Errorf("status = %+v, want stale for 2 minutes", statuses[0])
+	}
+	if !p.allStale() {
+		t.Error("allStale = false with the only worker stale")
+	}
+}
+
+func TestReadinessFlipsOnceDatabaseAnswers(t *testing.T) {
+	var up atomic.Bool
+	f := newFakePG(t, func(sql string) fakeResult {
+		if !up.Load() {
+			return fakeResult{err: pgError("57P03", "the database system is starting up")}
+		}
+		return fakeEvents()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	router := NewHashRouter(f.pool(t))
+	pool := NewPool(ctx, 1, router, PoolOptions{BatchSize: 10, Interval: time.Hour, StaleAfter: time.Minute})
+	h := &Handler{db: router, read: router, pool: pool}
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		h.Readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before startup finished: %d, want 503", code)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.becomeReady(ctx)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if code := readyz(); code != http.StatusServiceUnavailable || h.ready.Load() {
+		t.Fatalf("readyz while the database is down: %d, want 503", code)
+	}
+
+	up.Store(true)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never became ready")
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("readyz once ready: %d, want 200", code)
+	}
+}
+
+func TestPingCacheWithinTTL(t *testing.T) {
+	var pings atomic.Int32
+	errDown := errors.New("down")
+	result := errDown
+	ping := func(context.Context) error { pings.Add(1); return result }
+	c := &pingCache{ttl: 50 * time.Millisecond}
+
+	if err := c.check(context.Background(), ping); err != errDown {
+		t.Fatalf("first check = %v", err)
+	}
+	// The outage stays cached until the ttl is up.
+	result = nil
+	if err := c.check(context.Background(), ping); err != errDown || pings.Load() != 1 {
+		t.Errorf("second check within ttl = %v after %d pings, want the cached failure, 1 ping", err, pings.Load())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := c.check(context.Background(), ping); err != nil || pings.Load() != 2 {
+		t.Errorf("check after ttl = %v after %d pings, want a fresh ping", err, pings.Load())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	uncached := &pingCache{ttl: time.Minute}
+	uncached.check(ctx, func(ctx context.Context) error { return ctx.Err() })
+	if err := uncached.check(context.Background(), ping); err != nil || pings.Load() != 3 {
+		t.Errorf("a cancelled probe was cached: %v after %d pings", err, pings.Load())
+	}
+}
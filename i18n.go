@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is used when the client asks for nothing we have.
+const DefaultLanguage = "en"
+
+// messages translates client-facing error messages, keyed by language and
+// then by the English format string the code uses. English needs no
+// entries; a missing translation falls back to English.
+var messages = map[string]map[string]string{
+	"de": {
+		"invalid body":                                           "ungültiger Body",
+		"unsupported schema version":                             "nicht unterstützte Schemaversion",
+		"must be an RFC 3339 timestamp":                          "muss ein RFC-3339-Zeitstempel sein",
+		"Content-Type must be application/json":                  "Content-Type muss application/json sein",
+		"websiteUrl host is not allowed":                         "Host der websiteUrl ist nicht erlaubt",
+		"websiteUrl region is not allowed":                       "Region der websiteUrl ist nicht erlaubt",
+		"is required":                                            "ist erforderlich",
+		"must not be null":                                       "darf nicht null sein",
+		"must not be empty":                                      "darf nicht leer sein",
+		"must be at most %d characters":                          "darf höchstens %d Zeichen lang sein",
+		"must be a card number or a masked card like 4433**1409": "muss eine Kartennummer oder eine maskierte Karte wie 4433**1409 sein",
+		"must end in four digits":                                "muss auf vier Ziffern enden",
+		"must be between 0 and %d":                               "muss zwischen 0 und %d liegen",
+		"must be an RFC 3339 or Postgres timestamp":              "muss ein RFC-3339- oder Postgres-Zeitstempel sein",
+		"must be an absolute http(s) URL":                        "muss eine absolute http(s)-URL sein",
+		"must be a full card number when BINs are restricted":    "muss eine vollständige Kartennummer sein, wenn BINs eingeschränkt sind",
+		"has a BIN that is not allowed":                          "hat eine nicht erlaubte BIN",
+		"is not an accepted order type":                          "ist keine zulässige Bestellart",
+		"is not an accepted session ID":                          "ist keine zulässige Session-ID",
+		"is not an accepted card":                                "ist keine zulässige Karte",
+		"is outside the accepted range":                          "liegt außerhalb des zulässigen Bereichs",
+		"is not an accepted URL":                                 "ist keine zulässige URL",
+		"is in a region that is not accepted":                    "liegt in einer nicht zulässigen Region",
+	},
+}
+
+// translate formats msg in lang, falling back to English.
+func translate(lang, format string, args ...any) string {
+	if t, ok := messages[lang][format]; ok {
+		format = t
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// requestLanguage picks the supported language the client prefers most
+// according to Accept-Language, or DefaultLanguage.
+func requestLanguage(r *http.Request) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		// Only the primary subtag matters: de-CH is served German.
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q > 0 && (lang == DefaultLanguage || messages[lang] != nil) {
+			choices = append(choices, choice{lang, q})
+		}
+	}
+	if len(choices) == 0 {
+		return DefaultLanguage
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].lang
+}
+
+// localizeError writes a {"error": msg} response with msg translated for
+// the request.
+func localizeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Language", lang)
+	writeJSON(w, status, map[string]string{
+		"error": translate(lang, msg),
+	})
+}
+
+// localizeValidation translates the field errors in err for lang and
+// returns them along with the joined message.
+func localizeValidation(lang string, err error) ([]*ValidationError, string) {
+	failures := validationFailures(err)
+	localized := make(ValidationErrors, len(failures))
+	for i, f := range failures {
+		localized[i] = &ValidationError{Field: f.Field, Message: f.Message}
+		if f.format != "" {
+			localized[i].Message = translate(lang, f.format, f.args...)
+		}
+	}
+	return localized, localized.Error()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                       "en",
+		"de":                     "de",
+		"de-CH, en;q=0.5":        "de",
+		"fr, en;q=0.8, de;q=0.9": "de",
+		"en, de;q=0.9":           "en",
+		"fr-FR":                  "en",
+		"de;q=0, fr":             "en",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Language", header)
+		if got := requestLanguage(r); got != want {
+			t.Errorf("Accept-Language %q: %s, want %s", header, got, want)
+		}
+	}
+}
+
+func TestLocalizedValidationErrors(t *testing.T) {
+	tests := []struct {
+		acceptLanguage, lang, message string
+	}{
+		{"de-DE", "de", "sessionId ist erforderlich"},
+		{"fr", "en", "sessionId is required"},
+	}
+	for _, tt := range tests {
+		body := `{"orderType":"Purchase","card":"4433**1409","eventDate":"2024-01-01T00:00:00Z","websiteUrl":"https://example.com"}`
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+		rec := httptest.NewRecorder()
+		(&Handler{}).Event(rec, req)
+
+		var resp validationResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: %d %s", tt.acceptLanguage, rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Content-Language") != tt.lang || resp.Error != tt.message {
+			t.Errorf("%s: %s %q, want %s %q", tt.acceptLanguage, rec.Header().Get("Content-Language"), resp.Error, tt.lang, tt.message)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/event", strings.NewReader("{"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "de")
+	rec := httptest.NewRecorder()
+	(&Handler{}).Event(rec, req)
+	if !strings.Contains(rec.Body.String(), "ungültiger Body") {
+		t.Errorf("invalid body in German: %s", rec.Body)
+	}
+}
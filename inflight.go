@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// inflightLimiter caps how many events are claimed ('processing') across
+// all workers at once. A nil *inflightLimiter grants every request.
+type inflightLimiter struct {
+	mu   sync.Mutex
+	max  int
+	used int
+}
+
+var eventsInFlight = newGauge("events_in_flight", "Events claimed by workers and not yet finished.")
+
+func newInflightLimiter(max int) *inflightLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &inflightLimiter{max: max}
+}
+
+// acquire takes up to n slots without blocking and returns how many it
+// got, possibly zero.
+func (l *inflightLimiter) acquire(n int) int {
+	if l == nil {
+		return n
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n = min(n, l.max-l.used)
+	l.used += n
+	eventsInFlight.Set(float64(l.used))
+	return n
+}
+
+func (l *inflightLimiter) release(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	eventsInFlight.Set(float64(l.used))
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInflightCapAcrossWorkers(t *testing.T) {
+	const limit, events = 15, 100
+	var rows [][]any
+	for i := 1; i <= events; i++ {
+		rows = append(rows, fakeEventRow(fakeID(i)))
+	}
+	queue := &fakeQueue{rows: rows}
+	f := newFakePG(t, queue.handle)
+	captureLog(t)
+
+	var mu sync.Mutex
+	active, peak, done := 0, 0, 0
+	finished := make(chan struct{})
+	notifier := notifierFunc(func(context.Context, PGCartEvent) error {
+		mu.Lock()
+		active++
+		peak = max(peak, active)
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		active--
+		if done++; done == events {
+			close(finished)
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	// 4 workers of 10 could hold 40 events.
+	p := NewPool(ctx, 4, NewHashRouter(f.pool(t)), PoolOptions{BatchSize: 10, MaxInFlight: limit, Interval: time.Millisecond, Notifier: notifier})
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("only %d of %d events notified", done, events)
+	}
+	cancel()
+	p.wg.Wait()
+
+	if peak > limit {
+		t.Errorf("%d notifications in flight at once, cap is %d", peak, limit)
+	}
+	if p.inflight.used != 0 {
+		t.Errorf("%d slots still held after shutdown", p.inflight.used)
+	}
+}
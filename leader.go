@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// leaderLock elects one instance to run the workers by holding a session
+// level Postgres advisory lock on a dedicated connection. Followers retry
+// every interval, so a new leader takes over soon after the old one dies
+// and its session ends. A nil *leaderLock always leads.
+type leaderLock struct {
+	db       *pgxpool.Pool
+	key      int64
+	interval time.Duration
+	leading  atomic.Bool
+}
+
+var leaderGauge = newGauge("worker_leader", "1 while this instance holds the worker leader lock.")
+
+func newLeaderLock(db *pgxpool.Pool, key int64, interval time.Duration) *leaderLock {
+	return &leaderLock{db: db, key: key, interval: interval}
+}
+
+// Leading reports whether this instance currently holds the lock.
+func (l *leaderLock) Leading() bool {
+	return l == nil || l.leading.Load()
+}
+
+// run tries to take the lock until ctx is done, then keeps checking that
+// the connection holding it is still alive.
+func (l *leaderLock) run(ctx context.Context) {
+	for {
+		conn := l.acquire(ctx)
+		if conn != nil {
+			l.hold(ctx, conn)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.interval):
+		}
+	}
+}
+
+// acquire returns the connection holding the lock, or nil if another
+// instance has it.
+func (l *leaderLock) acquire(ctx context.Context) *pgxpool.Conn {
+	conn, err := l.db.Acquire(ctx)
+	if err != nil {
+		if !isShutdown(ctx, err) {
+			log.Println("Error acquiring leader lock connection:", err)
+		}
+		return nil
+	}
+	var got bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&got); err != nil || !got {
+		if err != nil && !isShutdown(ctx, err) {
+			log.Println("Error trying leader lock:", err)
+		}
+		conn.Release()
+		return nil
+	}
+	return conn
+}
+
+func (l *leaderLock) hold(ctx context.Context, conn *pgxpool.Conn) {
+	l.leading.Store(true)
+	leaderGauge.Set(1)
+	log.Println("Acquired worker leadership")
+	defer func() {
+		l.leading.Store(false)
+		leaderGauge.Set(0)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", l.key)
+			conn.Release()
+			return
+		case <-time.After(l.interval):
+		}
+		if err := conn.Ping(ctx); err != nil {
+			if isShutdown(ctx, err) {
+				continue
+			}
+			// Whether or not the server still sees our session, stop
+			// leading first and drop the connection so the lock is freed.
+			l.leading.Store(false)
+			log.Println("Lost worker leadership:", err)
+			conn.Conn().Close(context.Background())
+			conn.Release()
+			return
+		}
+	}
+}
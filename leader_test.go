@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// waitLeading waits until l.Leading() is want.
+func waitLeading(t *testing.T, l *leaderLock, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for l.Leading() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Leading() stayed %v", !want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	// Each instance talks to its own fake; the advisory lock they contend
+	// for lives here, and a session that ends takes the lock with it.
+	var mu sync.Mutex
+	holder := ""
+	database := func(instance string) func(string) fakeResult {
+		return func(sql string) fakeResult {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case strings.Contains(sql, "pg_try_advisory_lock"):
+				got := "f"
+				if holder == "" || holder == instance {
+					holder, got = instance, "t"
+				}
+				return fakeResult{columns: []fakeColumn{{"pg_try_advisory_lock", pgtype.BoolOID}}, rows: [][]any{{got}}}
+			case strings.Contains(sql, "pg_advisory_unlock") && holder == instance:
+				holder = ""
+			}
+			return fakeResult{}
+		}
+	}
+	fakeA, fakeB := newFakePG(t, database("a")), newFakePG(t, database("b"))
+	a := newLeaderLock(fakeA.pool(t), 1, 10*time.Millisecond)
+	b := newLeaderLock(fakeB.pool(t), 1, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+	waitLeading(t, a, true)
+	go b.run(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if b.Leading() {
+		t.Fatal("both instances lead")
+	}
+
+	// The leader's database connection dies: it must step down, and once
+	// its session is gone the follower takes over.
+	fakeA.close()
+	waitLeading(t, a, false)
+	mu.Lock()
+	holder = ""
+	mu.Unlock()
+	waitLeading(t, b, true)
+	if a.Leading() {
+		t.Error("the old leader still leads")
+	}
+}
+
+func TestLeaderFailoverOnShutdown(t *testing.T) {
+	db := testDB(t)
+	a := newLeaderLock(db, 42, 10*time.Millisecond)
+	b := newLeaderLock(db, 42, 10*time.Millisecond)
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	doneA := make(chan struct{})
+	go func() { a.run(ctxA); close(doneA) }()
+	waitLeading(t, a, true)
+	go b.run(ctxB)
+	time.Sleep(50 * time.Millisecond)
+	if b.Leading() {
+		t.Fatal("both instances lead")
+	}
+
+	stopA()
+	<-doneA
+	if a.Leading() {
+		t.Error("a stopped instance still leads")
+	}
+	waitLeading(t, b, true)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// notifyChannel is the channel the insert trigger notifies on. The
+// payload is only the event ID: NOTIFY payloads are capped at 8000 bytes,
+// and the row is fetched anyway when the event is claimed.
+const notifyChannel = "cart_events"
+
+var listenReconnects = newCounter("listen_reconnects_total",
+	"Times a LISTEN connection was lost and reopened.")
+
+// StartListener makes the pool react to new events right away instead of
+// at the next poll. Each shard gets a dedicated LISTEN connection; polling
+// keeps running alongside it and picks up anything a notification misses,
+// including everything inserted while a lost connection is reopened.
+func (p *Pool) StartListener(ctx context.Context) {
+	for _, db := range p.db.All() {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			failures := 0
+			for {
+				listening, err := p.listen(ctx, db)
+				if ctx.Err() != nil {
+					return
+				}
+				if listening {
+					failures = 0
+				}
+				wait := pollBackoff(p.interval, failures)
+				failures++
+				log.Printf("LISTEN connection lost, reconnecting in %s: %v", wait, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				listenReconnects.Inc()
+			}
+		}()
+	}
+}
+
+// listen delivers notifications from one LISTEN connection until it
+// fails. listening reports whether LISTEN itself succeeded, so the caller
+// can tell a dropped connection from one it can't open.
+func (p *Pool) listen(ctx context.Context, db *pgxpool.Pool) (listening bool, err error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	// A connection that was LISTENing must not go back to the pool.
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return false, err
+	}
+
+	// Bounds the sends started from notifications, like one worker's batch.
+	sem := make(chan struct{}, p.batchSize)
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() { <-sem }()
+			p.processNotified(ctx, db, n.Payload)
+		}()
+	}
+}
+
+// processNotified claims and sends the event whose ID was notified, if it
+// is still pending and due. Delayed events are left to polling. With
+// NOTIFY_ORDER=sequential or PRIORITY_AGING claiming it directly would
+// send it ahead of older or higher priority events, so it only wakes a
+// worker, which claims in order.
+func (p *Pool) processNotified(ctx context.Context, db *pgxpool.Pool, id string) {
+	if !uuidPattern.MatchString(id) {
+		return
+	}
+	if p.sequential || p.priorityAging > 0 {
+		p.wake()
+		return
+	}
+	if !p.leader.Leading() || !p.window.Contains(time.Now()) {
+		return
+	}
+	if p.inflight.acquire(1) == 0 {
+		return
+	}
+	defer p.inflight.release(1)
+
+	fifo := ""
+	if p.sessionFIFO {
+		fifo = "AND " + sessionFIFOClause
+	}
+	event, err := scanEvent(db.QueryRow(ctx, `
+	UPDATE cart_events e
+	SET status = 'processing'
+	WHERE id = $1 AND status = 'pending' AND process_after <= CURRENT_TIMESTAMP `+fifo+`
+	RETURNING `+eventColumns, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) {
+			// Not the server aborting the UPDATE but decoding or reading
+			// its result failing, so the row may well be claimed. Put it
+			// back rather than leave it in 'processing'.
+			p.requeueIDs(db, []string{id})
+		}
+		if !isShutdown(ctx, err) {
+			log.Println("Error claiming notified event:", err)
+		}
+		return
+	}
+	p.hook.Fire(event.ID, "pending", "processing")
+	if err := p.limiter.Wait(ctx); err != nil {
+		p.requeue(db, event)
+		return
+	}
+	p.send(ctx, db, event)
+}
+
+// wake makes an idle worker poll now without waiting for its result. If
+// every worker is busy it does nothing and their next poll picks the
+// event up.
+func (p *Pool) wake() {
+	select {
+	case p.pollNow <- make(chan int, 1):
+	default:
+	}
+}
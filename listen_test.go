@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNotifyPayloadIsEventID(t *testing.T) {
+	db := testDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stored body well over the 8000 byte NOTIFY limit must not reach
+	// the payload.
+	router := NewHashRouter(db)
+	h := &Handler{db: router, read: router, auditRawMax: 1 << 20}
+	raw := []byte(validEvent(`"padding":"` + strings.Repeat("x", 10000) + `"`))
+	event := CartEvent{OrderType: "Purchase", SessionID: "session-1", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(ctx, event, raw); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	if err := db.QueryRow(ctx, "SELECT id FROM cart_events").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := conn.Conn().WaitForNotification(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Channel != notifyChannel || n.Payload != id {
+		t.Errorf("notification on %q with payload %q, want %q", n.Channel, n.Payload, id)
+	}
+}
+
+func TestProcessNotifiedClaimsByID(t *testing.T) {
+	queue := &fakeQueue{}
+	f := newFakePG(t, queue.handle)
+	p := &Pool{batchSize: 10, notifier: notifierFunc(func(context.Context, PGCartEvent) error { return nil })}
+	db := f.pool(t)
+
+	// A payload that is not an event ID, such as a whole row from an old
+	// trigger, is ignored rather than sent to the database.
+	p.processNotified(context.Background(), db, `{"id":"`+fakeID(1)+`"}`)
+	p.processNotified(context.Background(), db, fakeID(1))
+
+	var claims []string
+	for _, q := range f.Queries() {
+		if strings.Contains(q, "SET status = 'processing'") {
+			claims = append(claims, q)
+		}
+	}
+	if len(claims) != 1 || !strings.Contains(claims[0], "'"+fakeID(1)+"'") {
+		t.Errorf("claims %q, want one for %s", claims, fakeID(1))
+	}
+}
+
+func TestProcessNotifiedOnlyWakesOrderedWorkers(t *testing.T) {
+	for name, p := range map[string]*Pool{
+		"sequential":     {sequential: true},
+		"priority aging": {priorityAging: time.Minute},
+	} {
+		f := newFakePG(t, (&fakeQueue{}).handle)
+		p.pollNow = make(chan chan int, 1)
+		p.processNotified(context.Background(), f.pool(t), fakeID(1))
+
+		if queries := f.Queries(); len(queries) > 0 {
+			t.Errorf("%s: notification claimed directly: %q", name, queries)
+		}
+		select {
+		case <-p.pollNow:
+		default:
+			t.Errorf("%s: no worker woken", name)
+		}
+	}
+}
+
+func TestListenRecoversFromDroppedConnection(t *testing.T) {
+	var listens atomic.Int32
+	f := newFakePG(t, func(sql string) fakeResult {
+		if sql == "LISTEN "+notifyChannel {
+			listens.Add(1)
+		}
+		return fakeResult{}
+	})
+	logs := captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{db: NewHashRouter(f.pool(t)), wg: &sync.WaitGroup{}, interval: 10 * time.Millisecond, batchSize: 10}
+	before := listenReconnects.Value()
+	p.StartListener(ctx)
+
+	waitListens := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for listens.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d LISTENs, want %d", listens.Load(), n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitListens(1)
+	f.dropConns()
+	waitListens(2)
+	f.dropConns()
+	waitListens(3)
+
+	cancel()
+	p.wg.Wait()
+	if n := listenReconnects.Value() - before; n != 2 {
+		t.Errorf("listen_reconnects_total went up %v, want 2", n)
+	}
+	if !strings.Contains(logs.String(), "LISTEN connection lost, reconnecting") {
+		t.Errorf("lost connection not logged:\n%s", logs)
+	}
+}
+
+func TestListenRecoversAfterBackendTerminated(t *testing.T) {
+	db := testDB(t)
+	captureLog(t)
+	sent := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := &Pool{db: NewHashRouter(db), wg: &sync.WaitGroup{}, interval: 10 * time.Millisecond, batchSize: 10,
+		notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+			sent <- event.ID
+			return nil
+		})}
+	p.StartListener(ctx)
+	defer p.wg.Wait()
+	defer cancel()
+
+	// listener waits for a LISTEN session other than old and returns its
+	// backend pid.
+	listener := func(old int) int {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var pid int
+			err := db.QueryRow(ctx, `
+			SELECT COALESCE(MAX(pid), 0) FROM pg_stat_activity
+			WHERE query = 'LISTEN `+notifyChannel+`' AND pid <> $1`, old).Scan(&pid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pid != 0 {
+				return pid
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("no LISTEN session")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Kill the LISTEN session from the server side and wait for a new one.
+	pid := listener(0)
+	if _, err := db.Exec(ctx, "SELECT pg_terminate_backend($1)", pid); err != nil {
+		t.Fatal(err)
+	}
+	listener(pid)
+
+	// The pool has no polling workers, so the event is only sent if the
+	// new session got its notification.
+	id := seedEvent(t, db, "session-1")
+	select {
+	case got := <-sent:
+		if got != id {
+			t.Errorf("sent %s, want %s", got, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event never sent after the LISTEN connection was restored")
+	}
+}
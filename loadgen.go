@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type loadgenOptions struct {
+	URL         string
+	Rate        int
+	Duration    time.Duration
+	Concurrency int
+}
+
+type loadgenResult struct {
+	sent, failed int
+	latencies    []time.Duration
+}
+
+// runLoadgen posts synthetic cart events to a running server at a fixed
+// rate and prints throughput and latency percentiles when done.
+func runLoadgen(ctx context.Context, opts loadgenOptions) error {
+	if opts.Rate < 1 || opts.Concurrency < 1 || opts.Duration <= 0 {
+		return fmt.Errorf("loadgen needs a positive rate, concurrency and duration")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	jobs := make(chan struct{})
+	var mu sync.Mutex
+	var result loadgenResult
+	var wg sync.WaitGroup
+
+	wg.Add(opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				start := time.Now()
+				err := postSyntheticEvent(client, opts.URL)
+				elapsed := time.Since(start)
+
+				mu.Lock()
+				result.sent++
+				if err != nil {
+					result.failed++
+				} else {
+					result.latencies = append(result.latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			select {
+			case jobs <- struct{}{}:
+			default:
+				// Every sender is busy; the server can't keep up with the rate.
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	log.Printf("loadgen: sent %d events in %s (%.1f/s), %d failed, p50 %s, p99 %s",
+		result.sent, elapsed.Round(time.Millisecond), float64(result.sent)/elapsed.Seconds(), result.failed,
+		percentile(result.latencies, 0.50), percentile(result.latencies, 0.99))
+	return nil
+}
+
+func postSyntheticEvent(client *http.Client, url string) error {
+	body, err := json.Marshal(CartEvent{
+		OrderType:  "Purchase",
+		SessionID:  fmt.Sprintf("loadgen-%d", rand.Int63()),
+		Card:       fmt.Sprintf("4433%08d1409", rand.Intn(1e8)),
+		EventDate:  time.Now().UTC().Format(time.RFC3339Nano),
+		WebsiteURL: "https://example.com",
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)].Round(time.Microsecond)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// bufferedLog batches log writes in memory and writes them out when the
+// buffer fills, every interval, and on Close, so logging doesn't block
+// request handling on a slow stderr.
+type bufferedLog struct {
+	mu   sync.Mutex
+	buf  *bufio.Writer
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBufferedLog(w io.Writer, size int, interval time.Duration) *bufferedLog {
+	l := &bufferedLog{
+		buf:  bufio.NewWriterSize(w, size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go l.flushEvery(interval)
+	return l
+}
+
+func (l *bufferedLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *bufferedLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Flush()
+}
+
+func (l *bufferedLog) flushEvery(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.Flush()
+		}
+	}
+}
+
+// Close stops the periodic flush and writes out everything still
+// buffered.
+func (l *bufferedLog) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.Flush()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while a flush writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBufferedLogFlushedOnClose(t *testing.T) {
+	var out syncBuffer
+	l := newBufferedLog(&out, 1<<10, time.Hour)
+	l.Write([]byte("first\n"))
+	l.Write([]byte("second\n"))
+	if got := out.String(); got != "" {
+		t.Fatalf("wrote %q before the buffer filled or the interval passed", got)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "first\nsecond\n" {
+		t.Errorf("after Close: %q", got)
+	}
+}
+
+func TestBufferedLogFlushes(t *testing.T) {
+	var out syncBuffer
+	l := newBufferedLog(&out, 16, 20*time.Millisecond)
+	defer l.Close()
+
+	l.Write([]byte(strings.Repeat("x", 20)))
+	if got := out.String(); len(got) < 16 {
+		t.Errorf("a full buffer was not written out: %q", got)
+	}
+	l.Write([]byte("tail\n"))
+	deadline := time.Now().Add(time.Second)
+	for !strings.HasSuffix(out.String(), "tail\n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("not flushed after the interval: %q", out.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
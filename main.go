@@ -3,20 +3,50 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Defaults for WORKER_COUNT, POLL_INTERVAL and BATCH_SIZE.
 const (
 	WorkerCount = 8
 	Interval    = 1 * time.Second
+	BatchSize   = 10
+
+	// MaxEventBytes bounds the request body. CartEvent is a flat object of
+	// short strings, so anything bigger is not a valid event.
+	MaxEventBytes = 16 << 10
+	// BodyReadTimeout is how long a client gets to send an event body. A
+	// body that stalls, e.g. behind a Content-Length larger than what is
+	// sent, fails with 400 instead of holding the handler.
+	BodyReadTimeout = 10 * time.Second
+)
+
+// Defaults for the SERVER_*_TIMEOUT settings. Handlers that need longer,
+// like batches and exports, extend their own deadlines.
+const (
+	ServerReadHeaderTimeout = 5 * time.Second
+	ServerReadTimeout       = 30 * time.Second
+	ServerWriteTimeout      = 30 * time.Second
+	ServerIdleTimeout       = 2 * time.Minute
 )
 
 type CartEvent struct {
@@ -25,52 +55,144 @@ type CartEvent struct {
 	Card       string `json:"card"`
 	EventDate  string `json:"eventDate"`
 	WebsiteURL string `json:"websiteUrl"`
+
+	// DelaySeconds postpones the notification, e.g. for abandoned-cart
+	// reminders. Zero means notify as soon as possible.
+	DelaySeconds int `json:"delaySeconds,omitempty"`
+
+	// Priority, 0 to MaxPriority, lets urgent events jump the queue when
+	// PRIORITY_AGING is set.
+	Priority int `json:"priority,omitempty"`
+
+	// CreatedAt is accepted so clients that echo it back aren't rejected,
+	// but it is never stored: created_at always comes from the database
+	// clock so ordering can't be skewed by client time. It must still be
+	// a string or null, so nothing else rides along in it.
+	CreatedAt *string `json:"createdAt,omitempty"`
+
+	// sent and nulls record which keys the JSON held and which of them
+	// were null, so Validate can tell a missing field from a null and
+	// from an empty string.
+	sent, nulls map[string]bool
+	// version is the schema version the event was sent in, zero meaning
+	// DefaultSchemaVersion.
+	version int
 }
 
 type PGCartEvent struct {
-	ID         string
-	OrderType  string
-	SessionID  string
-	Card       string
-	EventDate  time.Time
-	WebsiteURL string
-	Status     string
-	CreatedAt  time.Time
-}
+	ID         string     `json:"id"`
+	OrderType  string     `json:"orderType"`
+	SessionID  string     `json:"sessionId"`
+	Card       string     `json:"card"`
+	EventDate  time.Time  `json:"eventDate"`
+	WebsiteURL string     `json:"websiteUrl"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	NotifiedAt *time.Time `json:"notifiedAt,omitempty"`
+	// ProcessAfter is when the event becomes due for notification.
+	ProcessAfter time.Time `json:"processAfter"`
+	// RetryCount is how many failed notification attempts have been
+	// rescheduled so far.
+	RetryCount int `json:"retryCount"`
+	Priority   int `json:"priority"`
 
-func initDB() (*pgxpool.Pool, error) {
-	databaseURL := os.Getenv("DATABASE_URL")
+	// Delay is only used on insert to compute process_after.
+	Delay time.Duration `json:"-"`
+	// CardLastFour is only filled in on reads when CARD_LAST_FOUR is on.
+	CardLastFour string `json:"cardLastFour,omitempty"`
+	// Region is derived from WebsiteURL via REGION_MAP, empty if unmapped.
+	Region string `json:"region,omitempty"`
+	// InstanceID is the INSTANCE_ID of the replica that ingested the event.
+	InstanceID string `json:"instanceId,omitempty"`
+	// TenantID is the X-Tenant-ID the event was sent with, see MULTI_TENANT.
+	TenantID string `json:"tenantId,omitempty"`
+	// RawPayload is the masked request body, stored only with AUDIT_RAW.
+	RawPayload *string `json:"-"`
+	// RawPayloadGzip replaces RawPayload with AUDIT_RAW_COMPRESS.
+	RawPayloadGzip []byte `json:"-"`
+	// SchemaVersion is the payload version the event was sent in, only
+	// used on insert.
+	SchemaVersion int `json:"-"`
+}
 
+func connectDB(databaseURL string, minConns int) (*pgxpool.Pool, error) {
+	if err := checkDatabaseURL(databaseURL); err != nil {
+		return nil, err
+	}
 	config, err := pgxpool.ParseConfig(databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
 	config.MaxConns = 10
+	config.MinConns = int32(minConns)
 	config.MaxConnIdleTime = 30 * time.Minute
+	config.AfterConnect = scanTimesInUTC
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	db, err := pgxpool.New(ctx, config.ConnString())
+	db, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, err
 	}
+	if err := warmUp(ctx, db, minConns); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("warming up connection pool: %w", err)
+	}
+	return db, nil
+}
+
+// scanTimesInUTC makes timestamptz columns scan into UTC instead of the
+// process's local zone, so every time in a response is RFC 3339 with a
+// trailing Z no matter where the service runs.
+func scanTimesInUTC(_ context.Context, conn *pgx.Conn) error {
+	conn.TypeMap().RegisterType(&pgtype.Type{
+		Name:  "timestamptz",
+		OID:   pgtype.TimestamptzOID,
+		Codec: &pgtype.TimestamptzCodec{ScanLocation: time.UTC},
+	})
+	return nil
+}
 
-	query := `
-	CREATE EXTENSION IF NOT EXISTS "uuid-ossp";	
-	CREATE TABLE IF NOT EXISTS cart_events (
-		id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
-		order_type varchar(30) not null,
-		session_id text not null,
-		card varchar(16) not null,
-		event_date timestamp not null,
-		website_url text not null,
-		status varchar(20) DEFAULT 'pending',
-		created_at timestamp DEFAULT CURRENT_TIMESTAMP
-	);`
-	_, err = db.Exec(context.Background(), query)
+// warmUp opens n connections up front, so the first requests after
+// startup don't pay for connection setup. pgxpool only tops up to
+// MinConns in the background, so all n are held at the same time and
+// then handed back to the pool.
+func warmUp(ctx context.Context, db *pgxpool.Pool, n int) error {
+	conns := make([]*pgxpool.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		conn, err := db.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	return nil
+}
+
+// initDB connects and migrates the schema, with the LISTEN_NOTIFY insert
+// trigger if listenNotify is set. With skipSchema it issues no DDL and
+// only checks that the schema is already in place, including
+// dead_letter_events if deadLetter is set.
+func initDB(databaseURL string, skipSchema, deadLetter, listenNotify bool, minConns int) (*pgxpool.Pool, error) {
+	db, err := connectDB(databaseURL, minConns)
+	if err != nil {
+		return nil, err
+	}
+
+	if skipSchema {
+		err = checkSchema(context.Background(), db, deadLetter)
+	} else {
+		err = migrate(context.Background(), db, listenNotify)
+	}
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -78,86 +200,459 @@ func initDB() (*pgxpool.Pool, error) {
 }
 
 type Pool struct {
-	db         *pgxpool.Pool
+	db         ShardRouter
 	wg         *sync.WaitGroup
 	numWorkers int
+	limiter    *RateLimiter
+	notifier   Notifier
+	// degraded marks events processed without delivery while the circuit
+	// breaker is open, instead of re-queuing them for the whole outage.
+	degraded bool
+	hook     *StatusHook
+	// pollNow lets callers wake a worker outside its interval. The worker
+	// replies with the number of events it claimed.
+	pollNow chan chan int
+	// heartbeats holds, per worker, the UnixNano time its last poll
+	// finished. Workers silent for longer than staleAfter count as hung.
+	heartbeats []atomic.Int64
+	staleAfter time.Duration
+	interval   time.Duration
+	// window restricts notifications to a daily time span. Outside it
+	// workers don't claim events, and claimed ones go back to pending.
+	window    *TimeWindow
+	batchSize int
+	inflight  *inflightLimiter
+	retries   RetrySchedule
+	// leader, if set, lets workers claim events only while this instance
+	// holds the leader lock.
+	leader     *leaderLock
+	typeLimits typeLimiter
+	// sessionFIFO only claims a session's oldest pending event, and only
+	// while none of its events is processing, so each session is notified
+	// in order.
+	sessionFIFO bool
+	// atMostOnce marks events processed before notifying instead of
+	// after, trading duplicate notifications after a crash for lost ones.
+	// A failed notification is then marked failed, never retried.
+	atMostOnce bool
+	// deadLetter moves events that exhausted their retries to
+	// dead_letter_events instead of leaving them in cart_events as failed.
+	deadLetter bool
+	// sequential sends a batch's notifications one after another in
+	// created_at order instead of all at once.
+	sequential bool
+	// notifyTimeout bounds a single notification; an event that runs
+	// over is retried like any other failure. Zero sets no limit.
+	notifyTimeout time.Duration
+	// eventLog, if set, gets a line for every event marked processed.
+	eventLog *eventLog
+	ramp     *rampLimiter
+	// priorityAging, when set, claims by priority plus age instead of id.
+	priorityAging time.Duration
+}
+
+type PoolOptions struct {
+	Limiter    *RateLimiter
+	Notifier   Notifier
+	Degraded   bool
+	Hook       *StatusHook
+	StaleAfter time.Duration
+	Interval   time.Duration
+	Window     *TimeWindow
+	BatchSize  int
+	// MaxInFlight caps claimed events across all workers, zero means
+	// WorkerCount * BatchSize.
+	MaxInFlight int
+	Retries     RetrySchedule
+	// Leader restricts claiming to the instance holding the lock. Nil
+	// means every instance runs its workers.
+	Leader *leaderLock
+	// TypeLimits caps concurrent notifications per order type across the
+	// whole pool.
+	TypeLimits    map[string]int
+	SessionFIFO   bool
+	AtMostOnce    bool
+	DeadLetter    bool
+	Sequential    bool
+	NotifyTimeout time.Duration
+	EventLog      *eventLog
+	// RampUp grows notification concurrency from 1 to MaxInFlight, or
+	// WorkerCount * BatchSize, over this long. Zero starts at full speed.
+	RampUp        time.Duration
+	PriorityAging time.Duration
 }
 
-func NewPool(ctx context.Context, numWorkers int, db *pgxpool.Pool) *Pool {
+func NewPool(ctx context.Context, numWorkers int, db ShardRouter, opts PoolOptions) *Pool {
 	pool := &Pool{
-		db:         db,
-		wg:         &sync.WaitGroup{},
-		numWorkers: numWorkers,
+		db:            db,
+		wg:            &sync.WaitGroup{},
+		numWorkers:    numWorkers,
+		limiter:       opts.Limiter,
+		notifier:      opts.Notifier,
+		degraded:      opts.Degraded,
+		hook:          opts.Hook,
+		pollNow:       make(chan chan int),
+		heartbeats:    make([]atomic.Int64, numWorkers),
+		staleAfter:    opts.StaleAfter,
+		interval:      opts.Interval,
+		window:        opts.Window,
+		batchSize:     opts.BatchSize,
+		inflight:      newInflightLimiter(opts.MaxInFlight),
+		retries:       opts.Retries,
+		leader:        opts.Leader,
+		typeLimits:    newTypeLimiter(opts.TypeLimits),
+		sessionFIFO:   opts.SessionFIFO,
+		atMostOnce:    opts.AtMostOnce,
+		deadLetter:    opts.DeadLetter,
+		sequential:    opts.Sequential,
+		notifyTimeout: opts.NotifyTimeout,
+		eventLog:      opts.EventLog,
+	}
+	rampMax := opts.MaxInFlight
+	if rampMax <= 0 {
+		rampMax = numWorkers * opts.BatchSize
+	}
+	pool.ramp = newRampLimiter(rampMax, opts.RampUp)
+	pool.priorityAging = opts.PriorityAging
+
+	if pool.leader != nil {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			pool.leader.run(ctx)
+		}()
 	}
 
 	pool.wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
-		go pool.workerEvents(ctx)
+		pool.beat(i)
+		go pool.workerEvents(ctx, i)
 	}
 
 	return pool
 }
 
-func (p *Pool) workerEvents(ctx context.Context) {
+// MaxPollBackoff caps how long a worker waits between polls after
+// repeated claim errors.
+const MaxPollBackoff = 30 * time.Second
+
+func (p *Pool) workerEvents(ctx context.Context, id int) {
 	defer p.wg.Done()
+	failures := 0
 	for {
+		var reply chan int
 		select {
 		case <-ctx.Done():
 			return
-		default:
-			p.process(ctx)
+		case <-time.After(pollBackoff(p.interval, failures)):
+		case reply = <-p.pollNow:
 		}
+		// select picks randomly among ready cases, so a tick can win
+		// over a cancellation that happened at the same time.
+		if ctx.Err() != nil {
+			if reply != nil {
+				reply <- 0
+			}
+			return
+		}
+
+		claimed := 0
+		failed := false
+		if p.leader.Leading() && p.window.Contains(time.Now()) {
+			for _, db := range p.db.All() {
+				n, err := p.process(ctx, db)
+				claimed += n
+				failed = failed || err != nil
+			}
+		}
+		if failed {
+			failures++
+		} else {
+			failures = 0
+		}
+		p.beat(id)
+		if reply != nil {
+			reply <- claimed
+		}
+	}
+}
+
+// pollBackoff returns how long to wait before the next poll: interval
+// normally, doubling with each consecutive failed poll up to
+// MaxPollBackoff (or interval, if that is longer).
+func pollBackoff(interval time.Duration, failures int) time.Duration {
+	wait := interval
+	for i := 0; i < failures && wait < MaxPollBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, max(MaxPollBackoff, interval))
+}
+
+// PollNow makes an idle worker process one batch right away and returns
+// how many events it picked up once they have been handled.
+func (p *Pool) PollNow(ctx context.Context) (int, error) {
+	reply := make(chan int, 1)
+	select {
+	case p.pollNow <- reply:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case n := <-reply:
+		return n, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// process claims one batch of pending events from db, notifies them and
+// returns the number of events claimed. The error is the claim query's;
+// notification failures are handled per event.
+func (p *Pool) process(ctx context.Context, db *pgxpool.Pool) (int, error) {
+	slots := p.inflight.acquire(p.batchSize)
+	if slots == 0 {
+		return 0, nil
+	}
+	defer p.inflight.release(slots)
+
+	events, claimed, err := p.claim(ctx, db, slots)
+	if err != nil {
+		return 0, err
+	}
+
+	// Each send settles its own event, so a failure only re-queues that
+	// one and the rest of the batch still completes.
+	var sends sync.WaitGroup
+	started := 0
+	if p.sequential {
+		sort.Slice(events, func(i, j int) bool {
+			if !events[i].CreatedAt.Equal(events[j].CreatedAt) {
+				return events[i].CreatedAt.Before(events[j].CreatedAt)
+			}
+			return events[i].ID < events[j].ID
+		})
+	}
+	for _, event := range events {
+		if err := p.limiter.Wait(ctx); err != nil {
+			break
+		}
+		started++
+		if p.sequential {
+			p.send(ctx, db, event)
+			continue
+		}
+		sends.Add(1)
+		go func() {
+			defer sends.Done()
+			p.send(ctx, db, event)
+		}()
 	}
+	sends.Wait()
+	if unsent := events[started:]; len(unsent) > 0 {
+		// Shutting down mid-batch. Hand the rest back now rather than
+		// leaving them processing until the reaper finds them.
+		p.requeueAll(db, unsent)
+	}
+	return claimed, nil
 }
 
-func (p *Pool) process(ctx context.Context) {
-	time.Sleep(Interval)
+// send notifies one claimed event once its order type has a free slot.
+func (p *Pool) send(ctx context.Context, db *pgxpool.Pool, event PGCartEvent) {
+	release, err := p.typeLimits.acquire(ctx, event.OrderType)
+	if err != nil {
+		p.requeue(db, event)
+		return
+	}
+	defer release()
+	if err := p.ramp.acquire(ctx); err != nil {
+		p.requeue(db, event)
+		return
+	}
+	defer p.ramp.release()
+	p.sendNotification(ctx, db, event)
+}
+
+// sessionFIFOClause restricts a claim over cart_events e to events that
+// are next in line for their session: nothing of the session is being
+// processed and no older event of it is still pending.
+const sessionFIFOClause = `NOT EXISTS (
+			SELECT 1 FROM cart_events o
+			WHERE o.session_id = e.session_id AND o.id <> e.id
+			AND (o.status = 'processing'
+				OR (o.status = 'pending' AND (o.created_at, o.id) < (e.created_at, e.id)))
+		)`
+
+// MaxClaimRetries is how many times a claim that lost a serialization
+// conflict or deadlock is retried before the poll counts as failed.
+const MaxClaimRetries = 3
 
-	rows, err := p.db.Query(ctx, `
+var claimRetries = newCounter("claim_retries_total",
+	"Claims retried after a serialization failure or deadlock.")
+
+// claim marks up to limit due events as processing and returns the ones
+// it could read along with how many rows it claimed, or the query error.
+// Serialization failures and deadlocks are transient and retried after a
+// short pause; any other error fails the poll at once.
+func (p *Pool) claim(ctx context.Context, db *pgxpool.Pool, limit int) ([]PGCartEvent, int, error) {
+	for attempt := 1; ; attempt++ {
+		events, claimed, err := p.claimOnce(ctx, db, limit)
+		if err == nil {
+			return events, claimed, nil
+		}
+		if !isConflict(err) || attempt > MaxClaimRetries {
+			if !isShutdown(ctx, err) {
+				log.Println("Error fetching events:", err)
+			}
+			return nil, 0, err
+		}
+		claimRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+		}
+	}
+}
+
+// isConflict reports whether err is a serialization failure or deadlock,
+// which Postgres resolves by aborting one side and which is worth retrying.
+func isConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// claimOnce runs the claim query once. The result set is fully drained
+// and closed before it returns, so the connection is back in the pool
+// before any notification is sent.
+func (p *Pool) claimOnce(ctx context.Context, db *pgxpool.Pool, limit int) ([]PGCartEvent, int, error) {
+	fifo := ""
+	if p.sessionFIFO {
+		fifo = "AND " + sessionFIFOClause
+	}
+	args := []any{limit}
+	order := "id"
+	switch {
+	case p.priorityAging > 0:
+		// Every priorityAging an event waits past process_after counts
+		// as one more priority level, so a low-priority event overtakes
+		// newer urgent ones once it is old enough.
+		order = "priority + EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - process_after)::float8 / $2 DESC, created_at, id"
+		args = append(args, p.priorityAging.Seconds())
+	case p.sequential:
+		order = "created_at, id"
+	}
+	rows, err := db.Query(ctx, `
 	WITH cte AS (
 		SELECT id, order_type, session_id, card, event_date, website_url 
-		FROM cart_events 
-		WHERE status = 'pending' 
-		ORDER BY id 
-		LIMIT 10 
+		FROM cart_events e
+		WHERE status = 'pending' AND process_after <= CURRENT_TIMESTAMP `+fifo+`
+		ORDER BY `+order+` 
+		LIMIT $1 
 		FOR UPDATE SKIP LOCKED
 	)
 	UPDATE cart_events 
 	SET status = 'processing' 
 	WHERE id IN (SELECT id FROM cte)
-	RETURNING id, order_type, session_id, card, event_date, website_url, status, created_at;
-	`)
-	defer rows.Close()
-
+	RETURNING `+eventColumns+`;
+	`, args...)
 	if err != nil {
-		log.Println("Error fetching events:", err)
-		return
+		return nil, 0, err
 	}
 
+	// Rows are decoded from their raw values rather than with rows.Scan:
+	// pgx closes the result set on the first Scan error, which would
+	// leave the rest of the batch claimed but never read.
+	typeMap := rows.Conn().TypeMap()
+	fields := rows.FieldDescriptions()
+	claimed := 0
+	var events []PGCartEvent
+	var ids, unscanned []string
 	for rows.Next() {
-		var event PGCartEvent
-
-		err := rows.Scan(
-			&event.ID,
-			&event.OrderType,
-			&event.SessionID,
-			&event.Card,
-			&event.EventDate,
-			&event.WebsiteURL,
-			&event.Status,
-			&event.CreatedAt,
-		)
+		claimed++
+		row := rawRow{typeMap: typeMap, fields: fields, values: rows.RawValues()}
+		id, ok := row.id()
+		if ok {
+			ids = append(ids, id)
+		}
+		event, err := scanEvent(row)
 		if err != nil {
 			log.Println("Error scanning row:", err)
+			if ok {
+				unscanned = append(unscanned, id)
+			}
 			continue
 		}
+		events = append(events, event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) {
+			// Not the server aborting the UPDATE but the result getting
+			// lost on the way, so the rows seen so far may well be
+			// claimed.
+			p.requeueIDs(db, ids)
+		}
+		// A server error aborted the UPDATE, which rolls it back, so
+		// nothing is claimed. Decode errors never get here: rawRow
+		// leaves them to the loop above.
+		return nil, 0, err
+	}
 
-		sendNotification(ctx, p.db, event)
+	if len(unscanned) > 0 {
+		// Claimed but unusable; put them back rather than leave them in
+		// 'processing' forever.
+		p.requeueIDs(db, unscanned)
+	}
+	for _, event := range events {
+		p.hook.Fire(event.ID, "pending", "processing")
 	}
+	return events, claimed, nil
 }
 
 type Handler struct {
-	db *pgxpool.Pool
+	db ShardRouter
+	// read serves the GET endpoints. It points at replicas when
+	// READ_DATABASE_URLS is set and at db otherwise.
+	read ShardRouter
+	// dedupeWindow enables skipping an event when a pending or processing
+	// event with the same session, card and order type was stored within
+	// the window. Zero disables deduplication.
+	dedupeWindow time.Duration
+	adminKey     string
+	pool         *Pool
+	hook         *StatusHook
+	allowedHosts []string
+	// regions tags events with a region; allowedRegions, if set, rejects
+	// events from any other region, including unmapped ones.
+	regions        RegionMap
+	allowedRegions []string
+	// allowedBINs, if set, rejects cards issued outside these ranges.
+	allowedBINs BINRanges
+	// auditRawMax, when positive, stores each event's masked request body
+	// in raw_payload, cut to this many bytes.
+	auditRawMax   int
+	auditCompress bool
+	// acquireTimeout bounds how long a request waits for a free database
+	// connection before failing with ErrPoolBusy. Zero waits indefinitely.
+	acquireTimeout time.Duration
+	// instanceID is stored with every inserted event.
+	instanceID string
+	// multiTenant requires X-Tenant-ID on event routes, see tenantScoped.
+	multiTenant bool
+	// deadLetters is set when dead_letter_events is known to exist: the
+	// migrations create it, and SKIP_SCHEMA_INIT only requires it with
+	// DEAD_LETTER_TABLE.
+	deadLetters bool
+	// shedder, if set, turns ingest requests away while the backlog is
+	// too large, see shedding.
+	shedder *loadShedder
+	// config is what GET /admin/config reports.
+	config Config
+	// ready flips once the pool is running and the databases answer.
+	ready atomic.Bool
+	pings pingCache
 }
 
 func (h *Handler) Event(w http.ResponseWriter, r *http.Request) {
@@ -167,87 +662,701 @@ func (h *Handler) Event(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-
-	var event CartEvent
-	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{
-			"error": "invalid body",
-		})
+	if !isJSON(r) {
+		localizeError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
 		return
 	}
 
-	_, err := h.db.Exec(context.Background(),
-		`INSERT INTO cart_events (order_type, session_id, card, event_date, website_url) 
-	VALUES ($1, $2, $3, $4, $5)`,
-		event.OrderType, event.SessionID, event.Card, event.EventDate, event.WebsiteURL)
+	event, raw, err := decodeEvent(w, r)
+	if errors.Is(err, errUnsupportedVersion) {
+		localizeError(w, r, http.StatusBadRequest, "unsupported schema version")
+		return
+	}
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{
-			"error": err.Error(),
+		localizeError(w, r, http.StatusBadRequest, "invalid body")
+		return
+	}
+
+	// Finish the insert even if the client hangs up, but keep the
+	// request's values such as the tenant.
+	stored, err := h.ingest(context.WithoutCancel(r.Context()), event, raw)
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		lang := requestLanguage(r)
+		failures, msg := localizeValidation(lang, err)
+		w.Header().Set("Content-Language", lang)
+		writeJSON(w, http.StatusUnprocessableEntity, validationResponse{
+			Error:  msg,
+			Errors: failures,
 		})
 		return
+	case errors.Is(err, errHostNotAllowed), errors.Is(err, errRegionNotAllowed):
+		localizeError(w, r, http.StatusForbidden, err.Error())
+		return
+	case err != nil:
+		dbError(w, r, err)
+		return
+	}
+	if !stored {
+		writeJSON(w, http.StatusOK, "duplicate event ignored")
+		return
 	}
 
 	writeJSON(w, http.StatusOK, "event recieved and stored")
 }
 
-func main() {
-	db, err := initDB()
+// validationResponse is the 422 body: the joined message for clients that
+// only show one string, plus every failing field.
+type validationResponse struct {
+	Error  string             `json:"error"`
+	Errors []*ValidationError `json:"errors"`
+}
+
+var errHostNotAllowed = errors.New("websiteUrl host is not allowed")
+
+// ingest validates and stores one event decoded from raw. It is shared by every ingress so
+// they all apply the same rules. Errors are a *ValidationError,
+// errHostNotAllowed, errRegionNotAllowed, ErrPoolBusy or a database error.
+// A CHECK constraint the event violates is a *ValidationError too, see
+// constraintError.
+func (h *Handler) ingest(ctx context.Context, event CartEvent, raw []byte) (bool, error) {
+	pgEvent, err := event.toPGCartEvent()
+	if err == nil {
+		err = h.checkBIN(event.Card)
+	}
+	if err != nil {
+		return false, err
+	}
+	h.withAudit(&pgEvent, raw, event.Card)
+	if err := h.checkEvent(&pgEvent); err != nil {
+		return false, err
+	}
+	pgEvent.TenantID = tenantID(ctx)
+
+	conn, err := h.acquire(ctx, h.db.ForSession(pgEvent.SessionID))
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+	return h.insertEvent(ctx, conn, pgEvent)
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// DedupeLockClass is the first key of the two-key advisory locks that
+// serialize deduplicated inserts. Two-key locks never collide with the
+// single-key LEADER_LOCK_KEY.
+const DedupeLockClass = 72616002
+
+// insertEvent stores event through db, which is a shard connection or a
+// transaction on one. It returns false when the dedupe window swallowed
+// the event.
+func (h *Handler) insertEvent(ctx context.Context, db execer, event PGCartEvent) (bool, error) {
+	query := `INSERT INTO cart_events (order_type, session_id, card, event_date, website_url, process_after, raw_payload, region, card_last_four, instance_id, tenant_id, raw_payload_gzip, schema_version, priority) 
+	VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + make_interval(secs => $6), $7, NULLIF($8, ''), $9, NULLIF($10, ''), NULLIF($11, ''), $12, $13, $14)`
+	args := []any{event.OrderType, event.SessionID, event.Card, event.EventDate, event.WebsiteURL, event.Delay.Seconds(), event.RawPayload, event.Region, event.CardLastFour, h.instanceID, event.TenantID, event.RawPayloadGzip, event.SchemaVersion, event.Priority}
+	var tx pgx.Tx
+	if h.dedupeWindow > 0 {
+		query = `INSERT INTO cart_events (order_type, session_id, card, event_date, website_url, process_after, raw_payload, region, card_last_four, instance_id, tenant_id, raw_payload_gzip, schema_version, priority) 
+	SELECT $1::varchar, $2::text, $3::varchar, $4::timestamptz, $5::text, CURRENT_TIMESTAMP + make_interval(secs => $6), $7::text, NULLIF($8::text, ''), $9::varchar, NULLIF($10::text, ''), NULLIF($11::text, ''), $12::bytea, $13::smallint, $14::smallint
+	WHERE NOT EXISTS (
+		SELECT 1 FROM cart_events
+		WHERE session_id = $2 AND card = $3 AND order_type = $1
+		AND tenant_id IS NOT DISTINCT FROM NULLIF($11::text, '')
+		AND status IN ('pending', 'processing')
+		AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $15)
+	)`
+		args = append(args, h.dedupeWindow.Seconds())
+
+		// Under READ COMMITTED two concurrent inserts of the same event
+		// would both find nothing and both go in. Holding a lock on the
+		// session, card and order type until commit makes the second wait
+		// and then see the first. In a batch this is a savepoint and the
+		// lock is held until the whole batch commits.
+		var err error
+		if tx, err = db.Begin(ctx); err != nil {
+			return false, err
+		}
+		defer tx.Rollback(context.Background())
+		_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1::int, hashtext($2::text || '|' || $3 || '|' || $4))",
+			DedupeLockClass, event.SessionID, event.Card, event.OrderType)
+		if err != nil {
+			return false, err
+		}
+		db = tx
+	}
+
+	tag, err := db.Exec(ctx, query, args...)
 	if err != nil {
+		return false, constraintError(err, event.SchemaVersion)
+	}
+	if tx != nil {
+		if err := tx.Commit(ctx); err != nil {
+			return false, err
+		}
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+var eventDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999 -07:00",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// parseEventDate accepts RFC 3339 and the Postgres text format. Dates
+// without an offset are taken as UTC; the result is always in UTC.
+func parseEventDate(s string) (time.Time, error) {
+	for _, layout := range eventDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unsupported date format %q", s)
+}
+
+// isJSON reports whether the request declares a JSON body. Parameters
+// such as charset are allowed.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// decodeEvent reads a single CartEvent from the body. Unknown fields are
+// rejected, so nested objects or arrays smuggled into the payload fail
+// fast instead of being skipped over.
+func decodeEvent(w http.ResponseWriter, r *http.Request) (CartEvent, []byte, error) {
+	setReadDeadline(w, BodyReadTimeout)
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxEventBytes))
+	if err != nil {
+		return CartEvent{}, nil, err
+	}
+	version, err := headerVersion(r)
+	if err != nil {
+		return CartEvent{}, raw, err
+	}
+	event, err := unmarshalEvent(raw, version)
+	return event, raw, err
+}
+
+// setReadDeadline gives the rest of the request body d to arrive. Writers
+// that can't reach the connection, such as test recorders, are left
+// alone.
+func setReadDeadline(w http.ResponseWriter, d time.Duration) {
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(d))
+}
+
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// expectEOF fails if dec has anything but whitespace left after the value
+// it just decoded.
+func expectEOF(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+	return nil
+}
+
+func main() {
+	var lg loadgenOptions
+	flag.StringVar(&lg.URL, "loadgen", "", "instead of serving, post synthetic events to this /event URL")
+	flag.IntVar(&lg.Rate, "loadgen-rate", 100, "events per second to send in loadgen mode")
+	flag.DurationVar(&lg.Duration, "loadgen-duration", 30*time.Second, "how long to run loadgen mode")
+	flag.IntVar(&lg.Concurrency, "loadgen-concurrency", 16, "concurrent requests in loadgen mode")
+	flag.Parse()
+	if lg.URL != "" {
+		if err := runLoadgen(context.Background(), lg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, loadConfig()); err != nil {
 		log.Fatal(err)
 	}
-	h := &Handler{db: db}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+// run starts the workers and the HTTP server and blocks until ctx is
+// canceled, then shuts everything down. It returns nil after a graceful
+// shutdown and an error if startup or the listener fails.
+func run(ctx context.Context, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	if cfg.LogBuffered {
+		logs := newBufferedLog(os.Stderr, 64<<10, cfg.LogFlushInterval)
+		log.SetOutput(logs)
+		defer func() {
+			log.SetOutput(os.Stderr)
+			logs.Close()
+		}()
+	}
+	log.Println("Effective config:", cfg.Summary())
+	prettyJSON = cfg.PrettyJSON
+	logStackTraces = cfg.DebugStackTraces
+	exposeCardLastFour = cfg.CardLastFour
+	traceNotifications = cfg.MetricsExemplars
+
+	db, err := initShards(cfg.DatabaseURLs, cfg.SkipSchemaInit, cfg.DeadLetterTable, cfg.ListenNotify, cfg.DBMinConns)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	registerPoolMetrics(db)
+	read, err := initReadShards(cfg.ReadDatabaseURLs, db, cfg.DBMinConns)
+	if err != nil {
+		return err
+	}
+	if read != db {
+		defer read.Close()
+	}
+	h := &Handler{db: db, read: read, dedupeWindow: cfg.DedupeWindow, adminKey: cfg.AdminAPIKey, allowedHosts: cfg.AllowedWebsiteHosts, acquireTimeout: cfg.DBAcquireTimeout, instanceID: cfg.InstanceID, multiTenant: cfg.MultiTenant}
+	h.deadLetters = cfg.DeadLetterTable || !cfg.SkipSchemaInit
+	if cfg.AuditRaw {
+		h.auditRawMax = cfg.AuditRawMaxBytes
+		h.auditCompress = cfg.AuditRawCompress
+	}
+	if h.regions, err = parseRegionMap(cfg.RegionMap); err != nil {
+		return err
+	}
+	h.allowedRegions = cfg.AllowedRegions
+	if h.allowedBINs, err = parseBINRanges(cfg.AllowedBINs); err != nil {
+		return err
+	}
+	h.pings.ttl = cfg.ReadyPingTTL
+	h.config = cfg
+
+	workerCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	pool := NewPool(ctx, WorkerCount, db)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/event", h.Event)
+	notifier, err := newNotifier(workerCtx, cfg)
+	if err != nil {
+		return err
+	}
+	hook := NewStatusHook(workerCtx, cfg.StatusWebhookURL, newNotifyClient(cfg.NotifyInsecureSkipVerify, StatusHookTimeout))
+	h.hook = hook
+	window, err := parseTimeWindow(cfg.NotifyWindow, cfg.NotifyTimezone)
+	if err != nil {
+		return err
+	}
+	retries, err := parseRetrySchedule(cfg.RetrySchedule)
+	if err != nil {
+		return err
+	}
+	typeLimits, err := parseTypeLimits(cfg.OrderTypeConcurrency)
+	if err != nil {
+		return err
+	}
+	var events *eventLog
+	if cfg.EventLogFile != "" {
+		if events, err = openEventLog(cfg.EventLogFile, cfg.EventLogMaxBytes); err != nil {
+			return fmt.Errorf("open event log: %w", err)
+		}
+		defer events.Close()
+	}
+	var leader *leaderLock
+	if cfg.LeaderElection {
+		leader = newLeaderLock(db.All()[0], cfg.LeaderLockKey, cfg.LeaderCheckInterval)
+	}
+	pool := NewPool(workerCtx, cfg.WorkerCount, db, PoolOptions{
+		Limiter:       NewRateLimiter(cfg.NotifyRate, cfg.NotifyBurst),
+		Notifier:      notifier,
+		Degraded:      cfg.DegradedMode,
+		Hook:          hook,
+		StaleAfter:    cfg.WorkerStaleAfter,
+		Interval:      cfg.PollInterval,
+		Window:        window,
+		BatchSize:     cfg.BatchSize,
+		MaxInFlight:   cfg.MaxInFlight,
+		Retries:       retries,
+		Leader:        leader,
+		TypeLimits:    typeLimits,
+		SessionFIFO:   cfg.SessionFIFO,
+		AtMostOnce:    cfg.Delivery == "at-most-once",
+		DeadLetter:    cfg.DeadLetterTable,
+		Sequential:    cfg.NotifyOrder == "sequential",
+		NotifyTimeout: cfg.NotifyTimeout,
+		EventLog:      events,
+		RampUp:        cfg.NotifyRampUp,
+		PriorityAging: cfg.PriorityAging,
+	})
+	h.pool = pool
+	go h.becomeReady(workerCtx)
+	newGaugeFunc("worker_oldest_heartbeat_seconds", "Seconds since the least recently active worker finished a poll.",
+		func() float64 { return pool.oldestHeartbeat().Seconds() })
+	if h.shedder = newLoadShedder(db, cfg.ShedPendingThreshold, cfg.ShedFraction); h.shedder != nil {
+		go h.shedder.run(workerCtx, cfg.ShedCheckInterval)
+	}
+	var backfilling sync.WaitGroup
+	if !cfg.SkipSchemaInit {
+		for _, shard := range db.All() {
+			backfilling.Add(1)
+			go func() {
+				defer backfilling.Done()
+				if err := backfill(workerCtx, shard); err != nil && !isShutdown(workerCtx, err) {
+					log.Println("Backfill failed, resuming on next start:", err)
+				}
+			}()
+		}
+	}
+	var consuming sync.WaitGroup
+	if cfg.QueueConsumer != "" {
+		consumer, err := newConsumer(cfg.QueueConsumer)
+		if err != nil {
+			return err
+		}
+		consuming.Add(1)
+		go func() {
+			defer consuming.Done()
+			h.Consume(workerCtx, consumer)
+		}()
+	}
+	if cfg.MaxPendingAge > 0 {
+		pool.StartPendingExpiry(workerCtx, cfg.MaxPendingAge, cfg.PendingCheckInterval)
+	}
+	if cfg.ListenNotify {
+		pool.StartListener(workerCtx)
+	}
+	if cfg.StuckAfter > 0 {
+		pool.StartStuckReaper(workerCtx, cfg.StuckAfter, cfg.PendingCheckInterval)
+	}
 
-	server := &http.Server{
-		Addr: ":8080",
-		Handler: mux,
+	handler := h.routes()
+	if cfg.GzipMinSize > 0 {
+		handler = gzipResponses(handler, cfg.GzipMinSize)
+	}
+	if cfg.ConcurrencyLimit > 0 {
+		handler = limitConcurrency(handler, cfg.ConcurrencyLimit)
 	}
+	server := newServer(cfg, withRequestID(handler))
 
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-		<-sig
+	// Every way out of run goes through shutdown, and sync.OnceFunc makes
+	// sure workers and server are only stopped once whichever path gets
+	// there first. The deferred database closes run after it.
+	shutdown := sync.OnceFunc(func() {
 		log.Println("Shutting down server...")
-
 		cancel()
 		pool.wg.Wait()
+		consuming.Wait()
+		backfilling.Wait()
 
-		ctx1, cancel1 := context.WithTimeout(context.Background(), 10 * time.Second)
-		defer cancel1()
-
-		if err := server.Shutdown(ctx1); err != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelShutdown()
+		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Println("Error shutting down server:", err)
 		}
-
-		db.Close()
 		log.Println("Server stopped.")
+	})
+	defer shutdown()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Println("HTTP Server runnig on port", cfg.Port)
+		serveErr <- server.ListenAndServe()
 	}()
 
-	log.Println("HTTP Server runnig on port 8080")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	select {
+	case err := <-serveErr:
+		// The listener failed before shutdown was requested.
+		shutdown()
+		return err
+	case <-ctx.Done():
 	}
+	shutdown()
+	return nil
 }
 
-func sendNotification(ctx context.Context, db *pgxpool.Pool, event PGCartEvent) {
-	time.Sleep(2 * time.Second) // Simulate external Notify Service Call
-	log.Printf("NOTIFY: Order %s for card %s",
-		event.OrderType, event.Card)
+// newServer returns the HTTP server for handler with the SERVER_*_TIMEOUT
+// settings applied.
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+func (h *Handler) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/event", h.shedding(h.tenantScoped(h.Event)))
+	mux.Handle("GET /metrics", metrics)
+	mux.HandleFunc("GET /healthz", h.Healthz)
+	mux.HandleFunc("GET /readyz", h.Readyz)
+	mux.HandleFunc("GET /workers", h.Workers)
+	mux.HandleFunc("POST /events/batch", h.shedding(h.tenantScoped(h.Batch)))
+	mux.HandleFunc("GET /events", h.tenantScoped(h.List))
+	mux.HandleFunc("GET /events/export", h.tenantScoped(h.Export))
+	mux.HandleFunc("GET /events/{id}", h.tenantScoped(h.Get))
+	mux.HandleFunc("GET /events/{id}/attempts", h.tenantScoped(h.Attempts))
+	mux.HandleFunc("GET /events/{id}/raw", h.adminOnly(h.tenantScoped(h.RawPayload)))
+	mux.HandleFunc("GET /dead-letters", h.tenantScoped(h.DeadLetters))
+	mux.HandleFunc("GET /admin/config", h.adminOnly(h.Config))
+	mux.HandleFunc("POST /admin/requeue", h.adminOnly(h.Requeue))
+	mux.HandleFunc("POST /admin/poll", h.adminOnly(h.Poll))
+	mux.HandleFunc("POST /admin/reprocess", h.adminOnly(h.Reprocess))
+	return mux
+}
+
+var exhaustedNotifications = newCounter("notifications_exhausted_total",
+	"Events that used up RETRY_SCHEDULE and were marked failed or dead-lettered.")
+
+var degradedNotifications = newCounter("notifications_degraded_total",
+	"Events marked processed without delivery while the downstream was down.")
+
+var notificationDuration = newHistogram("notification_duration_seconds",
+	"Time taken by one notification attempt, successful or not.",
+	[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
 
-	_, err := db.Exec(ctx, "UPDATE cart_events SET status = 'processed' WHERE id = $1", event.ID)
+func (p *Pool) sendNotification(ctx context.Context, db *pgxpool.Pool, event PGCartEvent) {
+	if !p.window.Contains(time.Now()) {
+		p.requeue(db, event)
+		return
+	}
+	if event.NotifiedAt != nil {
+		// Delivered by a worker that died before marking it processed and
+		// then reclaimed; don't notify the user twice.
+		p.markProcessed(db, event)
+		return
+	}
+	if p.atMostOnce && !p.setProcessed(db, event) {
+		return
+	}
+
+	notifyCtx := ctx
+	if p.notifyTimeout > 0 {
+		var cancel context.CancelFunc
+		notifyCtx, cancel = context.WithTimeout(ctx, p.notifyTimeout)
+		defer cancel()
+	}
+	if traceNotifications {
+		notifyCtx = withNewTrace(notifyCtx)
+	}
+	start := time.Now()
+	err := safeNotify(notifyCtx, p.notifier, event)
+	notificationDuration.Observe(time.Since(start).Seconds(), traceID(notifyCtx))
+	p.ramp.observe(err)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		// Our own deadline rather than shutdown, so isShutdown below
+		// doesn't match and the event spends a retry.
+		err = fmt.Errorf("notification took longer than %s: %w", p.notifyTimeout, err)
+	}
+	if err == nil {
+		// Record delivery first so a crash from here on can't cause a
+		// second notification.
+		_, dbErr := db.Exec(context.Background(), "UPDATE cart_events SET notified_at = CURRENT_TIMESTAMP WHERE id = $1", event.ID)
+		if dbErr != nil {
+			log.Println("Failed to record notification time:", dbErr.Error())
+		}
+	}
+	if !isShutdown(ctx, err) {
+		recordAttempt(db, event.ID, err)
+	}
+	if p.degraded && errors.Is(err, ErrCircuitOpen) {
+		log.Printf("NOTIFY (degraded): Order %s for card %s",
+			event.OrderType, event.Card)
+		_, err = db.Exec(context.Background(), "UPDATE cart_events SET status = 'processed', degraded = true WHERE id = $1", event.ID)
+		if err != nil {
+			log.Println("Failed to update event status:", err.Error())
+			return
+		}
+		degradedNotifications.Inc()
+		if !p.atMostOnce {
+			p.hook.Fire(event.ID, "processing", "processed")
+		}
+		return
+	}
+	if err != nil && p.atMostOnce {
+		// Already processed, and trying again could notify twice.
+		p.abandon(db, event, err)
+		return
+	}
+	if isShutdown(ctx, err) {
+		// Interrupted, not refused: don't spend a retry on it.
+		p.requeue(db, event)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to notify event %s: %v", event.ID, err)
+		p.retry(db, event, err)
+		return
+	}
+
+	if p.atMostOnce {
+		p.logProcessed(event)
+		return
+	}
+	p.markProcessed(db, event)
+}
+
+func (p *Pool) requeue(db *pgxpool.Pool, event PGCartEvent) {
+	_, err := db.Exec(context.Background(), "UPDATE cart_events SET status = 'pending' WHERE id = $1", event.ID)
+	if err != nil {
+		log.Println("Failed to re-queue event:", err.Error())
+		return
+	}
+	p.hook.Fire(event.ID, "processing", "pending")
+}
+
+// requeueAll puts claimed events that were never sent back to pending in
+// one statement.
+func (p *Pool) requeueAll(db *pgxpool.Pool, events []PGCartEvent) {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	p.requeueIDs(db, ids)
+}
+
+// requeueIDs puts the given processing events back to pending.
+func (p *Pool) requeueIDs(db *pgxpool.Pool, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	_, err := db.Exec(context.Background(), "UPDATE cart_events SET status = 'pending' WHERE id = ANY($1::uuid[]) AND status = 'processing'", ids)
+	if err != nil {
+		log.Println("Failed to re-queue unsent events:", err.Error())
+		return
+	}
+	for _, id := range ids {
+		p.hook.Fire(id, "processing", "pending")
+	}
+}
+
+// retry reschedules a failed notification according to p.retries, or
+// dead-letters the event as failed once the schedule is exhausted. When
+// the downstream asked for a Retry-After, that wait replaces the
+// schedule's delay.
+func (p *Pool) retry(db *pgxpool.Pool, event PGCartEvent, cause error) {
+	delay, ok := p.retries.Next(event.RetryCount)
+	var retryAfter *RetryAfterError
+	if ok && errors.As(cause, &retryAfter) {
+		delay = retryAfter.After
+	}
+	if !ok {
+		reason := fmt.Sprintf("notification failed after %d retries", event.RetryCount)
+		var err error
+		if p.deadLetter {
+			err = moveToDeadLetter(db, event, reason)
+		} else {
+			_, err = db.Exec(context.Background(), `
+			UPDATE cart_events SET status = 'failed', failure_reason = $2 WHERE id = $1`,
+				event.ID, reason)
+		}
+		if err != nil {
+			log.Println("Failed to dead-letter event:", err.Error())
+			return
+		}
+		// Logged in key=value form with a fixed message so alerting rules
+		// can match it; only once the event is settled as failed, so a
+		// failed write retried later can't report it twice.
+		exhaustedNotifications.Inc()
+		log.Printf("notification_exhausted event_id=%s retries=%d last_error=%q", event.ID, event.RetryCount, cause.Error())
+		p.hook.Fire(event.ID, "processing", "failed")
+		return
+	}
+	_, err := db.Exec(context.Background(), `
+	UPDATE cart_events
+	SET status = 'pending', retry_count = retry_count + 1,
+		process_after = CURRENT_TIMESTAMP + make_interval(secs => $2)
+	WHERE id = $1`, event.ID, delay.Seconds())
+	if err != nil {
+		log.Println("Failed to re-queue event:", err.Error())
+		return
+	}
+	p.hook.Fire(event.ID, "processing", "pending")
+}
+
+// abandon settles an at-most-once event whose notification failed after
+// it was marked processed: it becomes failed, or is dead-lettered, and is
+// not retried.
+func (p *Pool) abandon(db *pgxpool.Pool, event PGCartEvent, cause error) {
+	reason := fmt.Sprintf("notification failed with DELIVERY=at-most-once: %v", cause)
+	var err error
+	if p.deadLetter {
+		err = moveToDeadLetter(db, event, reason)
+	} else {
+		_, err = db.Exec(context.Background(), `
+		UPDATE cart_events SET status = 'failed', failure_reason = $2 WHERE id = $1`,
+			event.ID, reason)
+	}
+	if err != nil {
+		log.Println("Failed to mark event failed:", err.Error())
+		return
+	}
+	log.Printf("Failed to notify event %s, not retrying in at-most-once mode: %v", event.ID, cause)
+	p.hook.Fire(event.ID, "processed", "failed")
+}
+
+// markProcessed settles a delivered event as processed and logs it.
+func (p *Pool) markProcessed(db *pgxpool.Pool, event PGCartEvent) {
+	if p.setProcessed(db, event) {
+		p.logProcessed(event)
+	}
+}
+
+// setProcessed marks event processed. Like requeue and retry it writes
+// with a fresh context, so an event notified just before shutdown is
+// still recorded instead of being left processing.
+func (p *Pool) setProcessed(db *pgxpool.Pool, event PGCartEvent) bool {
+	_, err := db.Exec(context.Background(), "UPDATE cart_events SET status = 'processed' WHERE id = $1", event.ID)
 	if err != nil {
 		log.Println("Failed to update event status:", err.Error())
+		return false
+	}
+	p.hook.Fire(event.ID, "processing", "processed")
+	return true
+}
+
+// logProcessed writes a delivered event to the event log, if there is one.
+func (p *Pool) logProcessed(event PGCartEvent) {
+	if p.eventLog == nil {
+		return
 	}
+	if err := p.eventLog.Append(event); err != nil {
+		log.Printf("Failed to write event %s to the event log: %v", event.ID, err)
+	}
+}
+
+// safeNotify turns a panicking notifier into a failed attempt so the
+// worker goroutine survives and the event is re-queued.
+func safeNotify(ctx context.Context, notifier Notifier, event PGCartEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Notifier panicked on event %s: %v\n%s", event.ID, r, debug.Stack())
+			err = fmt.Errorf("notifier panic: %v", r)
+		}
+	}()
+	return notifier.Notify(ctx, event)
 }
 
+// isShutdown reports whether err is just the worker's own context being
+// canceled, which is expected on shutdown and not worth logging.
+func isShutdown(ctx context.Context, err error) bool {
+	return ctx.Err() != nil &&
+		(errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded))
+}
+
+// prettyJSON indents every response, set from PRETTY_JSON for local
+// debugging.
+var prettyJSON bool
+
 func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	w.Header().Add("Content-Type", "application/json")
-	return json.NewEncoder(w).Encode(v)
+	enc := json.NewEncoder(w)
+	if prettyJSON {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
 }
@@ -0,0 +1,1330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// fakeQueue answers the claim query with up to LIMIT of rows that are
+// still pending, marking them processing, and records the status the
+// service moves each of them to.
+type fakeQueue struct {
+	mu       sync.Mutex
+	rows     [][]any
+	statuses map[string]string
+}
+
+var (
+	setStatus  = regexp.MustCompile(`SET status = '(\w+)'`)
+	claimLimit = regexp.MustCompile(`LIMIT\s+'?(\d+)`)
+)
+
+func (q *fakeQueue) handle(sql string) fakeResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.statuses == nil {
+		q.statuses = map[string]string{}
+	}
+	if strings.Contains(sql, "WITH cte AS") {
+		limit, _ := strconv.Atoi(claimLimit.FindStringSubmatch(sql)[1])
+		var due [][]any
+		for _, row := range q.rows {
+			id := row[0].(string)
+			if status := q.statuses[id]; (status == "" || status == "pending") && len(due) < limit {
+				q.statuses[id] = "processing"
+				due = append(due, row)
+			}
+		}
+		return fakeEvents(due...)
+	}
+	if m := setStatus.FindStringSubmatch(sql); m != nil {
+		for _, row := range q.rows {
+			if id := row[0].(string); strings.Contains(sql, id) {
+				q.statuses[id] = m[1]
+			}
+		}
+	}
+	return fakeResult{tag: "UPDATE 1"}
+}
+
+// status returns the status id was last set to, empty if none.
+func (q *fakeQueue) status(id string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.statuses[id]
+}
+
+// requeued returns the ids set back to pending.
+func (q *fakeQueue) requeued() map[string]bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ids := map[string]bool{}
+	for id, status := range q.statuses {
+		if status == "pending" {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// notifierFunc adapts a function to Notifier.
+type notifierFunc func(ctx context.Context, event PGCartEvent) error
+
+func (f notifierFunc) Notify(ctx context.Context, event PGCartEvent) error { return f(ctx, event) }
+
+func TestClaimRequeuesUnscannableRows(t *testing.T) {
+	bad := fakeEventRow(fakeID(2))
+	bad[fakeColRetryCount] = "not a number"
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1)), bad, fakeEventRow(fakeID(3))}}
+	db := newFakePG(t, queue.handle).pool(t)
+
+	p := &Pool{}
+	events, claimed, err := p.claimOnce(context.Background(), db, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed != 3 {
+		t.Errorf("claimed = %d, want 3", claimed)
+	}
+	if len(events) != 2 || events[0].ID != fakeID(1) || events[1].ID != fakeID(3) {
+		t.Errorf("events = %+v, want the two readable rows", events)
+	}
+	if got := queue.requeued(); len(got) != 1 || !got[fakeID(2)] {
+		t.Errorf("re-queued %v, want only %s", got, fakeID(2))
+	}
+}
+
+func TestNotifiedClaimRequeuesUnscannableRow(t *testing.T) {
+	bad := fakeEventRow(fakeID(1))
+	bad[fakeColRetryCount] = "not a number"
+	queue := &fakeQueue{rows: [][]any{bad}}
+	db := newFakePG(t, func(sql string) fakeResult {
+		res := queue.handle(sql)
+		if strings.Contains(sql, "SET status = 'processing'") {
+			return fakeEvents(bad)
+		}
+		return res
+	}).pool(t)
+	captureLog(t)
+
+	sent := false
+	p := &Pool{notifier: notifierFunc(func(context.Context, PGCartEvent) error {
+		sent = true
+		return nil
+	})}
+	p.processNotified(context.Background(), db, fakeID(1))
+	if sent {
+		t.Error("unreadable row was sent")
+	}
+	if got := queue.status(fakeID(1)); got != "pending" {
+		t.Errorf("status = %q, want the claimed row back in pending", got)
+	}
+}
+
+func TestClaimRequeuesRowsOfLostResult(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1)), fakeEventRow(fakeID(2))}}
+	var dropped atomic.Bool
+	db := newFakePG(t, func(sql string) fakeResult {
+		res := queue.handle(sql)
+		if strings.Contains(sql, "WITH cte AS") && dropped.CompareAndSwap(false, true) {
+			res.drop = true
+		}
+		return res
+	}).pool(t)
+
+	p := &Pool{}
+	if _, _, err := p.claimOnce(context.Background(), db, 10); err == nil {
+		t.Fatal("claim succeeded on a dropped connection")
+	}
+	if got := queue.requeued(); len(got) != 2 {
+		t.Errorf("re-queued %v, want both rows read before the connection dropped", got)
+	}
+}
+
+func TestClaimReleasesConnection(t *testing.T) {
+	bad := fakeEventRow(fakeID(2))
+	bad[fakeColRetryCount] = "not a number"
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1)), bad}}
+	db := newFakePG(t, queue.handle).pool(t)
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	p := &Pool{}
+	for i := 0; i < 200; i++ {
+		if _, _, err := p.claimOnce(context.Background(), db, 10); err != nil {
+			t.Fatal(err)
+		}
+		if n := db.Stat().AcquiredConns(); n != 0 {
+			t.Fatalf("after claim %d: %d connections still acquired", i+1, n)
+		}
+	}
+	if n := db.Stat().TotalConns(); n > 2 {
+		t.Errorf("pool holds %d connections, want at most 2 for sequential claims", n)
+	}
+}
+
+func TestProcessSettlesEventsNotifiedDuringShutdown(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1)), fakeEventRow(fakeID(2))}}
+	db := newFakePG(t, queue.handle).pool(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var once sync.Once
+	p := &Pool{batchSize: 10, notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+		// Shutdown starts while the batch is being delivered.
+		once.Do(cancel)
+		return nil
+	})}
+	if _, err := p.process(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{fakeID(1), fakeID(2)} {
+		if got := queue.status(id); got != "processed" {
+			t.Errorf("event %s: status %q, want processed", id, got)
+		}
+	}
+}
+
+func TestWorkerCancelLogsNoError(t *testing.T) {
+	claiming := make(chan struct{})
+	unblock := make(chan struct{})
+	var once sync.Once
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "WITH cte AS") {
+			// Hold the claim until the worker is canceled mid-query.
+			once.Do(func() { close(claiming) })
+			<-unblock
+		}
+		return fakeResult{tag: "UPDATE 0"}
+	})
+	t.Cleanup(func() { close(unblock) })
+	logs := captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPool(ctx, 1, NewHashRouter(f.pool(t)), PoolOptions{BatchSize: 10, Interval: time.Millisecond})
+	select {
+	case <-claiming:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never polled")
+	}
+	cancel()
+	p.wg.Wait()
+
+	if strings.Contains(logs.String(), "Error") {
+		t.Errorf("canceling the worker logged an error:\n%s", logs)
+	}
+}
+
+func TestEventRejectsDeeplyNestedPayload(t *testing.T) {
+	nested := strings.Repeat("[", 4000) + strings.Repeat("]", 4000)
+	for name, body := range map[string]string{
+		"unknown field": validEvent(`"extra":` + nested),
+		"known field":   validEvent(`"delaySeconds":` + nested),
+		"top level":     nested,
+		"nested object": validEvent(`"extra":` + strings.Repeat(`{"a":`, 2000) + "1" + strings.Repeat("}", 2000)),
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		// No database: anything that got past decoding would panic.
+		(&Handler{}).Event(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, rec.Code)
+		}
+	}
+}
+
+func TestEventRejectsTrailingData(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		h.Event(rec, req)
+		return rec.Code
+	}
+
+	for name, body := range map[string]string{
+		"garbage":       validEvent("") + "garbage",
+		"second object": validEvent("") + validEvent(""),
+		"second value":  validEvent("") + " 1",
+		"closing brace": validEvent("") + "}",
+	} {
+		if code := post(body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, code)
+		}
+	}
+	if code := post(validEvent("") + " \n\t"); code != http.StatusOK {
+		t.Errorf("trailing whitespace: status %d, want 200", code)
+	}
+	if n := len(f.Queries()); n != 1 {
+		t.Errorf("%d queries, want only the valid event stored", n)
+	}
+}
+
+func TestEventContentType(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db}
+
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"Application/JSON", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json-patch+json", http.StatusUnsupportedMediaType},
+		{"application/json;;", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(validEvent("")))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		h.Event(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Content-Type %q: status %d, want %d", tt.contentType, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusUnsupportedMediaType {
+			var body struct{ Error string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("Content-Type %q: body %s, want a JSON error", tt.contentType, rec.Body)
+			}
+		}
+	}
+	if n := len(f.Queries()); n != 3 {
+		t.Errorf("%d queries, want only the three JSON events stored", n)
+	}
+}
+
+func TestWorkerSurvivesPanickingNotifier(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+	f := newFakePG(t, queue.handle)
+	captureLog(t)
+
+	var calls atomic.Int32
+	notifier := notifierFunc(func(context.Context, PGCartEvent) error {
+		if calls.Add(1) == 1 {
+			panic("notifier bug")
+		}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewPool(ctx, 1, NewHashRouter(f.pool(t)), PoolOptions{BatchSize: 10, Interval: time.Hour, Notifier: notifier})
+
+	pollCtx, stop := context.WithTimeout(ctx, 5*time.Second)
+	defer stop()
+	if _, err := p.PollNow(pollCtx); err != nil {
+		t.Fatal(err)
+	}
+	if got := queue.status(fakeID(1)); got != "pending" {
+		t.Errorf("after the panic the event is %q, want pending", got)
+	}
+	// The only worker must still be there to take the second poll.
+	if _, err := p.PollNow(pollCtx); err != nil {
+		t.Fatalf("worker gone after the notifier panicked: %v", err)
+	}
+	if got := queue.status(fakeID(1)); got != "processed" {
+		t.Errorf("after the retry the event is %q, want processed", got)
+	}
+}
+
+func TestDegradedModeDuringOutage(t *testing.T) {
+	for _, degraded := range []bool{false, true} {
+		var rows [][]any
+		for i := 1; i <= 10; i++ {
+			rows = append(rows, fakeEventRow(fakeID(i)))
+		}
+		queue := &fakeQueue{rows: rows}
+		db := newFakePG(t, queue.handle).pool(t)
+		captureLog(t)
+
+		var calls atomic.Int32
+		down := notifierFunc(func(context.Context, PGCartEvent) error {
+			calls.Add(1)
+			return errors.New("connection refused")
+		})
+		p := &Pool{batchSize: 10, sequential: true, degraded: degraded, notifier: NewCircuitBreaker(down, 2, time.Hour)}
+		before := degradedNotifications.Value()
+		// The downstream stays down for several polls.
+		for i := 0; i < 3; i++ {
+			if _, err := p.process(context.Background(), db); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if n := calls.Load(); n != 2 {
+			t.Errorf("degraded=%v: downstream called %d times, want 2 before the breaker opened", degraded, n)
+		}
+		want, wantDegraded := "pending", uint64(0)
+		if degraded {
+			want, wantDegraded = "processed", 10
+		}
+		for _, row := range rows {
+			if got := queue.status(row[0].(string)); got != want {
+				t.Errorf("degraded=%v: event %s is %q, want %s", degraded, row[0], got, want)
+			}
+		}
+		if n := degradedNotifications.Value() - before; n != wantDegraded {
+			t.Errorf("degraded=%v: %d events counted degraded, want %d", degraded, n, wantDegraded)
+		}
+	}
+}
+
+func TestRestartRaceDoesNotNotifyTwice(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+	var mu sync.Mutex
+	notified, killed := false, false
+	db := newFakePG(t, func(sql string) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(sql, "SET notified_at"):
+			notified = true
+		case strings.Contains(sql, "SET status = 'processed'") && !killed:
+			// The worker dies between notifying and settling the event;
+			// the reaper later puts it back to pending.
+			killed = true
+			queue.handle("UPDATE cart_events SET status = 'pending' WHERE id = '" + fakeID(1) + "'")
+			return fakeResult{err: pgError("57P01", "terminating connection due to administrator command")}
+		case strings.Contains(sql, "WITH cte AS"):
+			res := queue.handle(sql)
+			for _, row := range res.rows {
+				if notified {
+					row[fakeColNotifiedAt] = "2024-01-01 00:00:01+00"
+				}
+			}
+			return res
+		}
+		return queue.handle(sql)
+	}).pool(t)
+	captureLog(t)
+
+	var calls atomic.Int32
+	p := &Pool{batchSize: 10, notifier: notifierFunc(func(context.Context, PGCartEvent) error {
+		calls.Add(1)
+		return nil
+	})}
+	for i := 0; i < 2; i++ {
+		if _, err := p.process(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("notified %d times, want once", n)
+	}
+	if got := queue.status(fakeID(1)); got != "processed" {
+		t.Errorf("reclaimed event is %q, want processed", got)
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	defer func() { prettyJSON = false }()
+	v := map[string]any{"status": "ok", "counts": []int{1, 2}}
+	for _, pretty := range []bool{false, true} {
+		prettyJSON = pretty
+		rec := httptest.NewRecorder()
+		if err := writeJSON(rec, http.StatusCreated, v); err != nil {
+			t.Fatal(err)
+		}
+		want := `{"counts":[1,2],"status":"ok"}` + "\n"
+		if pretty {
+			want = "{\n  \"counts\": [\n    1,\n    2\n  ],\n  \"status\": \"ok\"\n}\n"
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("pretty=%v: body %q, want %q", pretty, got, want)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" || rec.Code != http.StatusCreated {
+			t.Errorf("pretty=%v: %d with Content-Type %q", pretty, rec.Code, ct)
+		}
+	}
+}
+
+// serviceDB answers the queries run makes against an empty database.
+func serviceDB(sql string) fakeResult {
+	switch {
+	case strings.Contains(sql, "WITH cte AS"):
+		return fakeEvents()
+	case strings.Contains(sql, "INSERT INTO cart_events"):
+		return fakeResult{tag: "INSERT 0 1"}
+	case strings.Contains(sql, "SELECT EXISTS"):
+		// Neither the notify trigger nor a finished backfill exists yet.
+		return fakeResult{columns: []fakeColumn{{"exists", pgtype.BoolOID}}, rows: [][]any{{"f"}}}
+	}
+	return fakeResult{}
+}
+
+// freePort returns a TCP port nothing is listening on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startService runs the service against databaseURL until the returned
+// stop is called, which returns run's result. It waits for /readyz.
+func startService(t *testing.T, databaseURL string) (base string, stop func() error) {
+	t.Helper()
+	port := freePort(t)
+	cfg := testConfig(t, map[string]string{
+		"DATABASE_URL":  databaseURL,
+		"PORT":          strconv.Itoa(port),
+		"POLL_INTERVAL": "10ms",
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- run(ctx, cfg) }()
+	stop = func() error {
+		cancel()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(15 * time.Second):
+			t.Fatal("run didn't return after cancel")
+			return nil
+		}
+	}
+
+	base = fmt.Sprintf("http://127.0.0.1:%d", port)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(base + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return base, stop
+			}
+		}
+		select {
+		case err := <-result:
+			t.Fatalf("run returned during startup: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatal("service never became ready")
+		}
+	}
+}
+
+func TestRunShutsDownCleanly(t *testing.T) {
+	f := newFakePG(t, serviceDB)
+	logs := captureLog(t)
+	_, stop := startService(t, f.URL())
+	if err := stop(); err != nil {
+		t.Errorf("graceful shutdown returned %v, want nil", err)
+	}
+	if !strings.Contains(logs.String(), "Server stopped.") {
+		t.Errorf("no clean stop logged:\n%s", logs)
+	}
+}
+
+func TestRunReportsListenFailure(t *testing.T) {
+	f := newFakePG(t, serviceDB)
+	captureLog(t)
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := testConfig(t, map[string]string{
+		"DATABASE_URL": f.URL(),
+		"PORT":         strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+	})
+
+	result := make(chan error, 1)
+	go func() { result <- run(context.Background(), cfg) }()
+	select {
+	case err := <-result:
+		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("run with the port taken returned %v, want the listen error", err)
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("run kept going with its port taken")
+	}
+}
+
+func TestRunShutsDownOnce(t *testing.T) {
+	// Both ways out of run call shutdown and defer it again; the second
+	// call must be a no-op.
+	f := newFakePG(t, serviceDB)
+	logs := captureLog(t)
+	_, stop := startService(t, f.URL())
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Shutting down server...", "Server stopped."} {
+		if n := strings.Count(logs.String(), line); n != 1 {
+			t.Errorf("%q logged %d times on cancel:\n%s", line, n, logs)
+		}
+	}
+
+	logs.Reset()
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := testConfig(t, map[string]string{
+		"DATABASE_URL": f.URL(),
+		"PORT":         strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+	})
+	if err := run(context.Background(), cfg); err == nil {
+		t.Fatal("run with the port taken returned nil")
+	}
+	if n := strings.Count(logs.String(), "Shutting down server..."); n != 1 {
+		t.Errorf("shutdown ran %d times after a listen failure:\n%s", n, logs)
+	}
+}
+
+func TestRunServesUntilShutdown(t *testing.T) {
+	f := newFakePG(t, serviceDB)
+	captureLog(t)
+	base, stop := startService(t, f.URL())
+
+	resp, err := http.Post(base+"/event", "application/json", strings.NewReader(validEvent("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /event: %d, want 200", resp.StatusCode)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Error("server still answering after run returned")
+	}
+	// Workers are stopped too: no more polls once run is back.
+	polls := len(f.Queries())
+	time.Sleep(50 * time.Millisecond)
+	if n := len(f.Queries()); n != polls {
+		t.Errorf("%d queries after shutdown", n-polls)
+	}
+}
+
+func TestRunAgainstTestDatabase(t *testing.T) {
+	db := testDB(t)
+	captureLog(t)
+	base, stop := startService(t, os.Getenv("TEST_DATABASE_URL"))
+
+	resp, err := http.Post(base+"/event", "application/json", strings.NewReader(validEvent("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /event: %d, want 200", resp.StatusCode)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	var stored int
+	if err := db.QueryRow(context.Background(), "SELECT COUNT(*) FROM cart_events").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 1 {
+		t.Errorf("%d events stored, want 1", stored)
+	}
+}
+
+func TestBatchFailuresRequeueOnlyFailedEvents(t *testing.T) {
+	var rows [][]any
+	for i := 1; i <= 10; i++ {
+		rows = append(rows, fakeEventRow(fakeID(i)))
+	}
+	queue := &fakeQueue{rows: rows}
+	f := newFakePG(t, queue.handle)
+	captureLog(t)
+	failing := map[string]bool{fakeID(2): true, fakeID(5): true, fakeID(9): true}
+	p := &Pool{batchSize: 10, notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+		if failing[event.ID] {
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	})}
+	if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		id := row[0].(string)
+		want := "processed"
+		if failing[id] {
+			want = "pending"
+		}
+		if got := queue.status(id); got != want {
+			t.Errorf("event %s: status %q, want %s", id, got, want)
+		}
+	}
+	retried := 0
+	for _, q := range f.Queries() {
+		if strings.Contains(q, "retry_count = retry_count + 1") {
+			retried++
+		}
+	}
+	if retried != 3 {
+		t.Errorf("%d retries spent, want 3", retried)
+	}
+}
+
+// benchmarkEvent posts one event per iteration to Handler.Event.
+func benchmarkEvent(b *testing.B, db ShardRouter) {
+	h := &Handler{db: db, read: db}
+	body := queuedEvent("session-1")
+	post := func() {
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Event(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			post()
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				post()
+			}
+		})
+	})
+}
+
+// BenchmarkEventHandler measures the ingest path up to the database
+// round trip: decoding, validation and the insert through pgx, against a
+// fake server that answers instantly.
+func BenchmarkEventHandler(b *testing.B) {
+	f := newFakePG(b, func(sql string) fakeResult {
+		return fakeResult{tag: "INSERT 0 1"}
+	})
+	benchmarkEvent(b, NewHashRouter(f.pool(b)))
+}
+
+// BenchmarkEventHandlerDB is BenchmarkEventHandler against
+// TEST_DATABASE_URL, so it includes the real insert.
+func BenchmarkEventHandlerDB(b *testing.B) {
+	benchmarkEvent(b, NewHashRouter(testDB(b)))
+}
+
+func TestInsertEventLocksForDedupe(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, dedupeWindow: time.Minute}
+	event := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, q := range f.Queries() {
+		switch {
+		case strings.HasPrefix(strings.ToLower(q), "begin"), q == "commit":
+			got = append(got, strings.ToLower(q))
+		case strings.Contains(q, "pg_advisory_xact_lock"):
+			got = append(got, "lock")
+		case strings.Contains(q, "INSERT INTO cart_events"):
+			got = append(got, "insert")
+		}
+	}
+	if want := []string{"begin", "lock", "insert", "commit"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("statements = %v, want %v", got, want)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db, dedupeWindow: time.Minute}
+	ctx := context.Background()
+	event := func(card, orderType string) CartEvent {
+		return CartEvent{OrderType: orderType, SessionID: "session-1", Card: card, EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		event  CartEvent
+		stored bool
+	}{
+		{"first", event("4433**1409", "Purchase"), true},
+		{"duplicate", event("4433**1409", "Purchase"), false},
+		{"other card", event("4433**1410", "Purchase"), true},
+		{"other order type", event("4433**1409", "Refund"), true},
+	} {
+		stored, err := h.ingest(ctx, tt.event, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if stored != tt.stored {
+			t.Errorf("%s: stored = %v, want %v", tt.name, stored, tt.stored)
+		}
+	}
+}
+
+func TestDedupeConcurrentInserts(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db, dedupeWindow: time.Minute}
+	event := CartEvent{OrderType: "Purchase", SessionID: "session-1", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+
+	const n = 20
+	var wg sync.WaitGroup
+	var stored atomic.Int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := h.ingest(context.Background(), event, nil)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				stored.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	var rows int
+	if err := pool.QueryRow(context.Background(), "SELECT COUNT(*) FROM cart_events").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Load() != 1 || rows != 1 {
+		t.Errorf("%d of %d concurrent duplicates reported stored and %d rows exist, want 1", stored.Load(), n, rows)
+	}
+}
+
+// containsAll reports whether s contains every one of subs.
+func containsAll(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPollBackoff(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+	}{
+		{time.Second, 0, time.Second},
+		{time.Second, 1, 2 * time.Second},
+		{time.Second, 3, 8 * time.Second},
+		{time.Second, 5, MaxPollBackoff},
+		{time.Second, 1000, MaxPollBackoff},
+		{time.Minute, 3, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := pollBackoff(tt.interval, tt.failures); got != tt.want {
+			t.Errorf("pollBackoff(%v, %d) = %v, want %v", tt.interval, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestWorkerBacksOffOnRepeatedErrors(t *testing.T) {
+	var claims atomic.Int32
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "WITH cte AS") {
+			claims.Add(1)
+			return fakeResult{err: pgError("57P01", "terminating connection due to administrator command")}
+		}
+		return fakeResult{}
+	})
+	captureLog(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPool(ctx, 1, NewHashRouter(f.pool(t)), PoolOptions{BatchSize: 10, Interval: 10 * time.Millisecond})
+
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	p.wg.Wait()
+	// Polls at 10, 30, 70 and 150ms, then 310ms; a tight loop would
+	// claim hundreds of times and even a fixed interval about 30.
+	if n := claims.Load(); n < 2 || n > 6 {
+		t.Errorf("%d claims in 300ms of failures, want the interval doubling", n)
+	}
+	after := claims.Load()
+	time.Sleep(30 * time.Millisecond)
+	if n := claims.Load(); n != after {
+		t.Errorf("%d claims after the worker stopped", n-after)
+	}
+}
+
+func TestSessionFIFOClaimQuery(t *testing.T) {
+	for _, fifo := range []bool{false, true} {
+		queue := &fakeQueue{}
+		f := newFakePG(t, queue.handle)
+		p := &Pool{batchSize: 10, sessionFIFO: fifo}
+		if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+			t.Fatal(err)
+		}
+		var claim string
+		for _, q := range f.Queries() {
+			if strings.Contains(q, "WITH cte AS") {
+				claim = q
+			}
+		}
+		if got := strings.Contains(claim, sessionFIFOClause); got != fifo {
+			t.Errorf("SESSION_FIFO=%v: claim %q", fifo, claim)
+		}
+	}
+}
+
+func TestPriorityAgingClaimsAgedEventFirst(t *testing.T) {
+	db := testDB(t)
+	aged := seedEvent(t, db, "session-aged")
+	urgent := []string{seedEvent(t, db, "session-urgent-1"), seedEvent(t, db, "session-urgent-2")}
+	fresh := seedEvent(t, db, "session-fresh")
+	// With one level per minute the aged event is worth 0 + 10, ahead of
+	// the new priority 5 ones, while the fresh priority 0 one stays last.
+	for id, update := range map[string]string{
+		aged:      "priority = 0, process_after = CURRENT_TIMESTAMP - interval '10 minutes'",
+		urgent[0]: "priority = 5",
+		urgent[1]: "priority = 5",
+		fresh:     "priority = 0",
+	} {
+		if _, err := db.Exec(context.Background(), "UPDATE cart_events SET "+update+" WHERE id = $1", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := &Pool{priorityAging: time.Minute}
+	var order []string
+	for i := 0; i < 4; i++ {
+		events, _, err := p.claim(context.Background(), db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 {
+			t.Fatalf("claimed %d events, want 1", len(events))
+		}
+		order = append(order, events[0].ID)
+	}
+	if order[0] != aged {
+		t.Errorf("claimed %s first, want the aged event %s", order[0], aged)
+	}
+	if !slices.Contains(order[1:3], urgent[0]) || !slices.Contains(order[1:3], urgent[1]) || order[3] != fresh {
+		t.Errorf("claim order %v, want the urgent events %v before the fresh one %s", order, urgent, fresh)
+	}
+}
+
+func TestSessionFIFOOrdersSessionEvents(t *testing.T) {
+	db := testDB(t)
+	first := seedEvent(t, db, "session-1")
+	second := seedEvent(t, db, "session-1")
+	other := seedEvent(t, db, "session-2")
+	// The second event is created later but sorts first by id half the
+	// time; only created_at may decide.
+	for id, createdAt := range map[string]string{first: "2024-01-01 00:00:00Z", second: "2024-01-01 00:00:01Z", other: "2024-01-01 00:00:00Z"} {
+		if _, err := db.Exec(context.Background(), "UPDATE cart_events SET created_at = $2 WHERE id = $1", id, createdAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var order []string
+	busy := map[string]bool{}
+	p := &Pool{batchSize: 10, sessionFIFO: true, notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+		mu.Lock()
+		if busy[event.SessionID] {
+			t.Errorf("two events of %s sent at once", event.SessionID)
+		}
+		busy[event.SessionID] = true
+		order = append(order, event.ID)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		busy[event.SessionID] = false
+		mu.Unlock()
+		return nil
+	})}
+
+	// Two workers poll side by side until everything is sent.
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(5 * time.Second)
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := len(order) == 3
+				mu.Unlock()
+				if done {
+					return
+				}
+				if _, err := p.process(context.Background(), db); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var session []string
+	for _, id := range order {
+		if id != other {
+			session = append(session, id)
+		}
+	}
+	if len(order) != 3 || len(session) != 2 || session[0] != first || session[1] != second {
+		t.Errorf("sent %v, want %s before %s", order, first, second)
+	}
+}
+
+func TestMinConnsOpenAfterWarmUp(t *testing.T) {
+	for _, minConns := range []int{0, 4} {
+		f := newFakePG(t, nil)
+		db, err := connectDB(f.URL(), minConns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Checked straight away: the warm-up must not leave it to the
+		// background top-up, which races it and may add one more.
+		idle := int(db.Stat().IdleConns())
+		db.Close()
+		if idle < minConns || (minConns == 0 && idle != 0) {
+			t.Errorf("DB_MIN_CONNS=%d: %d idle connections after connect", minConns, idle)
+		}
+	}
+}
+
+func TestInsertRecordsInstanceID(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} })
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, instanceID: "events-7f9c"}
+	event := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, nil); err != nil {
+		t.Fatal(err)
+	}
+	if q := f.Queries(); len(q) != 1 || !containsAll(q[0], "instance_id", "'events-7f9c'") {
+		t.Errorf("queries = %q, want the instance ID inserted", q)
+	}
+}
+
+func TestInstanceIDStored(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db, instanceID: "events-7f9c"}
+	event := CartEvent{OrderType: "Purchase", SessionID: "s", Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, nil); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	if err := pool.QueryRow(context.Background(), "SELECT id FROM cart_events").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, httptest.NewRequest("GET", "/events/"+id, nil))
+	if !strings.Contains(rec.Body.String(), `"instanceId":"events-7f9c"`) {
+		t.Errorf("get: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestDeliveryModeOrdering(t *testing.T) {
+	tests := []struct {
+		atMostOnce bool
+		markFails  bool
+		want       []string
+	}{
+		{atMostOnce: false, want: []string{"notify", "notified_at", "processed"}},
+		{atMostOnce: true, want: []string{"processed", "notify", "notified_at"}},
+		// A crash or error before notifying loses the notification
+		// rather than risk sending it twice.
+		{atMostOnce: true, markFails: true, want: []string{"processed"}},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var steps []string
+		step := func(s string) {
+			mu.Lock()
+			defer mu.Unlock()
+			steps = append(steps, s)
+		}
+		f := newFakePG(t, func(sql string) fakeResult {
+			switch {
+			case strings.Contains(sql, "SET status = 'processed'"):
+				step("processed")
+				if tt.markFails {
+					return fakeResult{err: pgError("57P01", "terminating connection due to administrator command")}
+				}
+			case strings.Contains(sql, "SET notified_at"):
+				step("notified_at")
+			}
+			return fakeResult{tag: "UPDATE 1"}
+		})
+		captureLog(t)
+		p := &Pool{batchSize: 10, atMostOnce: tt.atMostOnce, notifier: notifierFunc(func(context.Context, PGCartEvent) error {
+			step("notify")
+			return nil
+		})}
+		p.sendNotification(context.Background(), f.pool(t), PGCartEvent{ID: fakeID(1)})
+
+		if !slices.Equal(steps, tt.want) {
+			t.Errorf("atMostOnce=%v markFails=%v: %v, want %v", tt.atMostOnce, tt.markFails, steps, tt.want)
+		}
+	}
+}
+
+func TestAtMostOnceFailureIsNotRetried(t *testing.T) {
+	for _, deadLetter := range []bool{false, true} {
+		for _, sendErr := range []error{nil, errors.New("downstream returned 502 Bad Gateway")} {
+			f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "UPDATE 1"} })
+			captureLog(t)
+			events, err := openEventLog(filepath.Join(t.TempDir(), "events.log"), 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hook := &StatusHook{queue: make(chan statusChange, 10)}
+			p := &Pool{batchSize: 10, atMostOnce: true, deadLetter: deadLetter, hook: hook, eventLog: events,
+				notifier: notifierFunc(func(context.Context, PGCartEvent) error { return sendErr })}
+			p.sendNotification(context.Background(), f.pool(t), PGCartEvent{ID: fakeID(1)})
+			events.Close()
+			close(hook.queue)
+
+			name := fmt.Sprintf("deadLetter=%v err=%v", deadLetter, sendErr)
+			var transitions []string
+			for change := range hook.queue {
+				transitions = append(transitions, change.OldStatus+"->"+change.NewStatus)
+			}
+			logged := len(readEventLog(t, events.path))
+			var requeued, failed bool
+			for _, q := range f.Queries() {
+				requeued = requeued || strings.Contains(q, "status = 'pending'")
+				failed = failed || strings.Contains(q, "status = 'failed'") || strings.Contains(q, "dead_letter_events")
+			}
+			if sendErr == nil {
+				if !slices.Equal(transitions, []string{"processing->processed"}) || logged != 1 || failed {
+					t.Errorf("%s: transitions %v, %d event log lines, failed %v; want one processed entry", name, transitions, logged, failed)
+				}
+				continue
+			}
+			if requeued || !failed {
+				t.Errorf("%s: requeued %v, failed %v; want the event failed and not retried", name, requeued, failed)
+			}
+			if want := []string{"processing->processed", "processed->failed"}; !slices.Equal(transitions, want) {
+				t.Errorf("%s: transitions %v, want %v", name, transitions, want)
+			}
+			if logged != 0 {
+				t.Errorf("%s: %d event log lines for an undelivered event", name, logged)
+			}
+		}
+	}
+}
+
+func TestServerTimeoutsSet(t *testing.T) {
+	server := newServer(testConfig(t, nil), http.NotFoundHandler())
+	for name, got := range map[string]time.Duration{
+		"ReadHeaderTimeout": server.ReadHeaderTimeout,
+		"ReadTimeout":       server.ReadTimeout,
+		"WriteTimeout":      server.WriteTimeout,
+		"IdleTimeout":       server.IdleTimeout,
+	} {
+		if got <= 0 {
+			t.Errorf("%s = %v, want a limit by default", name, got)
+		}
+	}
+}
+
+// failingBody is a request body whose read fails partway, like a client
+// that breaks off a chunked upload.
+type failingBody struct{ sent bool }
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.sent {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b.sent = true
+	return copy(p, `{"orderType":"Purc`), nil
+}
+
+func TestEventBodyReadErrorIsBadRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/event", &failingBody{})
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	(&Handler{}).Event(rec, req)
+	if rec.Code != http.StatusBadRequest || strings.TrimSpace(rec.Body.String()) != `{"error":"invalid body"}` {
+		t.Errorf("event with a broken body: %d %s, want 400", rec.Code, rec.Body)
+	}
+}
+
+func TestConfiguredServerTimeoutsApplied(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		cfg := testConfig(t, map[string]string{
+			"PORT":                       "9090",
+			"SERVER_READ_HEADER_TIMEOUT": "2s",
+			"SERVER_READ_TIMEOUT":        "15s",
+			"SERVER_WRITE_TIMEOUT":       "45s",
+			"SERVER_IDLE_TIMEOUT":        "5m",
+		})
+		server := newServer(cfg, http.NotFoundHandler())
+		if server.Addr != ":9090" || server.ReadHeaderTimeout != 2*time.Second || server.ReadTimeout != 15*time.Second ||
+			server.WriteTimeout != 45*time.Second || server.IdleTimeout != 5*time.Minute {
+			t.Errorf("server %s: header %v, read %v, write %v, idle %v", server.Addr,
+				server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+		}
+	})
+	t.Run("defaults", func(t *testing.T) {
+		server := newServer(testConfig(t, nil), http.NotFoundHandler())
+		if server.ReadHeaderTimeout != ServerReadHeaderTimeout || server.ReadTimeout != ServerReadTimeout ||
+			server.WriteTimeout != ServerWriteTimeout || server.IdleTimeout != ServerIdleTimeout {
+			t.Errorf("header %v, read %v, write %v, idle %v",
+				server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+		}
+	})
+	t.Run("negative", func(t *testing.T) {
+		if err := testConfig(t, map[string]string{"SERVER_WRITE_TIMEOUT": "-1s"}).Validate(); err == nil {
+			t.Error("a negative SERVER_WRITE_TIMEOUT was accepted")
+		}
+	})
+}
+
+func TestNotifyOrder(t *testing.T) {
+	// The claim returns the batch out of creation order.
+	created := []string{"2024-01-01 00:00:03+00", "2024-01-01 00:00:01+00", "2024-01-01 00:00:04+00", "2024-01-01 00:00:02+00"}
+	batch := func() *fakeQueue {
+		var rows [][]any
+		for i, at := range created {
+			row := fakeEventRow(fakeID(i + 1))
+			row[fakeColCreatedAt] = at
+			rows = append(rows, row)
+		}
+		return &fakeQueue{rows: rows}
+	}
+
+	t.Run("sequential", func(t *testing.T) {
+		f := newFakePG(t, batch().handle)
+		var mu sync.Mutex
+		var order []string
+		inFlight := 0
+		p := &Pool{batchSize: 10, sequential: true, notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+			mu.Lock()
+			inFlight++
+			if inFlight > 1 {
+				t.Error("notifications overlap in sequential mode")
+			}
+			order = append(order, event.ID)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return nil
+		})}
+		if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{fakeID(2), fakeID(4), fakeID(1), fakeID(3)}; !slices.Equal(order, want) {
+			t.Errorf("notified %v, want creation order %v", order, want)
+		}
+		for _, q := range f.Queries() {
+			if strings.Contains(q, "WITH cte AS") && !strings.Contains(q, "ORDER BY created_at, id") {
+				t.Errorf("sequential claim not in creation order: %q", q)
+			}
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		f := newFakePG(t, batch().handle)
+		// The oldest event can only finish once the newest has been sent,
+		// which sequential sending would never allow.
+		newestSent := make(chan struct{})
+		p := &Pool{batchSize: 10, notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+			switch event.ID {
+			case fakeID(3):
+				close(newestSent)
+			case fakeID(2):
+				select {
+				case <-newestSent:
+				case <-time.After(2 * time.Second):
+					t.Error("the newest event waited for the oldest in concurrent mode")
+				}
+			}
+			return nil
+		})}
+		if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestClaimRetriesConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      string
+		failures  int
+		claims    int
+		retries   uint64
+		wantError bool
+	}{
+		{"serialization failure", "40001", 2, 3, 2, false},
+		{"deadlock", "40P01", 1, 2, 1, false},
+		{"persistent conflict", "40001", 100, MaxClaimRetries + 1, MaxClaimRetries, true},
+		{"fatal error", "42P01", 100, 1, 0, true},
+	}
+	for _, tt := range tests {
+		queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+		var claims atomic.Int32
+		f := newFakePG(t, func(sql string) fakeResult {
+			if strings.Contains(sql, "WITH cte AS") && int(claims.Add(1)) <= tt.failures {
+				return fakeResult{err: pgError(tt.code, "could not serialize access due to concurrent update")}
+			}
+			return queue.handle(sql)
+		})
+		captureLog(t)
+		p := &Pool{batchSize: 10, notifier: notifierFunc(func(context.Context, PGCartEvent) error { return nil })}
+		before := claimRetries.Value()
+
+		claimed, err := p.process(context.Background(), f.pool(t))
+		if (err != nil) != tt.wantError || (err == nil && claimed != 1) {
+			t.Errorf("%s: claimed %d, %v", tt.name, claimed, err)
+		}
+		if n := int(claims.Load()); n != tt.claims {
+			t.Errorf("%s: %d claims, want %d", tt.name, n, tt.claims)
+		}
+		if n := claimRetries.Value() - before; n != tt.retries {
+			t.Errorf("%s: claim_retries_total went up %d, want %d", tt.name, n, tt.retries)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A minimal Prometheus registry. The service only needs a handful of
+// counters, gauges and one histogram, which doesn't justify the client
+// library and its dependencies. Scrapers that ask for OpenMetrics get it,
+// since only that format can carry exemplars; everyone else gets the
+// Prometheus text format.
+type registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+type metric interface {
+	write(w io.Writer, openMetrics bool)
+}
+
+var metrics = &registry{metrics: map[string]metric{}}
+
+// register adds m under name. Registering a name again replaces the old
+// metric, so run can set up a fresh service more than once per process.
+func (r *registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = m
+}
+
+// openMetricsType is the content type of the OpenMetrics text format.
+const openMetricsType = "application/openmetrics-text"
+
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	openMetrics := strings.Contains(req.Header.Get("Accept"), openMetricsType)
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsType+"; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+		m.write(w, openMetrics)
+	}
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines. OpenMetrics names a counter
+// family without its _total suffix.
+func writeHeader(w io.Writer, openMetrics bool, name, help, typ string) {
+	if openMetrics && typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+type Counter struct {
+	name, help string
+	v          atomic.Uint64
+}
+
+func newCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	metrics.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+func (c *Counter) write(w io.Writer, openMetrics bool) {
+	writeHeader(w, openMetrics, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.v.Load())
+}
+
+type Gauge struct {
+	name, help string
+	bits       atomic.Uint64
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	metrics.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64)  { g.bits.Store(math.Float64bits(v)) }
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+func (g *Gauge) write(w io.Writer, openMetrics bool) {
+	writeHeader(w, openMetrics, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", g.name, g.Value())
+}
+
+// GaugeFunc is a gauge whose value is computed on every scrape.
+type GaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer, openMetrics bool) {
+	writeHeader(w, openMetrics, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", g.name, g.fn())
+}
+
+// CounterFunc is a counter whose value is computed on every scrape, for
+// totals kept elsewhere.
+type CounterFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newCounterFunc(name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{name: name, help: help, fn: fn}
+	metrics.register(name, c)
+	return c
+}
+
+func (c *CounterFunc) write(w io.Writer, openMetrics bool) {
+	writeHeader(w, openMetrics, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %g\n", c.name, c.fn())
+}
+
+// Histogram counts observations into cumulative buckets. In OpenMetrics
+// each bucket also shows the trace ID of the last observation that landed
+// in it, if that observation had one, so a slow sample on a dashboard
+// links to its trace.
+type Histogram struct {
+	name, help string
+	bounds     []float64
+
+	mu        sync.Mutex
+	counts    []uint64 // per bucket, the last one being +Inf
+	exemplars []exemplar
+	sum       float64
+	count     uint64
+}
+
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+func newHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{
+		name:      name,
+		help:      help,
+		bounds:    bounds,
+		counts:    make([]uint64, len(bounds)+1),
+		exemplars: make([]exemplar, len(bounds)+1),
+	}
+	metrics.register(name, h)
+	return h
+}
+
+// Observe records v, with traceID as its exemplar unless that is empty.
+func (h *Histogram) Observe(v float64, traceID string) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID: traceID, value: v, at: time.Now()}
+	}
+}
+
+func (h *Histogram) write(w io.Writer, openMetrics bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, openMetrics, h.name, h.help, "histogram")
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d", h.name, le, cumulative)
+		if ex := h.exemplars[i]; openMetrics && ex.traceID != "" {
+			fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", ex.traceID, ex.value, float64(ex.at.UnixMilli())/1000)
+		}
+		io.WriteString(w, "\n")
+	}
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics returns /metrics as served with the given Accept header.
+func scrapeMetrics(t *testing.T, accept string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, req)
+	return rec.Body.String()
+}
+
+func TestNotificationExemplarCarriesTraceID(t *testing.T) {
+	ctx := withNewTrace(context.Background())
+	notificationDuration.Observe(0.07, traceID(ctx))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTraceParent(req)
+	parts := strings.Split(req.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || parts[1] != traceID(ctx) || len(parts[1]) != 32 {
+		t.Fatalf("traceparent = %q, want a W3C trace context for %s", req.Header.Get("traceparent"), traceID(ctx))
+	}
+	exemplar := `# {trace_id="` + parts[1] + `"} 0.07`
+
+	body := scrapeMetrics(t, "application/openmetrics-text; version=1.0.0")
+	if !strings.Contains(body, `notification_duration_seconds_bucket{le="0.1"}`) || !strings.Contains(body, exemplar) {
+		t.Errorf("no notification_duration_seconds bucket has exemplar %s:\n%s", exemplar, body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Error("OpenMetrics output doesn't end with # EOF")
+	}
+	if !strings.Contains(body, "# TYPE notifications_degraded counter\n") {
+		t.Error("OpenMetrics counter family keeps its _total suffix")
+	}
+
+	plain := scrapeMetrics(t, "")
+	if strings.Contains(plain, "trace_id") || strings.Contains(plain, "# EOF") {
+		t.Errorf("Prometheus text format carries OpenMetrics syntax:\n%s", plain)
+	}
+}
+
+func TestNotificationsAreNotTracedByDefault(t *testing.T) {
+	req, err := http.NewRequestWithContext(context.Background(), "POST", "http://example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTraceParent(req)
+	if got := req.Header.Get("traceparent"); got != "" {
+		t.Errorf("traceparent %q sent for an untraced notification", got)
+	}
+}
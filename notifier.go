@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers a processed cart event to the user. A non-nil error
+// means the event was not delivered and should be re-queued.
+type Notifier interface {
+	Notify(ctx context.Context, event PGCartEvent) error
+}
+
+// notification is the payload sent downstream. IdempotencyKey is the
+// event ID and stays the same across retries, so a downstream that dedupes
+// on it never notifies the user twice.
+type notification struct {
+	ID             string    `json:"id"`
+	IdempotencyKey string    `json:"idempotencyKey"`
+	OrderType      string    `json:"orderType"`
+	SessionID      string    `json:"sessionId"`
+	Card           string    `json:"card"`
+	CardLastFour   string    `json:"cardLastFour,omitempty"`
+	EventDate      time.Time `json:"eventDate"`
+	WebsiteURL     string    `json:"websiteUrl"`
+}
+
+func newNotification(event PGCartEvent) notification {
+	return notification{
+		ID:             event.ID,
+		IdempotencyKey: event.ID,
+		OrderType:      event.OrderType,
+		SessionID:      event.SessionID,
+		Card:           event.Card,
+		CardLastFour:   event.CardLastFour,
+		EventDate:      event.EventDate,
+		WebsiteURL:     event.WebsiteURL,
+	}
+}
+
+// LogNotifyDelay is how long logNotifier pretends the notification
+// service takes.
+const LogNotifyDelay = 2 * time.Second
+
+type logNotifier struct {
+	delay time.Duration
+}
+
+func (n logNotifier) Notify(ctx context.Context, event PGCartEvent) error {
+	// Simulate external Notify Service Call, which gives up when ctx
+	// does, so a timeout or shutdown isn't held up by it.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(n.delay):
+	}
+	log.Printf("NOTIFY: Order %s for card %s",
+		event.OrderType, event.Card)
+	return nil
+}
+
+// WriterNotifier writes each event to w as one line of JSON, for setups
+// where a log shipper picks notifications up from stdout. Cards are
+// always masked.
+type WriterNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterNotifier(w io.Writer) *WriterNotifier {
+	return &WriterNotifier{w: w}
+}
+
+func (n *WriterNotifier) Notify(ctx context.Context, event PGCartEvent) error {
+	payload := newNotification(event)
+	payload.Card = maskCard(payload.Card)
+	line, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// One Write per event under the lock keeps lines from interleaving.
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err = n.w.Write(line)
+	return err
+}
+
+// HTTPNotifier POSTs each event to the downstream as a JSON object.
+// Requests are signed with secret when it is non-empty, see signRequest.
+// The event ID goes in the keyHeader header, unless that is empty, for
+// downstreams that dedupe retries by header.
+type HTTPNotifier struct {
+	url       string
+	client    *http.Client
+	secret    []byte
+	keyHeader string
+}
+
+func NewHTTPNotifier(url string, client *http.Client, secret, keyHeader string) *HTTPNotifier {
+	return &HTTPNotifier{url: url, client: client, secret: []byte(secret), keyHeader: keyHeader}
+}
+
+func (n *HTTPNotifier) Notify(ctx context.Context, event PGCartEvent) error {
+	body, err := json.Marshal(newNotification(event))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.keyHeader != "" {
+		req.Header.Set(n.keyHeader, event.ID)
+	}
+	setTraceParent(req)
+	signRequest(req, body, n.secret)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	return checkStatus(resp)
+}
+
+// checkStatus treats every 2xx as delivered, not just 200. A 429 or 503
+// with a usable Retry-After becomes a RetryAfterError.
+func checkStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return &RetryAfterError{Status: resp.Status, After: after}
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("downstream returned %s", resp.Status)
+	}
+	return nil
+}
+
+// closeBody drains what is left of the body before closing it so the
+// connection can be reused for the next notification.
+func closeBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+}
+
+func newNotifier(ctx context.Context, cfg Config) (Notifier, error) {
+	var notifier Notifier
+	switch cfg.Notifier {
+	case "", "log":
+		notifier = logNotifier{delay: LogNotifyDelay}
+	case "stdout":
+		notifier = NewWriterNotifier(os.Stdout)
+	case "http":
+		if cfg.NotifyURL == "" {
+			return nil, fmt.Errorf("NOTIFY_URL is required for the http notifier")
+		}
+		notifier = NewHTTPNotifier(cfg.NotifyURL, newNotifyClient(cfg.NotifyInsecureSkipVerify, cfg.NotifyTimeout), cfg.NotifySigningSecret, cfg.NotifyIdempotencyHeader)
+	case "batch":
+		if cfg.NotifyURL == "" {
+			return nil, fmt.Errorf("NOTIFY_URL is required for the batch notifier")
+		}
+		notifier = NewBatchNotifier(ctx, cfg.NotifyURL, newNotifyClient(cfg.NotifyInsecureSkipVerify, cfg.NotifyTimeout), cfg.NotifyBatchSize, cfg.NotifyFlushInterval, cfg.NotifySigningSecret)
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", cfg.Notifier)
+	}
+
+	if cfg.BreakerThreshold > 0 {
+		notifier = NewCircuitBreaker(notifier, cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	return notifier, nil
+}
+
+// newNotifyClient returns the http.Client used for downstream calls, with
+// requests cut off after timeout (none if 0). It requires TLS 1.2 or
+// newer; insecureSkipVerify is only meant for testing against self-signed
+// endpoints.
+func newNotifyClient(insecureSkipVerify bool, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogNotifierStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := logNotifier{delay: time.Hour}.Notify(ctx, PGCartEvent{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Notify = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Notify took %s after its context ended", elapsed)
+	}
+}
+
+func TestSlowNotifierIsRequeued(t *testing.T) {
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+	f := newFakePG(t, queue.handle)
+	db := f.pool(t)
+	captureLog(t)
+
+	p := &Pool{
+		batchSize:     10,
+		notifier:      logNotifier{delay: time.Hour},
+		notifyTimeout: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	if _, err := p.process(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("process took %s with a %s notify timeout", elapsed, p.notifyTimeout)
+	}
+	if got := queue.status(fakeID(1)); got != "pending" {
+		t.Errorf("status %q, want the timed out event back to pending", got)
+	}
+	retried := false
+	for _, q := range f.Queries() {
+		retried = retried || containsAll(q, "retry_count = retry_count + 1", fakeID(1))
+	}
+	if !retried {
+		t.Error("timed out event didn't spend a retry")
+	}
+}
+
+func TestNotifyClientRequiresTLS12(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		transport := newNotifyClient(skip, 0).Transport.(*http.Transport)
+		tlsConfig := transport.TLSClientConfig
+		if tlsConfig.MinVersion != tls.VersionTLS12 {
+			t.Errorf("insecureSkipVerify=%v: MinVersion = %#x, want TLS 1.2", skip, tlsConfig.MinVersion)
+		}
+		if tlsConfig.InsecureSkipVerify != skip {
+			t.Errorf("InsecureSkipVerify = %v, want %v", tlsConfig.InsecureSkipVerify, skip)
+		}
+	}
+}
+
+func TestNotifyClientTimeoutFollowsNotifyTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Scaled down: a downstream slower than a fixed client timeout but
+	// within NOTIFY_TIMEOUT gets through, and the timeout still cuts off
+	// a slower one.
+	if err := NewHTTPNotifier(srv.URL, newNotifyClient(false, time.Second), "", "").Notify(ctx, PGCartEvent{ID: fakeID(1)}); err != nil {
+		t.Errorf("notification within the timeout failed: %v", err)
+	}
+	if err := NewHTTPNotifier(srv.URL, newNotifyClient(false, 20*time.Millisecond), "", "").Notify(ctx, PGCartEvent{ID: fakeID(1)}); err == nil {
+		t.Error("notification past the timeout succeeded")
+	}
+
+	for _, name := range []string{"http", "batch"} {
+		cfg := Config{Notifier: name, NotifyURL: srv.URL, NotifyTimeout: 45 * time.Second, NotifyBatchSize: 10, NotifyFlushInterval: time.Second}
+		notifier, err := newNotifier(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var client *http.Client
+		switch n := notifier.(type) {
+		case *HTTPNotifier:
+			client = n.client
+		case *BatchNotifier:
+			client = n.client
+		}
+		if client == nil || client.Timeout != cfg.NotifyTimeout {
+			t.Errorf("NOTIFIER=%s: client %+v, want a %s timeout", name, client, cfg.NotifyTimeout)
+		}
+	}
+}
+
+func TestRepeatedNotificationCarriesSameIdempotencyKey(t *testing.T) {
+	// A downstream that dedupes on the key delivers a re-sent event once.
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	delivered := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body notification
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("notification body: %v", err)
+		}
+		if header := r.Header.Get("Idempotency-Key"); header != body.IdempotencyKey {
+			t.Errorf("header key %q, body key %q", header, body.IdempotencyKey)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !seen[body.IdempotencyKey] {
+			seen[body.IdempotencyKey] = true
+			delivered++
+		}
+	}))
+	defer srv.Close()
+
+	n := NewHTTPNotifier(srv.URL, srv.Client(), "", "Idempotency-Key")
+	event := PGCartEvent{ID: fakeID(1), OrderType: "Purchase", Card: "4433**1409"}
+	for i := 0; i < 2; i++ {
+		if err := n.Notify(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if delivered != 1 || !seen[fakeID(1)] {
+		t.Errorf("downstream delivered %d notifications with keys %v, want one keyed %s", delivered, seen, fakeID(1))
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		ok     bool
+	}{
+		{http.StatusOK, `{"received":true}`, true},
+		{http.StatusAccepted, `{"queued":true}`, true},
+		{http.StatusNoContent, "", true},
+		{http.StatusMultipleChoices, "", false},
+		{http.StatusBadRequest, `{"error":"bad"}`, false},
+		{http.StatusInternalServerError, "", false},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			io.WriteString(w, tt.body)
+		}))
+		// Every notification reuses one connection when bodies are
+		// drained and closed.
+		var conns atomic.Int32
+		srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
+			}
+		}
+		srv.Start()
+		n := NewHTTPNotifier(srv.URL, srv.Client(), "", "")
+		for i := 0; i < 3; i++ {
+			err := n.Notify(context.Background(), PGCartEvent{ID: fakeID(1)})
+			if (err == nil) != tt.ok {
+				t.Errorf("%d: err = %v, want ok %v", tt.status, err, tt.ok)
+			}
+		}
+		if got := conns.Load(); got != 1 {
+			t.Errorf("%d: %d connections for 3 notifications, want 1", tt.status, got)
+		}
+		srv.Close()
+	}
+}
+
+func TestWriterNotifierWritesProcessedEvents(t *testing.T) {
+	var rows [][]any
+	for i := 1; i <= 3; i++ {
+		rows = append(rows, fakeEventRow(fakeID(i)))
+	}
+	queue := &fakeQueue{rows: rows}
+	f := newFakePG(t, queue.handle)
+	var out bytes.Buffer
+	p := &Pool{batchSize: 10, notifier: NewWriterNotifier(&out)}
+	if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(rows) {
+		t.Fatalf("wrote %q, want one line per event", out.String())
+	}
+	seen := map[string]bool{}
+	for _, line := range lines {
+		var n notification
+		if err := json.Unmarshal([]byte(line), &n); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if n.Card != "4111**1111" || n.SessionID != "session-1" || n.IdempotencyKey != n.ID {
+			t.Errorf("line %q, want the event with its card masked", line)
+		}
+		seen[n.ID] = true
+	}
+	for _, row := range rows {
+		if id := row[0].(string); !seen[id] || queue.status(id) != "processed" {
+			t.Errorf("event %s: written %v, status %q", id, seen[id], queue.status(id))
+		}
+	}
+}
+
+func TestWriterNotifierLinesDoNotInterleave(t *testing.T) {
+	var out bytes.Buffer
+	n := NewWriterNotifier(&out)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.Notify(context.Background(), PGCartEvent{ID: fakeID(i), Card: "4111111111111111"})
+		}()
+	}
+	wg.Wait()
+
+	scanner := bufio.NewScanner(&out)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var n notification
+		if err := json.Unmarshal(scanner.Bytes(), &n); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+	}
+	if lines != 50 {
+		t.Errorf("%d lines, want 50", lines)
+	}
+}
+
+func TestIdempotencyHeaderStableAcrossRetries(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("X-Dedup-Key"))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := testConfig(t, map[string]string{"NOTIFIER": "http", "NOTIFY_URL": srv.URL, "NOTIFY_IDEMPOTENCY_HEADER": "X-Dedup-Key"})
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	n := NewHTTPNotifier(cfg.NotifyURL, srv.Client(), "", cfg.NotifyIdempotencyHeader)
+	// Each retry is a fresh Notify of the event as reclaimed from the
+	// database.
+	for retries := 0; ; retries++ {
+		err := n.Notify(context.Background(), PGCartEvent{ID: fakeID(1), RetryCount: retries})
+		if err == nil {
+			break
+		}
+		if retries == 5 {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{fakeID(1), fakeID(1), fakeID(1)}; !slices.Equal(keys, want) {
+		t.Errorf("X-Dedup-Key across attempts: %q, want %q", keys, want)
+	}
+
+	keys = nil
+	if err := NewHTTPNotifier(srv.URL, srv.Client(), "", "").Notify(context.Background(), PGCartEvent{ID: fakeID(2)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "" {
+		t.Errorf("header sent with NOTIFY_IDEMPOTENCY_HEADER unset: %q", keys)
+	}
+	if err := testConfig(t, map[string]string{"NOTIFY_IDEMPOTENCY_HEADER": "X Dedup"}).Validate(); err == nil {
+		t.Error("an invalid header name was accepted")
+	}
+}
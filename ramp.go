@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// rampLimiter caps concurrent notifications at a limit that grows from 1
+// to max over window, so a cold downstream isn't hit with the full load
+// at once. The ramp starts with the pool and starts over once the
+// downstream answers again after the circuit breaker opened. A nil
+// *rampLimiter grants every request.
+type rampLimiter struct {
+	mu     sync.Mutex
+	max    int
+	window time.Duration
+	start  time.Time
+	used   int
+	// down is set while the breaker reports the downstream open.
+	down bool
+	// freed is closed and replaced whenever a slot is released.
+	freed chan struct{}
+}
+
+func newRampLimiter(max int, window time.Duration) *rampLimiter {
+	if window <= 0 || max <= 1 {
+		return nil
+	}
+	return &rampLimiter{max: max, window: window, start: time.Now(), freed: make(chan struct{})}
+}
+
+// limit is the current cap. The caller holds l.mu.
+func (l *rampLimiter) limit() int {
+	elapsed := time.Since(l.start)
+	if elapsed >= l.window {
+		return l.max
+	}
+	return 1 + int(float64(l.max-1)*float64(elapsed)/float64(l.window))
+}
+
+// acquire waits until a slot is free under the current limit or ctx is
+// done.
+func (l *rampLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	// The limit goes up by one every step, so waiting that long picks up
+	// the next slot even when none is released.
+	step := max(l.window/time.Duration(l.max), 10*time.Millisecond)
+	for {
+		l.mu.Lock()
+		if l.used < l.limit() {
+			l.used++
+			l.mu.Unlock()
+			return nil
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(step)
+		select {
+		case <-freed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (l *rampLimiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used--
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// observe restarts the ramp on the first success after the breaker
+// reported the downstream down.
+func (l *rampLimiter) observe(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case errors.Is(err, ErrCircuitOpen):
+		l.down = true
+	case err == nil && l.down:
+		l.down = false
+		l.start = time.Now()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rampAt moves l's start back so that elapsed of its window has passed.
+func rampAt(l *rampLimiter, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.start = time.Now().Add(-elapsed)
+}
+
+// acquireAll takes slots from l until one doesn't come within a short
+// wait and returns how many it got.
+func acquireAll(t *testing.T, l *rampLimiter) int {
+	t.Helper()
+	n := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := l.acquire(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			return n
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func TestRampLimiterGrowsStepByStep(t *testing.T) {
+	const window = time.Hour
+	l := newRampLimiter(5, window)
+
+	// Each stage only adds the slots the limit grew by, so the totals
+	// show the limit itself.
+	total := 0
+	for _, stage := range []struct {
+		elapsed time.Duration
+		want    int
+	}{
+		{0, 1},
+		{window / 4, 2},
+		{window / 2, 3},
+		{3 * window / 4, 4},
+		{window, 5},
+		{2 * window, 5},
+	} {
+		rampAt(l, stage.elapsed)
+		total += acquireAll(t, l)
+		if total != stage.want {
+			t.Errorf("after %s: %d concurrent slots, want %d", stage.elapsed, total, stage.want)
+		}
+	}
+}
+
+func TestRampLimiterRestartsAfterOutage(t *testing.T) {
+	l := newRampLimiter(5, time.Hour)
+	rampAt(l, time.Hour)
+	l.observe(ErrCircuitOpen)
+	l.mu.Lock()
+	if got := l.limit(); got != 5 {
+		t.Errorf("limit while down = %d, want the ramp left alone until the downstream answers", got)
+	}
+	l.mu.Unlock()
+
+	l.observe(nil)
+	if got := acquireAll(t, l); got != 1 {
+		t.Errorf("%d slots right after recovery, want the ramp to start over at 1", got)
+	}
+}
+
+func TestRampLimiterDisabled(t *testing.T) {
+	for _, l := range []*rampLimiter{newRampLimiter(5, 0), newRampLimiter(1, time.Hour)} {
+		if l != nil {
+			t.Errorf("newRampLimiter returned %+v, want nil so nothing is limited", l)
+		}
+		if err := l.acquire(context.Background()); err != nil {
+			t.Errorf("nil limiter: acquire = %v", err)
+		}
+		l.release()
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterStaysUnderLimit(t *testing.T) {
+	const rate, burst, n = 100, 5, 25
+	l := NewRateLimiter(rate, burst)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// The burst goes through at once, every further send waits a token.
+	min := time.Duration(n-burst) * time.Second / rate
+	if elapsed < min*9/10 {
+		t.Errorf("%d sends took %v, want at least %v at %d/s", n, elapsed, min, rate)
+	}
+	if got := float64(n-burst) / elapsed.Seconds(); got > rate*1.1 {
+		t.Errorf("sent at %.0f/s, limit is %d/s", got, rate)
+	}
+}
+
+func TestRateLimiterWaitRespectsContext(t *testing.T) {
+	l := NewRateLimiter(0.1, 1)
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait = %v, want deadline exceeded", err)
+	}
+}
+
+func TestNilRateLimiterDoesNotBlock(t *testing.T) {
+	if l := NewRateLimiter(0, 1); l != nil {
+		t.Fatalf("NewRateLimiter(0) = %v, want nil", l)
+	}
+	var l *RateLimiter
+	if err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var reclaimedEvents = newCounter("events_reclaimed_total",
+	"Events moved back to pending after being stuck in processing longer than STUCK_AFTER.")
+
+// StartStuckReaper periodically returns events that have sat in
+// 'processing' for longer than stuckAfter, e.g. because their worker
+// crashed, to 'pending'. The threshold is evaluated against the database
+// clock so skew between app hosts can't reclaim events early.
+func (p *Pool) StartStuckReaper(ctx context.Context, stuckAfter, every time.Duration) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.reclaimStuck(ctx, stuckAfter)
+			}
+		}
+	}()
+}
+
+func (p *Pool) reclaimStuck(ctx context.Context, stuckAfter time.Duration) {
+	for _, db := range p.db.All() {
+		rows, err := db.Query(ctx, `
+		UPDATE cart_events
+		SET status = 'pending'
+		WHERE status = 'processing'
+		AND status_changed_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		RETURNING id::text`,
+			stuckAfter.Seconds())
+		var ids []string
+		if err == nil {
+			ids, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+		if err != nil {
+			if !isShutdown(ctx, err) {
+				log.Println("Error reclaiming stuck events:", err)
+			}
+			continue
+		}
+
+		for _, id := range ids {
+			p.hook.Fire(id, "processing", "pending")
+		}
+		if len(ids) > 0 {
+			log.Printf("Reclaimed %d events stuck in processing longer than %s", len(ids), stuckAfter)
+			reclaimedEvents.Add(uint64(len(ids)))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestReclaimStuckBackdated(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	stuck := seedEvent(t, db, "session-1")
+	recent := seedEvent(t, db, "session-2")
+	setEventStatus(t, db, "processing", stuck, recent)
+	// Only the status trigger moves status_changed_at, so this backdates
+	// it as if the worker had claimed the event an hour ago.
+	if _, err := db.Exec(ctx, "UPDATE cart_events SET status_changed_at = CURRENT_TIMESTAMP - interval '1 hour' WHERE id = $1", stuck); err != nil {
+		t.Fatal(err)
+	}
+	captureLog(t)
+
+	p := &Pool{db: NewHashRouter(db)}
+	p.reclaimStuck(ctx, 10*time.Minute)
+	for id, want := range map[string]string{stuck: "pending", recent: "processing"} {
+		if got := eventStatus(t, db, id); got != want {
+			t.Errorf("event %s: status %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestReclaimStuckUsesDatabaseClock(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult {
+		return fakeResult{columns: []fakeColumn{{"id", pgtype.TextOID}}, rows: [][]any{{fakeID(1)}}}
+	})
+	captureLog(t)
+	p := &Pool{db: NewHashRouter(f.pool(t))}
+	before := reclaimedEvents.Value()
+	p.reclaimStuck(context.Background(), 10*time.Minute)
+
+	queries := f.Queries()
+	if len(queries) != 1 || !containsAll(queries[0], "status_changed_at < CURRENT_TIMESTAMP - make_interval", "'600'") {
+		t.Fatalf("queries = %q, want one update against CURRENT_TIMESTAMP", queries)
+	}
+	// No timestamp from this host goes into the comparison.
+	if year := time.Now().Format("2006-"); strings.Contains(queries[0], year) {
+		t.Errorf("reaper query carries an application timestamp: %s", queries[0])
+	}
+	if n := reclaimedEvents.Value() - before; n != 1 {
+		t.Errorf("%d events counted reclaimed, want 1", n)
+	}
+}
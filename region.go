@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// RegionMap maps host suffixes to business regions, e.g. "de" to "eu" or
+// "amazon.co.uk" to "uk". The longest matching suffix wins, so specific
+// domains can override their TLD.
+type RegionMap map[string]string
+
+// parseRegionMap parses "suffix=region" pairs such as
+// "de=eu,fr=eu,com=us,amazon.co.uk=uk".
+func parseRegionMap(pairs []string) (RegionMap, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	m := RegionMap{}
+	for _, pair := range pairs {
+		suffix, region, ok := strings.Cut(pair, "=")
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		region = strings.TrimSpace(region)
+		if !ok || suffix == "" || region == "" {
+			return nil, fmt.Errorf("region mapping %q must look like de=eu", pair)
+		}
+		m[suffix] = region
+	}
+	return m, nil
+}
+
+// Region returns the region of websiteURL's host, or "" if no suffix
+// matches.
+func (m RegionMap) Region(websiteURL string) string {
+	if len(m) == 0 {
+		return ""
+	}
+	u, err := url.Parse(websiteURL)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for {
+		if region, ok := m[host]; ok {
+			return region
+		}
+		_, rest, ok := strings.Cut(host, ".")
+		if !ok {
+			return ""
+		}
+		host = rest
+	}
+}
+
+var errRegionNotAllowed = errors.New("websiteUrl region is not allowed")
+
+// checkEvent applies the host allowlist and region rules to a validated
+// event and records its region.
+func (h *Handler) checkEvent(event *PGCartEvent) error {
+	if !hostAllowed(event.WebsiteURL, h.allowedHosts) {
+		return errHostNotAllowed
+	}
+	event.Region = h.regions.Region(event.WebsiteURL)
+	if len(h.allowedRegions) > 0 && !slices.Contains(h.allowedRegions, event.Region) {
+		return errRegionNotAllowed
+	}
+	return nil
+}
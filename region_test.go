@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestRegionMapRegion(t *testing.T) {
+	m, err := parseRegionMap([]string{"de=eu", " .co.uk = uk", "com=us", "amazon.co.uk=uk-amazon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for websiteURL, want := range map[string]string{
+		"https://shop.de/cart":            "eu",
+		"https://SHOP.DE:8443/":           "eu",
+		"https://www.example.co.uk/":      "uk",
+		"https://www.amazon.co.uk/basket": "uk-amazon",
+		"https://amazon.co.uk/":           "uk-amazon",
+		"https://example.com/":            "us",
+		"https://example.org/":            "",
+		"https://localhost/":              "",
+		"://bad":                          "",
+	} {
+		if got := m.Region(websiteURL); got != want {
+			t.Errorf("Region(%q) = %q, want %q", websiteURL, got, want)
+		}
+	}
+	if got := RegionMap(nil).Region("https://shop.de/"); got != "" {
+		t.Errorf("empty map: Region = %q", got)
+	}
+}
+
+func TestParseRegionMapRejectsBadPairs(t *testing.T) {
+	for _, pair := range []string{"de", "=eu", "de=", "."} {
+		if _, err := parseRegionMap([]string{pair}); err == nil {
+			t.Errorf("parseRegionMap(%q) succeeded", pair)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type reprocessRequest struct {
+	Status string `json:"status"`
+	// From and To bound created_at like the export endpoint, [from, to).
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Confirm must be set for a request without a date range, which
+	// reprocesses every event in Status.
+	Confirm bool `json:"confirm"`
+}
+
+// reprocessable are the statuses Reprocess may move back to pending.
+var reprocessable = map[string]bool{"failed": true, "processed": true}
+
+// Reprocess resets events in a status, optionally created in a date range,
+// to 'pending' with a clean retry history so they are notified again.
+func (h *Handler) Reprocess(w http.ResponseWriter, r *http.Request) {
+	var req reprocessRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxEventBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err == nil {
+		err = expectEOF(dec)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "invalid body",
+		})
+		return
+	}
+	if !reprocessable[req.Status] {
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "status must be failed or processed",
+		})
+		return
+	}
+
+	var from, to *time.Time
+	switch {
+	case req.From != "" || req.To != "":
+		f, t, err := exportRange(req.From, req.To)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		}
+		from, to = &f, &t
+	case !req.Confirm:
+		writeJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "reprocessing without from/to affects every " + req.Status + " event; set confirm to true",
+		})
+		return
+	}
+
+	var reprocessed int
+	for _, db := range h.db.All() {
+		rows, err := db.Query(r.Context(), `
+		UPDATE cart_events
+		SET status = 'pending', process_after = CURRENT_TIMESTAMP, retry_count = 0,
+			failure_reason = NULL, notified_at = NULL, degraded = false
+		WHERE status = $1
+		AND ($2::timestamptz IS NULL OR created_at >= $2)
+		AND ($3::timestamptz IS NULL OR created_at < $3)
+		RETURNING id::text`, req.Status, from, to)
+		var ids []string
+		if err == nil {
+			ids, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		}
+		if err != nil {
+			internalError(w, r, err)
+			return
+		}
+		for _, id := range ids {
+			h.hook.Fire(id, req.Status, "pending")
+		}
+		reprocessed += len(ids)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{
+		"reprocessed": reprocessed,
+	})
+}
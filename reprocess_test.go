@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// reprocess posts body to /admin/reprocess as the admin.
+func reprocess(h *Handler, body string) *httptest.ResponseRecorder {
+	h.adminKey = "admin-key"
+	req := httptest.NewRequest("POST", "/admin/reprocess", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReprocessScopedToRange(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult {
+		return fakeResult{columns: []fakeColumn{{"id", pgtype.TextOID}}, rows: [][]any{{fakeID(1)}, {fakeID(2)}}}
+	})
+	db := NewHashRouter(f.pool(t))
+	hook := &StatusHook{queue: make(chan statusChange, 10)}
+	h := &Handler{db: db, read: db, hook: hook}
+
+	rec := reprocess(h, `{"status":"failed","from":"2024-01-01","to":"2024-01-02"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"reprocessed":2}` {
+		t.Fatalf("reprocess: %d %s", rec.Code, rec.Body)
+	}
+	q := f.Queries()
+	if len(q) != 1 || !containsAll(q[0], "WHERE status =  'failed'", "'2024-01-01 00:00:00Z'", "'2024-01-02 00:00:00Z'") {
+		t.Errorf("queries = %q, want the status and range", q)
+	}
+	for i := 1; i <= 2; i++ {
+		if c := <-hook.queue; c.EventID != fakeID(i) || c.OldStatus != "failed" || c.NewStatus != "pending" {
+			t.Errorf("hook got %+v", c)
+		}
+	}
+
+	for body, want := range map[string]string{
+		`{"status":"pending","confirm":true}`:                  "status must be failed or processed",
+		`{"status":"failed"}`:                                  "set confirm to true",
+		`{"status":"failed","from":"2024-01-01"}`:              "from and to are required",
+		`{"status":"failed","from":"2024-01-01","to":"later"}`: "invalid to",
+		`{"status":"failed","confirm":true} {}`:                "invalid body",
+		`{"status":"failed","scope":"all"}`:                    "invalid body",
+	} {
+		rec := reprocess(h, body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("reprocess %s: %d %s, want 400 %q", body, rec.Code, rec.Body, want)
+		}
+	}
+	if n := len(f.Queries()); n != 1 {
+		t.Errorf("%d queries, rejected requests must not touch the database", n)
+	}
+}
+
+func TestReprocessLeavesOtherEventsAlone(t *testing.T) {
+	pool := testDB(t)
+	seed := func(status, createdAt string) string {
+		id := seedEvent(t, pool, "session-1")
+		setEventStatus(t, pool, status, id)
+		if _, err := pool.Exec(context.Background(), "UPDATE cart_events SET created_at = $2, retry_count = 3 WHERE id = $1", id, createdAt); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	inRange := seed("failed", "2024-01-01 12:00:00Z")
+	before := seed("failed", "2023-12-31 23:59:59Z")
+	after := seed("failed", "2024-01-02 00:00:00Z")
+	processed := seed("processed", "2024-01-01 12:00:00Z")
+	db := NewHashRouter(pool)
+
+	rec := reprocess(&Handler{db: db, read: db}, `{"status":"failed","from":"2024-01-01","to":"2024-01-02"}`)
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"reprocessed":1}` {
+		t.Fatalf("reprocess: %d %s", rec.Code, rec.Body)
+	}
+	for id, want := range map[string]string{inRange: "pending", before: "failed", after: "failed", processed: "processed"} {
+		if got := eventStatus(t, pool, id); got != want {
+			t.Errorf("event %s: %q, want %s", id, got, want)
+		}
+	}
+	var retries int
+	if err := pool.QueryRow(context.Background(), "SELECT retry_count FROM cart_events WHERE id = $1", inRange).Scan(&retries); err != nil || retries != 0 {
+		t.Errorf("retry_count %d, %v, want reset to 0", retries, err)
+	}
+}
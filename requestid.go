@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+type requestIDKey struct{}
+
+// withRequestID tags every request with a correlation ID, taken from the
+// caller's X-Request-ID header when it looks sane and generated otherwise,
+// and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the correlation ID withRequestID stored in ctx, or ""
+// outside a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logStackTraces adds the stack to internal error logs, set from
+// DEBUG_STACK_TRACES.
+var logStackTraces bool
+
+// logInternalError logs an unexpected handler error with the request's
+// correlation ID, and the stack of the caller when logStackTraces is on.
+func logInternalError(r *http.Request, err error) {
+	if logStackTraces {
+		log.Printf("Internal error [request %s] %s %s: %v\n%s", requestID(r.Context()), r.Method, r.URL.Path, err, debug.Stack())
+		return
+	}
+	log.Printf("Internal error [request %s] %s %s: %v", requestID(r.Context()), r.Method, r.URL.Path, err)
+}
+
+// internalError logs err and responds 500 with just the request ID to
+// look it up by. Database errors can name tables and columns, so the
+// error itself never goes to the client.
+func internalError(w http.ResponseWriter, r *http.Request, err error) {
+	logInternalError(r, err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{
+		"error":     "internal error",
+		"requestId": requestID(r.Context()),
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog sends the standard logger to a buffer for the rest of the
+// test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestInternalError(t *testing.T) {
+	secret := errors.New(`relation "cart_events" does not exist`)
+	for _, debug := range []bool{false, true} {
+		logs := captureLog(t)
+		logStackTraces = debug
+		t.Cleanup(func() { logStackTraces = false })
+
+		handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			internalError(w, r, secret)
+		}))
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/events", nil)
+		req.Header.Set("X-Request-ID", "req-1")
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("status = %d", rec.Code)
+		}
+		var body map[string]string
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body["error"] != "internal error" || body["requestId"] != "req-1" || len(body) != 2 {
+			t.Errorf("debug %v: body = %v, want only the generic error and request ID", debug, body)
+		}
+		if !strings.Contains(logs.String(), secret.Error()) || !strings.Contains(logs.String(), "req-1") {
+			t.Errorf("debug %v: log %q lacks the error or request ID", debug, logs)
+		}
+		if hasStack := strings.Contains(logs.String(), "runtime/debug.Stack"); hasStack != debug {
+			t.Errorf("debug %v: stack trace logged = %v", debug, hasStack)
+		}
+	}
+}
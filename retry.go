@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetrySchedule lists how long to wait before each retry of a failed
+// notification: the first retry waits s[0], the second s[1], and so on.
+// Once every step is used up the event is dead-lettered as failed. A nil
+// schedule retries immediately and forever.
+type RetrySchedule []time.Duration
+
+// parseRetrySchedule parses a comma-separated list of durations such as
+// "10s,1m,5m,30m". An empty spec returns nil.
+func parseRetrySchedule(spec string) (RetrySchedule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var schedule RetrySchedule
+	for _, step := range strings.Split(spec, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(step))
+		if err != nil {
+			return nil, fmt.Errorf("retry schedule %q: %w", spec, err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("retry schedule %q: negative delay %s", spec, d)
+		}
+		schedule = append(schedule, d)
+	}
+	return schedule, nil
+}
+
+// Next returns the delay before the next attempt of an event that has
+// already been retried retryCount times, and false if the schedule is
+// exhausted.
+func (s RetrySchedule) Next(retryCount int) (time.Duration, bool) {
+	if s == nil {
+		return 0, true
+	}
+	if retryCount < 0 || retryCount >= len(s) {
+		return 0, false
+	}
+	return s[retryCount], true
+}
+
+// RetryAfterError is a downstream refusal that said when to come back.
+// The event is retried after After instead of the next schedule step.
+type RetryAfterError struct {
+	Status string
+	After  time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("downstream returned %s, retry after %s", e.Status, e.After)
+}
+
+// parseRetryAfter reads a Retry-After header, given either as seconds or
+// as an HTTP date. Dates in the past mean no wait.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
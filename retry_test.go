@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryScheduleNext(t *testing.T) {
+	schedule, err := parseRetrySchedule("10s, 1m,5m,30m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+	for retries, delay := range want {
+		got, ok := schedule.Next(retries)
+		if !ok || got != delay {
+			t.Errorf("Next(%d) = %s, %v, want %s", retries, got, ok, delay)
+		}
+	}
+	if _, ok := schedule.Next(len(want)); ok {
+		t.Error("schedule not exhausted after its last step")
+	}
+	if _, ok := schedule.Next(-1); ok {
+		t.Error("Next(-1) gave a delay")
+	}
+
+	var none RetrySchedule
+	if d, ok := none.Next(1000); !ok || d != 0 {
+		t.Errorf("nil schedule Next = %s, %v, want an immediate retry", d, ok)
+	}
+	for _, bad := range []string{"10s,soon", "-1m", "10s,,1m"} {
+		if _, err := parseRetrySchedule(bad); err == nil {
+			t.Errorf("parseRetrySchedule(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestRetrySetsProcessAfterFromSchedule(t *testing.T) {
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "UPDATE 1"} })
+	db := f.pool(t)
+	captureLog(t)
+	p := &Pool{retries: RetrySchedule{10 * time.Second, time.Minute, 5 * time.Minute}}
+
+	for retries, secs := range []string{"10", "60", "300"} {
+		p.retry(db, PGCartEvent{ID: fakeID(1), RetryCount: retries}, errors.New("downstream unavailable"))
+		last := lastUpdate(f)
+		if !containsAll(last, "retry_count = retry_count + 1", "process_after = CURRENT_TIMESTAMP + make_interval", "'"+secs+"'") {
+			t.Errorf("retry %d: %q, want process_after %ss out", retries+1, last, secs)
+		}
+	}
+	p.retry(db, PGCartEvent{ID: fakeID(1), RetryCount: 3}, errors.New("downstream unavailable"))
+	if last := lastUpdate(f); !strings.Contains(last, "SET status = 'failed'") {
+		t.Errorf("exhausted retry: %q, want the event failed", last)
+	}
+}
+
+// lastUpdate returns the last UPDATE f received.
+func lastUpdate(f *fakePG) string {
+	var last string
+	for _, q := range f.Queries() {
+		if strings.Contains(q, "UPDATE") {
+			last = q
+		}
+	}
+	return last
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Mon, 01 Jan 2024 12:01:30 GMT", 90 * time.Second, true},
+		{"Monday, 01-Jan-24 12:00:10 GMT", 10 * time.Second, true},
+		{"Mon Jan  1 12:00:05 2024", 5 * time.Second, true},
+		{"Mon, 01 Jan 2024 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"1.5", 0, false},
+		{"tomorrow", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.header, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterOverridesSchedule(t *testing.T) {
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer downstream.Close()
+	f := newFakePG(t, func(string) fakeResult { return fakeResult{tag: "UPDATE 1"} })
+	captureLog(t)
+	p := &Pool{retries: RetrySchedule{10 * time.Second}}
+
+	event := PGCartEvent{ID: fakeID(1)}
+	err := NewHTTPNotifier(downstream.URL, downstream.Client(), "", "").Notify(context.Background(), event)
+	var retryAfter *RetryAfterError
+	if !errors.As(err, &retryAfter) || retryAfter.After != 2*time.Minute {
+		t.Fatalf("Notify = %v, want a RetryAfterError of 2m", err)
+	}
+	p.retry(f.pool(t), event, err)
+	if last := lastUpdate(f); !containsAll(last, "process_after = CURRENT_TIMESTAMP + make_interval", "'120'") {
+		t.Errorf("retry: %q, want process_after 120s out", last)
+	}
+}
+
+func TestExhaustedSignalledOnce(t *testing.T) {
+	var wrote atomic.Bool
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "SET status = 'failed'") && !wrote.Swap(true) {
+			return fakeResult{err: pgError("57P01", "terminating connection due to administrator command")}
+		}
+		return fakeResult{tag: "UPDATE 1"}
+	})
+	db := f.pool(t)
+	logs := captureLog(t)
+	p := &Pool{retries: RetrySchedule{time.Second, time.Second}}
+	before := exhaustedNotifications.Value()
+
+	cause := errors.New("downstream returned 502 Bad Gateway")
+	for retries := 0; retries < 2; retries++ {
+		p.retry(db, PGCartEvent{ID: fakeID(1), RetryCount: retries}, cause)
+	}
+	if strings.Contains(logs.String(), "notification_exhausted") {
+		t.Fatalf("exhausted while retries were left:\n%s", logs)
+	}
+	// The first attempt to mark it failed is lost; the event is retried
+	// from processing and only settling it counts.
+	p.retry(db, PGCartEvent{ID: fakeID(1), RetryCount: 2}, cause)
+	p.retry(db, PGCartEvent{ID: fakeID(1), RetryCount: 2}, cause)
+
+	if n := strings.Count(logs.String(), "notification_exhausted"); n != 1 {
+		t.Errorf("notification_exhausted logged %d times:\n%s", n, logs)
+	}
+	if !strings.Contains(logs.String(), `notification_exhausted event_id=`+fakeID(1)+` retries=2 last_error="downstream returned 502 Bad Gateway"`) {
+		t.Errorf("exhausted log lacks the event or error:\n%s", logs)
+	}
+	if n := exhaustedNotifications.Value() - before; n != 1 {
+		t.Errorf("notifications_exhausted_total went up %v, want 1", n)
+	}
+}
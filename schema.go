@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrations run in order on every start, so each one must be idempotent.
+// Append new steps rather than editing old ones.
+var migrations = []string{
+	`
+	CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+	CREATE TABLE IF NOT EXISTS cart_events (
+		id UUID DEFAULT uuid_generate_v4() PRIMARY KEY,
+		order_type varchar(30) not null,
+		session_id text not null,
+		card varchar(16) not null,
+		event_date timestamptz not null,
+		website_url text not null,
+		status varchar(20) DEFAULT 'pending',
+		created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);`,
+	`
+	CREATE TABLE IF NOT EXISTS event_attempts (
+		id bigserial PRIMARY KEY,
+		event_id UUID not null REFERENCES cart_events (id) ON DELETE CASCADE,
+		attempt_number int not null,
+		status varchar(20) not null,
+		error text,
+		attempted_at timestamptz DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS event_attempts_event_id_idx ON event_attempts (event_id);`,
+	// Tables created before timestamps carried a zone. The database runs in
+	// UTC, so existing values are interpreted as UTC.
+	`
+	DO $$
+	BEGIN
+		IF (SELECT data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'cart_events' AND column_name = 'event_date'
+		) = 'timestamp without time zone' THEN
+			ALTER TABLE cart_events
+				ALTER COLUMN event_date TYPE timestamptz USING event_date AT TIME ZONE 'UTC',
+				ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'UTC';
+			ALTER TABLE event_attempts
+				ALTER COLUMN attempted_at TYPE timestamptz USING attempted_at AT TIME ZONE 'UTC';
+		END IF;
+	END $$;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS degraded boolean NOT NULL DEFAULT false;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS failure_reason text;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS notified_at timestamptz;`,
+	`
+	ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS process_after timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE INDEX IF NOT EXISTS cart_events_pending_idx ON cart_events (process_after) WHERE status = 'pending';`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS retry_count int NOT NULL DEFAULT 0;`,
+	// status_changed_at is maintained by the database so every writer,
+	// including manual fixes, keeps it accurate.
+	`
+	ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS status_changed_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP;
+	CREATE OR REPLACE FUNCTION cart_events_touch_status() RETURNS trigger AS $$
+	BEGIN
+		IF NEW.status IS DISTINCT FROM OLD.status THEN
+			NEW.status_changed_at := CURRENT_TIMESTAMP;
+		END IF;
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS cart_events_status_changed ON cart_events;
+	CREATE TRIGGER cart_events_status_changed BEFORE UPDATE ON cart_events
+		FOR EACH ROW EXECUTE FUNCTION cart_events_touch_status();`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS raw_payload text;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS region text;`,
+	// Existing rows get card_last_four from the card_last_four backfill.
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS card_last_four varchar(4);`,
+	// Wakes LISTEN_NOTIFY listeners. Only the ID is sent to stay far below
+	// the 8000 byte payload limit. The trigger calling it is managed by
+	// notifyTrigger.
+	`
+	CREATE OR REPLACE FUNCTION cart_events_notify() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('cart_events', NEW.id::text);
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;`,
+	`CREATE INDEX IF NOT EXISTS cart_events_session_active_idx ON cart_events (session_id, created_at) WHERE status IN ('pending', 'processing');`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS instance_id text;`,
+	`CREATE INDEX IF NOT EXISTS cart_events_session_idx ON cart_events (session_id, created_at, id);`,
+	`
+	CREATE TABLE IF NOT EXISTS dead_letter_events (
+		id UUID PRIMARY KEY,
+		order_type varchar(30) not null,
+		session_id text not null,
+		card varchar(16) not null,
+		event_date timestamptz not null,
+		website_url text not null,
+		created_at timestamptz not null,
+		failed_at timestamptz not null DEFAULT CURRENT_TIMESTAMP,
+		failure_reason text not null,
+		retry_count int not null,
+		attempts int not null
+	);
+	CREATE INDEX IF NOT EXISTS dead_letter_events_failed_at_idx ON dead_letter_events (failed_at);`,
+	`
+	ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS tenant_id text;
+	ALTER TABLE dead_letter_events ADD COLUMN IF NOT EXISTS tenant_id text;
+	CREATE INDEX IF NOT EXISTS cart_events_tenant_idx ON cart_events (tenant_id, created_at, id);`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS raw_payload_gzip bytea;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS schema_version smallint NOT NULL DEFAULT 1;`,
+	`ALTER TABLE cart_events ADD COLUMN IF NOT EXISTS priority smallint NOT NULL DEFAULT 0;`,
+	// Attempts are the audit trail and must outlive a dead-lettered
+	// event, so deleting it from cart_events no longer cascades to them.
+	`ALTER TABLE event_attempts DROP CONSTRAINT IF EXISTS event_attempts_event_id_fkey;`,
+	`
+	CREATE TABLE IF NOT EXISTS schema_backfills (
+		name text PRIMARY KEY,
+		done_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`,
+}
+
+// backfills fill a new column in rows that existed before it. Unlike
+// migrations they only run until they finish once per database, which
+// schema_backfills records, and each statement updates one batch of at
+// most $1 rows, so a large table is never locked as a whole. Every batch
+// must exclude the rows it already did.
+var backfills = []struct{ name, batch string }{
+	{"card_last_four", `
+	UPDATE cart_events SET card_last_four = right(card, 4)
+	WHERE id IN (
+		SELECT id FROM cart_events
+		WHERE card_last_four IS NULL AND card ~ '[0-9]{4}$'
+		LIMIT $1
+	)`},
+}
+
+// BackfillBatchSize is how many rows a backfill updates per statement.
+const BackfillBatchSize = 1000
+
+func migrate(ctx context.Context, db *pgxpool.Pool, listenNotify bool) error {
+	for _, query := range migrations {
+		if _, err := db.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+	return notifyTrigger(ctx, db, listenNotify)
+}
+
+// duplicateObject is the SQLSTATE for creating a trigger that exists.
+const duplicateObject = "42710"
+
+// notifyTrigger adds the insert trigger that wakes LISTEN_NOTIFY
+// listeners when listenNotify is set and removes it when it isn't, so
+// inserts don't pay for a pg_notify nobody listens to. Creating or
+// dropping a trigger locks the whole table, so it only does either when
+// the trigger has to change. Every instance sharing a database therefore
+// needs the same LISTEN_NOTIFY.
+func notifyTrigger(ctx context.Context, db *pgxpool.Pool, listenNotify bool) error {
+	var exists bool
+	err := db.QueryRow(ctx, `
+	SELECT EXISTS (
+		SELECT 1 FROM pg_trigger
+		WHERE tgrelid = 'cart_events'::regclass AND tgname = 'cart_events_inserted'
+	)`).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	switch {
+	case listenNotify && !exists:
+		_, err = db.Exec(ctx, `
+		CREATE TRIGGER cart_events_inserted AFTER INSERT ON cart_events
+			FOR EACH ROW EXECUTE FUNCTION cart_events_notify()`)
+		// Another instance starting at the same time created it first.
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == duplicateObject {
+			err = nil
+		}
+	case !listenNotify && exists:
+		_, err = db.Exec(ctx, "DROP TRIGGER IF EXISTS cart_events_inserted ON cart_events")
+	}
+	return err
+}
+
+// backfill runs the backfills db hasn't finished yet. It is meant to run
+// in the background after startup; an interrupted backfill carries on
+// where it left off on the next start.
+func backfill(ctx context.Context, db *pgxpool.Pool) error {
+	for _, b := range backfills {
+		var done bool
+		err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM schema_backfills WHERE name = $1)", b.name).Scan(&done)
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+		for {
+			tag, err := db.Exec(ctx, b.batch, BackfillBatchSize)
+			if err != nil {
+				return fmt.Errorf("backfill %s: %w", b.name, err)
+			}
+			if tag.RowsAffected() == 0 {
+				break
+			}
+		}
+		if _, err := db.Exec(ctx, "INSERT INTO schema_backfills (name) VALUES ($1) ON CONFLICT DO NOTHING", b.name); err != nil {
+			return fmt.Errorf("backfill %s: %w", b.name, err)
+		}
+	}
+	return nil
+}
+
+// requiredSchema lists the tables and columns the service reads or
+// writes, in the order they are checked. dead_letter_events is only
+// required with DEAD_LETTER_TABLE.
+var requiredSchema = []struct {
+	table   string
+	columns []string
+}{
+	{"cart_events", []string{
+		"id", "order_type", "session_id", "card", "event_date", "website_url", "status", "created_at",
+		"degraded", "failure_reason", "notified_at", "process_after", "retry_count", "status_changed_at",
+		"raw_payload", "region", "card_last_four", "instance_id", "tenant_id", "raw_payload_gzip",
+		"schema_version", "priority",
+	}},
+	{"event_attempts", []string{"id", "event_id", "attempt_number", "status", "error", "attempted_at"}},
+	{"dead_letter_events", []string{
+		"id", "order_type", "session_id", "card", "event_date", "website_url", "created_at", "failed_at",
+		"failure_reason", "retry_count", "attempts", "tenant_id",
+	}},
+}
+
+// checkSchema pings db and fails if a table or column the service needs
+// is missing, for deployments that manage the schema externally. Every
+// missing piece is reported at once.
+func checkSchema(ctx context.Context, db *pgxpool.Pool, deadLetter bool) error {
+	if err := db.Ping(ctx); err != nil {
+		return err
+	}
+	var problems []string
+	for _, required := range requiredSchema {
+		if required.table == "dead_letter_events" && !deadLetter {
+			continue
+		}
+		rows, err := db.Query(ctx, `
+		SELECT column_name::text FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1`, required.table)
+		if err != nil {
+			return err
+		}
+		columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			problems = append(problems, fmt.Sprintf("table %s does not exist", required.table))
+			continue
+		}
+		var missing []string
+		for _, column := range required.columns {
+			if !slices.Contains(columns, column) {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("table %s is missing columns %s", required.table, strings.Join(missing, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s; apply the migrations or unset SKIP_SCHEMA_INIT", strings.Join(problems, "; "))
+	}
+	return nil
+}
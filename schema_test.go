@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// fakeSchema answers checkSchema's column queries from tables.
+func fakeSchema(tables map[string][]string) func(sql string) fakeResult {
+	return func(sql string) fakeResult {
+		res := fakeResult{columns: []fakeColumn{{"column_name", pgtype.TextOID}}}
+		for table, columns := range tables {
+			if strings.Contains(sql, "'"+table+"'") {
+				for _, column := range columns {
+					res.rows = append(res.rows, []any{column})
+				}
+			}
+		}
+		return res
+	}
+}
+
+// fullSchema returns every required table with all its columns.
+func fullSchema() map[string][]string {
+	tables := map[string][]string{}
+	for _, required := range requiredSchema {
+		tables[required.table] = append([]string(nil), required.columns...)
+	}
+	return tables
+}
+
+func TestCheckSchema(t *testing.T) {
+	without := func(columns []string, drop ...string) []string {
+		return slices.DeleteFunc(columns, func(c string) bool { return slices.Contains(drop, c) })
+	}
+	tests := []struct {
+		name       string
+		change     func(map[string][]string)
+		deadLetter bool
+		wantErr    []string
+	}{
+		{name: "complete", deadLetter: true},
+		{
+			name:   "no dead letter table without DEAD_LETTER_TABLE",
+			change: func(s map[string][]string) { delete(s, "dead_letter_events") },
+		},
+		{
+			name:       "no dead letter table with DEAD_LETTER_TABLE",
+			change:     func(s map[string][]string) { delete(s, "dead_letter_events") },
+			deadLetter: true,
+			wantErr:    []string{"table dead_letter_events does not exist"},
+		},
+		{
+			name:    "missing table",
+			change:  func(s map[string][]string) { delete(s, "event_attempts") },
+			wantErr: []string{"table event_attempts does not exist"},
+		},
+		{
+			name: "missing columns",
+			change: func(s map[string][]string) {
+				s["cart_events"] = without(s["cart_events"], "process_after", "retry_count", "priority", "tenant_id")
+			},
+			wantErr: []string{"table cart_events is missing columns process_after, retry_count, tenant_id, priority"},
+		},
+		{
+			name: "every problem at once",
+			change: func(s map[string][]string) {
+				delete(s, "event_attempts")
+				s["cart_events"] = without(s["cart_events"], "schema_version")
+			},
+			wantErr: []string{"cart_events is missing columns schema_version", "table event_attempts does not exist", "apply the migrations"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables := fullSchema()
+			if tt.change != nil {
+				tt.change(tables)
+			}
+			db := newFakePG(t, fakeSchema(tables)).pool(t)
+			err := checkSchema(context.Background(), db, tt.deadLetter)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("schema accepted")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMigratedSchemaPassesCheck(t *testing.T) {
+	db := testDB(t)
+	if err := checkSchema(context.Background(), db, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOffsetTimestampReadBackInUTC(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db}
+	event := CartEvent{OrderType: "Purchase", SessionID: "session-1", Card: "4433**1409", EventDate: "2024-01-01T10:00:00+02:00", WebsiteURL: "https://example.com"}
+	if _, err := h.ingest(context.Background(), event, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var eventDate time.Time
+	if err := pool.QueryRow(context.Background(), "SELECT event_date FROM cart_events").Scan(&eventDate); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	if !eventDate.Equal(want) || eventDate.Location() != time.UTC {
+		t.Errorf("event_date = %s, want %s", eventDate, want)
+	}
+}
+
+func TestTimestampMigrationReadsOldValuesAsUTC(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	// Put cart_events back the way tables created before the migration
+	// were, with a zoneless value in it.
+	_, err := db.Exec(ctx, `
+	ALTER TABLE cart_events
+		ALTER COLUMN event_date TYPE timestamp,
+		ALTER COLUMN created_at TYPE timestamp;
+	ALTER TABLE event_attempts ALTER COLUMN attempted_at TYPE timestamp;
+	INSERT INTO cart_events (order_type, session_id, card, event_date, website_url, created_at)
+	VALUES ('Purchase', 'session-1', '4433**1409', '2024-01-01 10:00:00', 'https://example.com', '2024-01-01 09:00:00')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated, err := initDB(os.Getenv("TEST_DATABASE_URL"), false, false, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+	rows, err := migrated.Query(ctx, `
+	SELECT data_type FROM information_schema.columns
+	WHERE table_schema = current_schema()
+	AND (table_name, column_name) IN (('cart_events', 'event_date'), ('cart_events', 'created_at'), ('event_attempts', 'attempted_at'))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range types {
+		if typ != "timestamp with time zone" {
+			t.Errorf("column still %s after the migration", typ)
+		}
+	}
+
+	var eventDate, createdAt time.Time
+	if err := migrated.QueryRow(ctx, "SELECT event_date, created_at FROM cart_events").Scan(&eventDate, &createdAt); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC); !eventDate.Equal(want) {
+		t.Errorf("event_date = %s, want %s", eventDate, want)
+	}
+	if want := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC); !createdAt.Equal(want) {
+		t.Errorf("created_at = %s, want %s", createdAt, want)
+	}
+}
+
+func TestMigrationsDontRewriteRows(t *testing.T) {
+	for i, query := range migrations {
+		if strings.Contains(query, "UPDATE cart_events") {
+			t.Errorf("migration %d updates cart_events on every start; make it a backfill:\n%s", i, query)
+		}
+	}
+}
+
+func TestBackfillRunsInBatchesOnce(t *testing.T) {
+	var mu sync.Mutex
+	remaining := 2500
+	done := false
+	var batches []int
+	f := newFakePG(t, func(sql string) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(sql, "SELECT EXISTS"):
+			exists := "f"
+			if done {
+				exists = "t"
+			}
+			return fakeResult{columns: []fakeColumn{{"exists", pgtype.BoolOID}}, rows: [][]any{{exists}}}
+		case strings.Contains(sql, "UPDATE cart_events SET card_last_four"):
+			n := min(remaining, BackfillBatchSize)
+			remaining -= n
+			batches = append(batches, n)
+			return fakeResult{tag: fmt.Sprintf("UPDATE %d", n)}
+		case strings.Contains(sql, "INSERT INTO schema_backfills"):
+			done = true
+			return fakeResult{tag: "INSERT 0 1"}
+		}
+		return fakeResult{}
+	})
+	db := f.pool(t)
+
+	for i := 0; i < 2; i++ {
+		if err := backfill(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []int{1000, 1000, 500, 0}; !slices.Equal(batches, want) || !done {
+		t.Errorf("batches %v, done %v; want %v once, then recorded", batches, done, want)
+	}
+}
+
+func TestBackfillCardLastFour(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, "DELETE FROM schema_backfills WHERE name = 'card_last_four'"); err != nil {
+		t.Fatal(err)
+	}
+	id := seedEvent(t, db, "session-1")
+	if err := backfill(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var lastFour string
+	if err := db.QueryRow(ctx, "SELECT card_last_four FROM cart_events WHERE id = $1", id).Scan(&lastFour); err != nil {
+		t.Fatal(err)
+	}
+	if lastFour != "1409" {
+		t.Errorf("card_last_four = %q, want 1409", lastFour)
+	}
+}
+
+func TestNotifyTriggerFollowsListenNotify(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		listen, exists bool
+		createErr      *pgconn.PgError
+		want           string // DDL issued, if any
+	}{
+		{name: "on, missing", listen: true, want: "CREATE TRIGGER"},
+		{name: "on, present", listen: true, exists: true},
+		{name: "off, present", exists: true, want: "DROP TRIGGER"},
+		{name: "off, missing"},
+		{name: "on, created concurrently", listen: true, createErr: pgError(duplicateObject, `trigger "cart_events_inserted" for relation "cart_events" already exists`), want: "CREATE TRIGGER"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakePG(t, func(sql string) fakeResult {
+				switch {
+				case strings.Contains(sql, "pg_trigger"):
+					exists := "f"
+					if tc.exists {
+						exists = "t"
+					}
+					return fakeResult{columns: []fakeColumn{{"exists", pgtype.BoolOID}}, rows: [][]any{{exists}}}
+				case strings.Contains(sql, "CREATE TRIGGER"):
+					return fakeResult{tag: "CREATE TRIGGER", err: tc.createErr}
+				}
+				return fakeResult{tag: "DROP TRIGGER"}
+			})
+			if err := notifyTrigger(context.Background(), f.pool(t), tc.listen); err != nil {
+				t.Fatal(err)
+			}
+			var ddl []string
+			for _, query := range f.Queries() {
+				if strings.Contains(query, "TRIGGER") {
+					ddl = append(ddl, query)
+				}
+			}
+			if tc.want == "" && len(ddl) > 0 {
+				t.Errorf("trigger changed although it was already right:\n%s", strings.Join(ddl, "\n"))
+			}
+			if tc.want != "" && (len(ddl) != 1 || !strings.Contains(ddl[0], tc.want)) {
+				t.Errorf("issued %q, want one %s", ddl, tc.want)
+			}
+		})
+	}
+}
+
+func TestMigrationsLeaveNotifyTriggerAlone(t *testing.T) {
+	for i, query := range migrations {
+		if strings.Contains(query, "cart_events_inserted") {
+			t.Errorf("migration %d touches the LISTEN_NOTIFY trigger on every start:\n%s", i, query)
+		}
+	}
+}
+
+func TestNoNotifyWithoutListenNotify(t *testing.T) {
+	db := testDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := migrate(ctx, db, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { notifyTrigger(context.Background(), db, true) })
+
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+	if _, err := conn.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		t.Fatal(err)
+	}
+	seedEvent(t, db, "session-1")
+	wait, stop := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer stop()
+	if n, err := conn.Conn().WaitForNotification(wait); err == nil {
+		t.Errorf("got notification %q with LISTEN_NOTIFY off", n.Payload)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ShardRouter hides how cart_events are spread across databases. Inserts
+// go to the shard owning the session, workers poll every shard.
+type ShardRouter interface {
+	ForSession(sessionID string) *pgxpool.Pool
+	All() []*pgxpool.Pool
+	Close()
+}
+
+type hashRouter struct {
+	shards []*pgxpool.Pool
+	closed sync.Once
+}
+
+func NewHashRouter(shards ...*pgxpool.Pool) ShardRouter {
+	return &hashRouter{shards: shards}
+}
+
+func (r *hashRouter) ForSession(sessionID string) *pgxpool.Pool {
+	return r.shards[shardIndex(sessionID, len(r.shards))]
+}
+
+func (r *hashRouter) All() []*pgxpool.Pool {
+	return r.shards
+}
+
+// Close closes every shard. Calling it again does nothing.
+func (r *hashRouter) Close() {
+	r.closed.Do(func() {
+		for _, db := range r.shards {
+			db.Close()
+		}
+	})
+}
+
+func shardIndex(sessionID string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// initReadShards connects to read replicas, one per primary shard in the
+// same order. Replicas are never migrated. With no URLs the primary router
+// is returned as is.
+func initReadShards(databaseURLs []string, primary ShardRouter, minConns int) (ShardRouter, error) {
+	if len(databaseURLs) == 0 {
+		return primary, nil
+	}
+	if len(databaseURLs) != len(primary.All()) {
+		return nil, fmt.Errorf("got %d read database URLs for %d shards", len(databaseURLs), len(primary.All()))
+	}
+	return openShards(databaseURLs, func(url string) (*pgxpool.Pool, error) {
+		return connectDB(url, minConns)
+	})
+}
+
+func initShards(databaseURLs []string, skipSchema, deadLetter, listenNotify bool, minConns int) (ShardRouter, error) {
+	return openShards(databaseURLs, func(url string) (*pgxpool.Pool, error) {
+		return initDB(url, skipSchema, deadLetter, listenNotify, minConns)
+	})
+}
+
+func openShards(databaseURLs []string, open func(string) (*pgxpool.Pool, error)) (ShardRouter, error) {
+	shards := make([]*pgxpool.Pool, 0, len(databaseURLs))
+	for _, url := range databaseURLs {
+		db, err := open(url)
+		if err != nil {
+			for _, s := range shards {
+				s.Close()
+			}
+			return nil, err
+		}
+		shards = append(shards, db)
+	}
+	return NewHashRouter(shards...), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestShardIndex(t *testing.T) {
+	counts := make([]int, 2)
+	for i := 0; i < 1000; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		n := shardIndex(session, 2)
+		if n < 0 || n > 1 {
+			t.Fatalf("shardIndex(%q, 2) = %d", session, n)
+		}
+		if again := shardIndex(session, 2); again != n {
+			t.Fatalf("shardIndex(%q, 2) = %d, then %d", session, n, again)
+		}
+		counts[n]++
+	}
+	// Both shards take a fair share of sessions.
+	for i, c := range counts {
+		if c < 400 {
+			t.Errorf("shard %d got %d of 1000 sessions", i, c)
+		}
+	}
+}
+
+func TestEventsLandOnTheirShard(t *testing.T) {
+	fakes := []*fakePG{
+		newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} }),
+		newFakePG(t, func(string) fakeResult { return fakeResult{tag: "INSERT 0 1"} }),
+	}
+	router := NewHashRouter(fakes[0].pool(t), fakes[1].pool(t))
+	h := &Handler{db: router, read: router}
+
+	want := make([]int, 2)
+	for i := 0; i < 20; i++ {
+		session := fmt.Sprintf("session-%d", i)
+		if router.ForSession(session) != router.All()[shardIndex(session, 2)] {
+			t.Fatalf("ForSession(%q) is not shard %d", session, shardIndex(session, 2))
+		}
+		event := CartEvent{OrderType: "Purchase", SessionID: session, Card: "4433**1409", EventDate: "2024-01-01T00:00:00Z", WebsiteURL: "https://example.com"}
+		if _, err := h.ingest(context.Background(), event, nil); err != nil {
+			t.Fatal(err)
+		}
+		want[shardIndex(session, 2)]++
+	}
+
+	for i, f := range fakes {
+		var got int
+		for _, q := range f.Queries() {
+			if !strings.Contains(q, "INSERT INTO cart_events") {
+				continue
+			}
+			got++
+			for j := 0; j < 20; j++ {
+				session := fmt.Sprintf("session-%d", j)
+				if strings.Contains(q, "'"+session+"'") && shardIndex(session, 2) != i {
+					t.Errorf("%s inserted on shard %d, want %d", session, i, shardIndex(session, 2))
+				}
+			}
+		}
+		if got != want[i] {
+			t.Errorf("shard %d got %d inserts, want %d", i, got, want[i])
+		}
+	}
+}
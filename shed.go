@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	shedEvents = newCounter("events_shed_total",
+		"Ingest requests rejected with 429 because the pending backlog was over SHED_PENDING_THRESHOLD.")
+	sheddingActive = newGauge("load_shedding_active",
+		"1 while the pending backlog is over SHED_PENDING_THRESHOLD and ingest requests are being shed.")
+)
+
+// loadShedder rejects a fraction of ingest requests while too many events
+// are pending, a last resort that keeps the backlog from growing faster
+// than the workers can drain it. The backlog is counted every interval
+// rather than per request.
+type loadShedder struct {
+	db         ShardRouter
+	threshold  int
+	fraction   float64
+	overloaded atomic.Bool
+}
+
+func newLoadShedder(db ShardRouter, threshold int, fraction float64) *loadShedder {
+	if threshold <= 0 {
+		return nil
+	}
+	return &loadShedder{db: db, threshold: threshold, fraction: fraction}
+}
+
+// run recounts the backlog every interval until ctx is done.
+func (s *loadShedder) run(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		s.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *loadShedder) check(ctx context.Context) {
+	pending := 0
+	for _, db := range s.db.All() {
+		n, err := countPending(ctx, db, s.threshold+1)
+		if err != nil {
+			if !isShutdown(ctx, err) {
+				log.Println("Error counting pending events:", err)
+			}
+			// Keep the last verdict rather than guessing.
+			return
+		}
+		pending += n
+	}
+	overloaded := pending > s.threshold
+	if overloaded != s.overloaded.Swap(overloaded) {
+		if overloaded {
+			log.Printf("Over %d events pending, shedding %g of ingest requests", s.threshold, s.fraction)
+			sheddingActive.Set(1)
+		} else {
+			log.Println("Pending backlog back under the threshold, no longer shedding")
+			sheddingActive.Set(0)
+		}
+	}
+}
+
+// countPending counts pending events on db, stopping at limit so a huge
+// backlog doesn't make the check itself expensive.
+func countPending(ctx context.Context, db *pgxpool.Pool, limit int) (int, error) {
+	var n int
+	err := db.QueryRow(ctx, `SELECT count(*) FROM (
+		SELECT 1 FROM cart_events WHERE status = 'pending' LIMIT $1
+	) p`, limit).Scan(&n)
+	return n, err
+}
+
+// shed reports whether to reject this request.
+func (s *loadShedder) shed() bool {
+	return s != nil && s.overloaded.Load() && rand.Float64() < s.fraction
+}
+
+// shedding answers 429 for the fraction of requests h.shedder picks while
+// the backlog is over the threshold. Wrapped around the ingest routes.
+func (h *Handler) shedding(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.shedder.shed() {
+			shedEvents.Inc()
+			w.Header().Set("Retry-After", "5")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{
+				"error": "too many events pending, retry later",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestLoadSheddingUnderOverload(t *testing.T) {
+	var pending atomic.Int64
+	f := newFakePG(t, func(sql string) fakeResult {
+		if !strings.Contains(sql, "count(*)") {
+			return fakeResult{}
+		}
+		return fakeResult{
+			columns: []fakeColumn{{"count", pgtype.Int8OID}},
+			rows:    [][]any{{strconv.FormatInt(pending.Load(), 10)}},
+		}
+	})
+	captureLog(t)
+	const fraction = 0.3
+	h := &Handler{shedder: newLoadShedder(NewHashRouter(f.pool(t)), 100, fraction)}
+	handler := h.shedding(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, "event recieved and stored")
+	})
+
+	// send posts n events and returns how many were shed.
+	send := func(n int) int {
+		shed := 0
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("POST", "/event", nil))
+			switch rec.Code {
+			case http.StatusOK:
+			case http.StatusTooManyRequests:
+				shed++
+				if got := rec.Header().Get("Retry-After"); got != "5" {
+					t.Fatalf("shed response Retry-After = %q, want 5", got)
+				}
+			default:
+				t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+			}
+		}
+		return shed
+	}
+
+	pending.Store(50)
+	h.shedder.check(context.Background())
+	if shed := send(100); shed != 0 {
+		t.Errorf("%d requests shed under the threshold", shed)
+	}
+
+	pending.Store(500)
+	h.shedder.check(context.Background())
+	if sheddingActive.Value() != 1 {
+		t.Error("load_shedding_active not set while overloaded")
+	}
+	const requests = 4000
+	before := shedEvents.Value()
+	shed := send(requests)
+	if rate := float64(shed) / requests; rate < fraction-0.05 || rate > fraction+0.05 {
+		t.Errorf("shed %.3f of requests, want about %g", rate, fraction)
+	}
+	if got := shedEvents.Value() - before; got != uint64(shed) {
+		t.Errorf("events_shed_total went up %d, want %d", got, shed)
+	}
+
+	pending.Store(10)
+	h.shedder.check(context.Background())
+	if shed := send(100); shed != 0 || sheddingActive.Value() != 0 {
+		t.Errorf("still shedding %d requests once the backlog drained", shed)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	// hex(HMAC-SHA256("secret", `1700000000.{"id":"1"}`)), computed independently.
+	const want = "086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	if got := signature([]byte("secret"), "1700000000", []byte(`{"id":"1"}`)); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	req := httptest.NewRequest("POST", "/", nil)
+	signRequest(req, body, []byte("secret"))
+
+	ts := req.Header.Get("X-Signature-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(sec, 0)).Abs() > time.Minute {
+		t.Fatalf("X-Signature-Timestamp = %q, want the current unix time", ts)
+	}
+	if got, want := req.Header.Get("X-Signature"), "sha256="+signature([]byte("secret"), ts, body); got != want {
+		t.Errorf("X-Signature = %q, want %q", got, want)
+	}
+
+	unsigned := httptest.NewRequest("POST", "/", nil)
+	signRequest(unsigned, body, nil)
+	if unsigned.Header.Get("X-Signature") != "" || unsigned.Header.Get("X-Signature-Timestamp") != "" {
+		t.Error("signed a request without a secret")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var droppedStatusChanges = newCounter("status_webhook_dropped_total",
+	"Status changes not sent to the webhook because its queue was full.")
+
+// StatusHookTimeout caps one call to the status webhook.
+const StatusHookTimeout = 10 * time.Second
+
+type statusChange struct {
+	EventID   string    `json:"eventId"`
+	OldStatus string    `json:"oldStatus"`
+	NewStatus string    `json:"newStatus"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// StatusHook posts every event status transition to a webhook. Delivery
+// is best effort: Fire never blocks, and changes are dropped when the
+// queue is full or the webhook fails. A nil *StatusHook does nothing.
+type StatusHook struct {
+	url    string
+	client *http.Client
+	queue  chan statusChange
+}
+
+func NewStatusHook(ctx context.Context, url string, client *http.Client) *StatusHook {
+	if url == "" {
+		return nil
+	}
+	h := &StatusHook{
+		url:    url,
+		client: client,
+		queue:  make(chan statusChange, 1000),
+	}
+	go h.run(ctx)
+	return h
+}
+
+func (h *StatusHook) Fire(eventID, oldStatus, newStatus string) {
+	if h == nil {
+		return
+	}
+	change := statusChange{
+		EventID:   eventID,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		ChangedAt: time.Now().UTC(),
+	}
+	select {
+	case h.queue <- change:
+	default:
+		droppedStatusChanges.Inc()
+	}
+}
+
+func (h *StatusHook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-h.queue:
+			if err := h.send(ctx, change); err != nil && !isShutdown(ctx, err) {
+				log.Printf("Status webhook failed for event %s: %v", change.EventID, err)
+			}
+		}
+	}
+}
+
+func (h *StatusHook) send(ctx context.Context, change statusChange) error {
+	body, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusHookFiresPerTransition(t *testing.T) {
+	var mu sync.Mutex
+	changes := map[string][]string{}
+	received := make(chan struct{}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change statusChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("webhook body: %v", err)
+		}
+		mu.Lock()
+		changes[change.EventID] = append(changes[change.EventID], change.OldStatus+"->"+change.NewStatus)
+		mu.Unlock()
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	exhausted := fakeEventRow(fakeID(2))
+	exhausted[fakeColRetryCount] = "1"
+	queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1)), exhausted}}
+	db := newFakePG(t, queue.handle).pool(t)
+	captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The first event goes through on its retry, the second has no
+	// retries left.
+	firstCalls := 0
+	p := &Pool{
+		batchSize:  10,
+		sequential: true,
+		retries:    RetrySchedule{0},
+		hook:       NewStatusHook(ctx, srv.URL, srv.Client()),
+		notifier: notifierFunc(func(_ context.Context, event PGCartEvent) error {
+			if event.ID == fakeID(1) {
+				if firstCalls++; firstCalls > 1 {
+					return nil
+				}
+			}
+			return errors.New("downstream unavailable")
+		}),
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := p.process(ctx, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{
+		fakeID(1): "pending->processing processing->pending pending->processing processing->processed",
+		fakeID(2): "pending->processing processing->failed",
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook got %d of 6 changes: %v", i, changes)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for id, transitions := range want {
+		if got := strings.Join(changes[id], " "); got != transitions {
+			t.Errorf("event %s: transitions %q, want %q", id, got, transitions)
+		}
+	}
+}
+
+func TestStatusHookNeverBlocks(t *testing.T) {
+	// Nothing drains the queue, as if the webhook hung.
+	hook := &StatusHook{queue: make(chan statusChange, 1)}
+	before := droppedStatusChanges.Value()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			hook.Fire(fakeID(i), "pending", "processing")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fire blocked on a full queue")
+	}
+	if n := droppedStatusChanges.Value() - before; n != 2 {
+		t.Errorf("%d changes dropped, want 2", n)
+	}
+	var nilHook *StatusHook
+	nilHook.Fire(fakeID(1), "pending", "processing")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+)
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type tenantKey struct{}
+
+// tenantScoped requires an X-Tenant-ID header when MULTI_TENANT is on and
+// passes it on in the request context. Events are stored with the tenant
+// and reads only see the caller's own tenant.
+func (h *Handler) tenantScoped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.multiTenant {
+			next(w, r)
+			return
+		}
+		id := r.Header.Get("X-Tenant-ID")
+		if id == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "X-Tenant-ID header is required",
+			})
+			return
+		}
+		if !tenantPattern.MatchString(id) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "X-Tenant-ID must be 1 to 64 letters, digits, '.', '_' or '-'",
+			})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, id)))
+	}
+}
+
+// tenantID returns the tenant tenantScoped stored in ctx, or "" when
+// multi-tenancy is off. Queries treat "" as no tenant filter.
+func tenantID(ctx context.Context) string {
+	id, _ := ctx.Value(tenantKey{}).(string)
+	return id
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// tenantRequest runs a request as tenant through h's routes.
+func tenantRequest(h *Handler, method, path, tenant, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		req.Header.Set("X-Tenant-ID", tenant)
+	}
+	rec := httptest.NewRecorder()
+	h.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestTenantScopesEveryQuery(t *testing.T) {
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") {
+			return fakeResult{tag: "INSERT 0 1"}
+		}
+		return fakeEvents()
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, multiTenant: true}
+
+	for _, tenant := range []string{"", "acme corp", strings.Repeat("a", 65)} {
+		if rec := tenantRequest(h, "GET", "/events", tenant, ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("X-Tenant-ID %q: %d, want 400", tenant, rec.Code)
+		}
+	}
+	if n := len(f.Queries()); n != 0 {
+		t.Fatalf("%d queries without a valid tenant", n)
+	}
+
+	tenantRequest(h, "POST", "/event", "acme", validEvent(""))
+	tenantRequest(h, "GET", "/events", "acme", "")
+	tenantRequest(h, "GET", "/events/"+fakeID(1), "acme", "")
+	tenantRequest(h, "GET", "/events/export?from=2024-01-01&to=2024-01-02", "acme", "")
+	scoped := 0
+	for _, q := range f.Queries() {
+		if q == "" {
+			continue
+		}
+		if !strings.Contains(q, "'acme'") {
+			t.Errorf("query not scoped to the tenant: %q", q)
+		}
+		scoped++
+	}
+	if scoped != 4 {
+		t.Errorf("%d queries, want one per request", scoped)
+	}
+}
+
+func TestTenantsCannotSeeEachOther(t *testing.T) {
+	pool := testDB(t)
+	db := NewHashRouter(pool)
+	h := &Handler{db: db, read: db, multiTenant: true}
+
+	if rec := tenantRequest(h, "POST", "/event", "acme", validEvent("")); rec.Code != http.StatusOK {
+		t.Fatalf("post: %d %s", rec.Code, rec.Body)
+	}
+	var id string
+	if err := pool.QueryRow(context.Background(), "SELECT id FROM cart_events WHERE tenant_id = 'acme'").Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	today := "from=" + now.Format(time.DateOnly) + "&to=" + now.AddDate(0, 0, 1).Format(time.DateOnly)
+	for tenant, visible := range map[string]bool{"acme": true, "globex": false} {
+		if rec := tenantRequest(h, "GET", "/events/"+id, tenant, ""); (rec.Code == http.StatusOK) != visible {
+			t.Errorf("%s get: %d", tenant, rec.Code)
+		}
+		var page eventPage
+		rec := tenantRequest(h, "GET", "/events", tenant, "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || (len(page.Events) == 1) != visible {
+			t.Errorf("%s list: %d %s", tenant, rec.Code, rec.Body)
+		}
+		rec = tenantRequest(h, "GET", "/events/export?"+today, tenant, "")
+		if strings.Contains(rec.Body.String(), id) != visible {
+			t.Errorf("%s export: %d %s", tenant, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestTenantReadsWithoutDeadLetterTable(t *testing.T) {
+	for _, deadLetters := range []bool{false, true} {
+		f := newFakePG(t, func(sql string) fakeResult {
+			if strings.Contains(sql, "dead_letter_events") && !deadLetters {
+				return fakeResult{err: pgError("42P01", `relation "dead_letter_events" does not exist`)}
+			}
+			return fakeResult{columns: []fakeColumn{{"attempt_number", pgtype.Int4OID}}}
+		})
+		db := NewHashRouter(f.pool(t))
+		captureLog(t)
+		h := &Handler{db: db, read: db, multiTenant: true, deadLetters: deadLetters}
+
+		if rec := tenantRequest(h, "GET", "/events/"+fakeID(1)+"/attempts", "acme", ""); rec.Code != http.StatusOK {
+			t.Errorf("deadLetters=%v attempts: %d %s", deadLetters, rec.Code, rec.Body)
+		}
+		rec := tenantRequest(h, "GET", "/dead-letters", "acme", "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deadLetters":[]`) {
+			t.Errorf("deadLetters=%v dead letters: %d %s", deadLetters, rec.Code, rec.Body)
+		}
+		used := false
+		for _, q := range f.Queries() {
+			used = used || strings.Contains(q, "dead_letter_events")
+		}
+		if used != deadLetters {
+			t.Errorf("deadLetters=%v: queried dead_letter_events %v", deadLetters, used)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDB connects to TEST_DATABASE_URL, migrates it with the
+// LISTEN_NOTIFY trigger and empties every table. Tests that need real Postgres behaviour use it and are skipped
+// when the variable is unset. They share the database, so none of them
+// may run in parallel.
+func testDB(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := initDB(url, false, false, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if _, err := db.Exec(context.Background(), "TRUNCATE cart_events, event_attempts, dead_letter_events"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// seedEvent inserts a due pending event for session and returns its id.
+func seedEvent(t testing.TB, db *pgxpool.Pool, sessionID string) string {
+	t.Helper()
+	var id string
+	err := db.QueryRow(context.Background(), `
+	INSERT INTO cart_events (order_type, session_id, card, event_date, website_url)
+	VALUES ('Purchase', $1, '4433**1409', CURRENT_TIMESTAMP, 'https://example.com/cart')
+	RETURNING id`, sessionID).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// eventStatus returns the status of event id, or "" if it is gone.
+func eventStatus(t *testing.T, db *pgxpool.Pool, id string) string {
+	t.Helper()
+	var status string
+	err := db.QueryRow(context.Background(), "SELECT status FROM cart_events WHERE id = $1", id).Scan(&status)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatal(err)
+	}
+	return status
+}
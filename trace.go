@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// traceNotifications gives every notification attempt a W3C trace ID,
+// set from METRICS_EXEMPLARS. The ID is sent downstream in traceparent
+// and attached to notification_duration_seconds as an exemplar, so a slow
+// notification on a dashboard can be followed to the downstream's trace.
+var traceNotifications bool
+
+type traceKey struct{}
+
+// spanContext is the part of a W3C trace context we propagate.
+type spanContext struct {
+	traceID string // 32 hex digits
+	spanID  string // 16 hex digits
+}
+
+// withNewTrace starts a trace for one notification attempt.
+func withNewTrace(ctx context.Context) context.Context {
+	trace := make([]byte, 16)
+	span := make([]byte, 8)
+	rand.Read(trace)
+	rand.Read(span)
+	return context.WithValue(ctx, traceKey{}, spanContext{
+		traceID: hex.EncodeToString(trace),
+		spanID:  hex.EncodeToString(span),
+	})
+}
+
+// traceID returns the trace ID withNewTrace stored in ctx, or "".
+func traceID(ctx context.Context) string {
+	sc, _ := ctx.Value(traceKey{}).(spanContext)
+	return sc.traceID
+}
+
+// setTraceParent adds the traceparent header for the trace in ctx, if any.
+func setTraceParent(req *http.Request) {
+	if sc, ok := req.Context().Value(traceKey{}).(spanContext); ok {
+		req.Header.Set("traceparent", "00-"+sc.traceID+"-"+sc.spanID+"-01")
+	}
+}
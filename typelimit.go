@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// typeLimiter caps concurrent notifications per order type, since
+// downstreams differ in how much load each type can take. Types without
+// a limit, and a nil typeLimiter, are unlimited.
+type typeLimiter map[string]chan struct{}
+
+// parseTypeLimits parses "orderType=max" pairs such as
+// "subscription=2,one-time=10".
+func parseTypeLimits(pairs []string) (map[string]int, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	limits := map[string]int{}
+	for _, pair := range pairs {
+		orderType, v, ok := strings.Cut(pair, "=")
+		orderType = strings.TrimSpace(orderType)
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || orderType == "" || err != nil || n <= 0 {
+			return nil, fmt.Errorf("order type limit %q must look like subscription=2", pair)
+		}
+		limits[orderType] = n
+	}
+	return limits, nil
+}
+
+func newTypeLimiter(limits map[string]int) typeLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	l := typeLimiter{}
+	for orderType, n := range limits {
+		l[orderType] = make(chan struct{}, n)
+	}
+	return l
+}
+
+// acquire waits for a slot for orderType and returns the function that
+// gives it back, or ctx's error.
+func (l typeLimiter) acquire(ctx context.Context, orderType string) (func(), error) {
+	sem, ok := l[orderType]
+	if !ok {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
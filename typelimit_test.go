@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTypeLimitsUnderLoad(t *testing.T) {
+	limits := map[string]int{"subscription": 2, "one-time": 10}
+	var rows [][]any
+	for i := 1; i <= 40; i++ {
+		row := fakeEventRow(fakeID(i))
+		row[1] = "subscription"
+		switch {
+		case i%4 == 1:
+			row[1] = "one-time"
+		case i%4 == 2:
+			row[1] = "gift"
+		}
+		rows = append(rows, row)
+	}
+	queue := &fakeQueue{rows: rows}
+	f := newFakePG(t, queue.handle)
+
+	var mu sync.Mutex
+	inFlight, peak := map[string]int{}, map[string]int{}
+	slow := notifierFunc(func(_ context.Context, event PGCartEvent) error {
+		mu.Lock()
+		inFlight[event.OrderType]++
+		peak[event.OrderType] = max(peak[event.OrderType], inFlight[event.OrderType])
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight[event.OrderType]--
+		mu.Unlock()
+		return nil
+	})
+	p := &Pool{batchSize: 40, notifier: slow, typeLimits: newTypeLimiter(limits)}
+	if _, err := p.process(context.Background(), f.pool(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for orderType, limit := range limits {
+		if peak[orderType] > limit {
+			t.Errorf("%d %s notifications in flight, limit %d", peak[orderType], orderType, limit)
+		}
+	}
+	// The limits must not serialize everything: other types still run
+	// side by side.
+	if peak["one-time"] < 3 || peak["gift"] < 3 {
+		t.Errorf("peaks %v, want one-time and gift to run concurrently", peak)
+	}
+	for _, row := range rows {
+		if got := queue.status(row[0].(string)); got != "processed" {
+			t.Errorf("event %s: status %q", row[0], got)
+		}
+	}
+}
+
+func TestParseTypeLimits(t *testing.T) {
+	limits, err := parseTypeLimits([]string{"subscription=2", " one-time = 10 "})
+	if err != nil || len(limits) != 2 || limits["subscription"] != 2 || limits["one-time"] != 10 {
+		t.Errorf("parseTypeLimits = %v, %v", limits, err)
+	}
+	for _, pair := range []string{"subscription", "=2", "subscription=0", "subscription=x"} {
+		if _, err := parseTypeLimits([]string{pair}); err == nil {
+			t.Errorf("parseTypeLimits(%q) succeeded", pair)
+		}
+	}
+}
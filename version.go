@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Event payloads are versioned so their shape can change without breaking
+// clients still sending an older one. The version comes from the
+// X-Schema-Version header or a "version" field and defaults to 1. Every
+// version is upgraded to the version 1 shape CartEvent decodes, and the
+// version is stored in schema_version.
+const (
+	DefaultSchemaVersion = 1
+	LatestSchemaVersion  = 2
+	SchemaVersionHeader  = "X-Schema-Version"
+)
+
+var errUnsupportedVersion = errors.New("unsupported schema version")
+
+// schemaRenames maps the keys a version renamed to the version 1 keys
+// CartEvent uses. Version 2 renamed eventDate to occurredAt and
+// websiteUrl to pageUrl.
+var schemaRenames = map[int]map[string]string{
+	2: {"occurredAt": "eventDate", "pageUrl": "websiteUrl"},
+}
+
+// headerVersion reads X-Schema-Version, zero if it isn't set.
+func headerVersion(r *http.Request) (int, error) {
+	v := r.Header.Get(SchemaVersionHeader)
+	if v == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("%w %q", errUnsupportedVersion, v)
+	}
+	return version, nil
+}
+
+// upgradeEvent removes the "version" field from fields and rewrites them
+// to the version 1 shape. header is the version the request declared, or
+// zero; a body that declares a different one is an error. It returns the
+// version the event was sent in and whether fields changed.
+func upgradeEvent(fields map[string]json.RawMessage, header int) (int, bool, error) {
+	version := header
+	raw, ok := fields["version"]
+	if ok {
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return 0, false, fmt.Errorf("%w %s", errUnsupportedVersion, raw)
+		}
+		if header != 0 && v != header {
+			return 0, false, fmt.Errorf("version %d does not match %s %d", v, SchemaVersionHeader, header)
+		}
+		version = v
+		delete(fields, "version")
+	}
+	if version == 0 {
+		version = DefaultSchemaVersion
+	}
+	if version < 1 || version > LatestSchemaVersion {
+		return 0, false, fmt.Errorf("%w %d", errUnsupportedVersion, version)
+	}
+
+	changed := ok
+	for key, old := range schemaRenames[version] {
+		// The old spelling is not part of this version.
+		if _, ok := fields[old]; ok {
+			return 0, false, fmt.Errorf("%s is not a version %d field, use %s", old, version, key)
+		}
+		if v, ok := fields[key]; ok {
+			fields[old] = v
+			delete(fields, key)
+			changed = true
+		}
+	}
+	return version, changed, nil
+}
+
+// versionedField returns the name field has in version, so validation
+// errors point at the key the client actually sent.
+func versionedField(version int, field string) string {
+	for key, old := range schemaRenames[version] {
+		if old == field {
+			return key
+		}
+	}
+	return field
+}
+
+// parseVersionedDate parses eventDate as version allows: version 1 also
+// takes the Postgres text format, later versions only RFC 3339.
+func parseVersionedDate(version int, s string) (time.Time, string, error) {
+	if version >= 2 {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t.UTC(), "must be an RFC 3339 timestamp", err
+	}
+	t, err := parseEventDate(s)
+	return t, "must be an RFC 3339 or Postgres timestamp", err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSchemaVersionsDecodeToSameEvent(t *testing.T) {
+	v1 := `{"orderType":"Purchase","sessionId":"s","card":"4111111111111111","eventDate":"2024-01-01T10:00:00+02:00","websiteUrl":"https://example.com/cart"}`
+	v2 := `{"version":2,"orderType":"Purchase","sessionId":"s","card":"4111111111111111","occurredAt":"2024-01-01T10:00:00+02:00","pageUrl":"https://example.com/cart"}`
+	v2NoField := `{"orderType":"Purchase","sessionId":"s","card":"4111111111111111","occurredAt":"2024-01-01T10:00:00+02:00","pageUrl":"https://example.com/cart"}`
+	v2Snake := `{"version":2,"order_type":"Purchase","session_id":"s","card":"4111111111111111","occurred_at":"2024-01-01T10:00:00+02:00","page_url":"https://example.com/cart"}`
+
+	decode := func(body string, header int) PGCartEvent {
+		t.Helper()
+		event, err := unmarshalEvent([]byte(body), header)
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		pgEvent, err := event.toPGCartEvent()
+		if err != nil {
+			t.Fatalf("%s: %v", body, err)
+		}
+		return pgEvent
+	}
+	want := decode(v1, 0)
+	if want.SchemaVersion != 1 {
+		t.Errorf("version 1: SchemaVersion = %d", want.SchemaVersion)
+	}
+	for name, got := range map[string]PGCartEvent{
+		"version 1 by header":  decode(v1, 1),
+		"version 2 by field":   decode(v2, 0),
+		"version 2 by header":  decode(v2NoField, 2),
+		"version 2 by both":    decode(v2, 2),
+		"version 2 snake_case": decode(v2Snake, 0),
+	} {
+		wantVersion := 2
+		if name == "version 1 by header" {
+			wantVersion = 1
+		}
+		if got.SchemaVersion != wantVersion {
+			t.Errorf("%s: SchemaVersion = %d, want %d", name, got.SchemaVersion, wantVersion)
+		}
+		got.SchemaVersion = want.SchemaVersion
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestSchemaVersionErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		header      int
+		unsupported bool
+	}{
+		{"unknown version", `{"version":3,"orderType":"Purchase"}`, 0, true},
+		{"unknown header", `{"orderType":"Purchase"}`, 3, true},
+		{"non-numeric version", `{"version":"two","orderType":"Purchase"}`, 0, true},
+		{"header and field disagree", `{"version":2,"orderType":"Purchase"}`, 1, false},
+		{"version 1 key in version 2", `{"version":2,"eventDate":"2024-01-01T00:00:00Z"}`, 0, false},
+		{"version 2 key in version 1", `{"version":1,"occurredAt":"2024-01-01T00:00:00Z"}`, 0, false},
+		{"snake_case version 1 key in version 2", `{"version":2,"event_date":"2024-01-01T00:00:00Z"}`, 0, false},
+		{"snake_case version 1 key by header", `{"website_url":"https://example.com"}`, 2, false},
+		{"snake_case version 2 key in version 1", `{"version":1,"occurred_at":"2024-01-01T00:00:00Z"}`, 0, false},
+		{"both spellings of a version 2 key", `{"version":2,"page_url":"https://a.example","pageUrl":"https://b.example"}`, 0, false},
+	}
+	for _, tt := range tests {
+		_, err := unmarshalEvent([]byte(tt.body), tt.header)
+		if err == nil {
+			t.Errorf("%s: decoded, want an error", tt.name)
+			continue
+		}
+		if got := errors.Is(err, errUnsupportedVersion); got != tt.unsupported {
+			t.Errorf("%s: err = %v, unsupported %v, want %v", tt.name, err, got, tt.unsupported)
+		}
+	}
+
+	// Version 2 only takes RFC 3339 dates and reports the version 2 key.
+	event, err := unmarshalEvent([]byte(`{"version":2,"orderType":"Purchase","sessionId":"s","card":"4433**1409","occurredAt":"2024-01-01 10:00:00","pageUrl":"https://example.com"}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = event.toPGCartEvent()
+	var errs ValidationErrors
+	if !errors.As(err, &errs) || !errs.has("occurredAt") {
+		t.Errorf("postgres date in version 2: err = %v, want an occurredAt error", err)
+	}
+}
+
+func TestAuditedVersion2BodyIsStored(t *testing.T) {
+	var mu sync.Mutex
+	var inserts []string
+	f := newFakePG(t, func(sql string) fakeResult {
+		if strings.Contains(sql, "INSERT INTO cart_events") {
+			mu.Lock()
+			inserts = append(inserts, sql)
+			mu.Unlock()
+		}
+		return fakeResult{tag: "INSERT 0 1"}
+	})
+	db := NewHashRouter(f.pool(t))
+	h := &Handler{db: db, read: db, auditRawMax: 4096}
+
+	// The escaped digit defeats the in-place replacement, so the body
+	// goes through the re-encoding fallback.
+	for _, body := range []string{
+		`{"version":2,"orderType":"Purchase","sessionId":"s","card":"4111111111111111","occurredAt":"2024-01-01T10:00:00Z","pageUrl":"https://example.com/cart"}`,
+		`{"version":2,"orderType":"Purchase","sessionId":"s","card":"411\u0031111111111111","occurredAt":"2024-01-01T10:00:00Z","pageUrl":"https://example.com/cart"}`,
+	} {
+		inserts = nil
+		req := httptest.NewRequest("POST", "/event", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Event(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, rec.Code, rec.Body)
+		}
+		if len(inserts) != 1 {
+			t.Fatalf("%s: %d inserts", body, len(inserts))
+		}
+		if !containsAll(inserts[0], `"occurredAt":"2024-01-01T10:00:00Z"`, `"pageUrl":"https://example.com/cart"`, `"card":"4111**1111"`) {
+			t.Errorf("%s: raw payload not stored masked and whole: %s", body, inserts[0])
+		}
+		if strings.Contains(inserts[0], "1111111111") {
+			t.Errorf("%s: full card stored: %s", body, inserts[0])
+		}
+	}
+}
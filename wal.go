@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// eventLog appends every processed event to a local file as one line of
+// JSON, a durable record that doesn't depend on the downstream. Each line
+// is synced to disk before Append returns. Once the file would grow past
+// maxSize it is renamed with a timestamp suffix and a new one is started,
+// so rotated files are never overwritten.
+type eventLog struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+// eventLogEntry is a notification with the time it was processed. Cards
+// are masked, as with WriterNotifier.
+type eventLogEntry struct {
+	notification
+	ProcessedAt time.Time `json:"processedAt"`
+}
+
+func openEventLog(path string, maxSize int64) (*eventLog, error) {
+	l := &eventLog{path: path, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *eventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+func (l *eventLog) Append(event PGCartEvent) error {
+	entry := eventLogEntry{notification: newNotification(event), ProcessedAt: time.Now().UTC()}
+	entry.Card = maskCard(entry.Card)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("rotate %s: %w", l.path, err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// rotate closes the current file, moves it aside and opens a fresh one.
+// The directory is synced so the rename survives a crash.
+func (l *eventLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := fmt.Sprintf("%s.%s", l.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(l.path, rotated); err != nil {
+		// Keep appending to the old file rather than losing records.
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return l.open()
+}
+
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEventLogAppendsAndRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.log")
+	event := func(n int) PGCartEvent {
+		return PGCartEvent{ID: fakeID(n), OrderType: "Purchase", SessionID: "session-1", Card: "4111111111111111", WebsiteURL: "https://example.com/cart"}
+	}
+
+	// Size the limit from a real line so three fit and the fourth starts a
+	// new file.
+	scratch := filepath.Join(dir, "scratch.log")
+	l, err := openEventLog(scratch, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(event(1)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	info, err := os.Stat(scratch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxSize := info.Size()*3 + info.Size()/2
+	l, err = openEventLog(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 4; n++ {
+		if err := l.Append(event(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("rotated files = %q, want one", rotated)
+	}
+	old := readEventLog(t, rotated[0])
+	if len(old) != 3 || old[0].ID != fakeID(1) || old[2].ID != fakeID(3) {
+		t.Errorf("rotated file holds %v, want events 1-3", old)
+	}
+	if info, err := os.Stat(rotated[0]); err != nil {
+		t.Fatal(err)
+	} else if info.Size() > maxSize {
+		t.Errorf("rotated file is %d bytes, limit %d", info.Size(), maxSize)
+	}
+	current := readEventLog(t, path)
+	if len(current) != 1 || current[0].ID != fakeID(4) {
+		t.Errorf("current file holds %v, want event 4", current)
+	}
+	if current[0].Card != maskCard("4111111111111111") || current[0].ProcessedAt.IsZero() {
+		t.Errorf("entry = %+v, want a masked card and processedAt", current[0])
+	}
+
+	// Reopening appends to the current file rather than truncating it.
+	l, err = openEventLog(path, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(event(5)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if got := readEventLog(t, path); len(got) != 2 || got[1].ID != fakeID(5) {
+		t.Errorf("after reopen current file holds %v, want events 4 and 5", got)
+	}
+	if err := l.Append(event(6)); err == nil {
+		t.Error("Append after Close succeeded")
+	}
+}
+
+func readEventLog(t *testing.T, path string) []eventLogEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []eventLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry eventLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
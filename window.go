@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily span of wall-clock time in a given location, e.g.
+// 09:00-18:00 in Europe/Berlin. A window whose end is before its start
+// wraps past midnight. A nil *TimeWindow contains every time.
+type TimeWindow struct {
+	start, end time.Duration // offset from local midnight
+	loc        *time.Location
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM" in timezone tz. An empty spec
+// returns nil.
+func parseTimeWindow(spec, tz string) (*TimeWindow, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("time window %q must look like 09:00-18:00", spec)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("time window %q is empty", spec)
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+	return &TimeWindow{start: start, end: end, loc: loc}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *TimeWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	t = t.In(w.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// Opened returns when the span containing t began. t must be inside the
+// window.
+func (w *TimeWindow) Opened(t time.Time) time.Time {
+	t = t.In(w.loc)
+	opened := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.loc).Add(w.start)
+	if opened.After(t) {
+		// A window wrapping past midnight that opened yesterday.
+		opened = opened.AddDate(0, 0, -1)
+	}
+	return opened
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowOpened(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	tests := []struct {
+		spec string
+		at   time.Time
+		want time.Time
+	}{
+		{"09:00-18:00", time.Date(2024, 3, 5, 12, 30, 0, 0, berlin), time.Date(2024, 3, 5, 9, 0, 0, 0, berlin)},
+		{"09:00-18:00", time.Date(2024, 3, 5, 9, 0, 0, 0, berlin), time.Date(2024, 3, 5, 9, 0, 0, 0, berlin)},
+		// Wrapping windows opened the evening before once past midnight.
+		{"22:00-06:00", time.Date(2024, 3, 5, 23, 0, 0, 0, berlin), time.Date(2024, 3, 5, 22, 0, 0, 0, berlin)},
+		{"22:00-06:00", time.Date(2024, 3, 5, 2, 0, 0, 0, berlin), time.Date(2024, 3, 4, 22, 0, 0, 0, berlin)},
+		// The window is evaluated in its own zone.
+		{"09:00-18:00", time.Date(2024, 3, 5, 8, 30, 0, 0, time.UTC), time.Date(2024, 3, 5, 9, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.spec, "Europe/Berlin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !w.Contains(tt.at) {
+			t.Fatalf("%s doesn't contain %s", tt.spec, tt.at)
+		}
+		if got := w.Opened(tt.at); !got.Equal(tt.want) {
+			t.Errorf("%s opened before %s = %s, want %s", tt.spec, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	tests := []struct {
+		spec string
+		at   time.Time
+		want bool
+	}{
+		{"09:00-18:00", time.Date(2024, 3, 5, 12, 0, 0, 0, berlin), true},
+		{"09:00-18:00", time.Date(2024, 3, 5, 9, 0, 0, 0, berlin), true},
+		{"09:00-18:00", time.Date(2024, 3, 5, 18, 0, 0, 0, berlin), false},
+		{"09:00-18:00", time.Date(2024, 3, 5, 8, 59, 59, 0, berlin), false},
+		// 08:30 UTC is 09:30 in Berlin, 17:30 UTC is 18:30.
+		{"09:00-18:00", time.Date(2024, 3, 5, 8, 30, 0, 0, time.UTC), true},
+		{"09:00-18:00", time.Date(2024, 3, 5, 17, 30, 0, 0, time.UTC), false},
+		{"22:00-06:00", time.Date(2024, 3, 5, 23, 0, 0, 0, berlin), true},
+		{"22:00-06:00", time.Date(2024, 3, 5, 3, 0, 0, 0, berlin), true},
+		{"22:00-06:00", time.Date(2024, 3, 5, 12, 0, 0, 0, berlin), false},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.spec, "Europe/Berlin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Contains(tt.at); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.spec, tt.at, got, tt.want)
+		}
+	}
+	var always *TimeWindow
+	if !always.Contains(time.Now()) {
+		t.Error("nil window excluded a time")
+	}
+}
+
+func TestEventsOutsideWindowRequeued(t *testing.T) {
+	now := time.Now().UTC()
+	clock := func(d time.Duration) string { return now.Add(d).Format("15:04") }
+	open, err := parseTimeWindow(clock(-time.Hour)+"-"+clock(time.Hour), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := parseTimeWindow(clock(2*time.Hour)+"-"+clock(3*time.Hour), "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		window *TimeWindow
+		want   string
+	}{{closed, "pending"}, {open, "processed"}} {
+		queue := &fakeQueue{rows: [][]any{fakeEventRow(fakeID(1))}}
+		db := newFakePG(t, queue.handle).pool(t)
+		notified := false
+		p := &Pool{batchSize: 10, window: tt.window, notifier: notifierFunc(func(context.Context, PGCartEvent) error {
+			notified = true
+			return nil
+		})}
+		if _, err := p.process(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		if got := queue.status(fakeID(1)); got != tt.want || notified != (tt.want == "processed") {
+			t.Errorf("window %s-%s: event %q, notified %v, want %s", tt.window.start, tt.window.end, got, notified, tt.want)
+		}
+	}
+}